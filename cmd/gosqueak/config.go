@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rebeljah/gosqueak/kit/certs"
+	"github.com/rebeljah/gosqueak/kit/config"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/server"
+	"github.com/rebeljah/gosqueak/services/auth/api"
+	messageapi "github.com/rebeljah/gosqueak/services/message/api"
+	messagedb "github.com/rebeljah/gosqueak/services/message/database"
+)
+
+// prefix of the environment variables configuring gosqueak
+const EnvPrefix = "GOSQUEAK_"
+
+// name of gosqueak in its spans
+const ServiceName = "gosqueak"
+
+// Configuration of both services, see DefaultConfig for the defaults.
+// Secrets such as key passphrases are only read from the environment.
+type Config struct {
+	// when set, both services are served on this address instead of
+	// AuthAddr and MessageAddr
+	Addr        string `yaml:"addr" toml:"addr" env:"ADDR" flag:"addr" usage:"single listen address of both services"`
+	AuthAddr    string `yaml:"auth_addr" toml:"auth_addr" env:"AUTH_ADDR" flag:"auth-addr" usage:"listen address of the auth server"`
+	MessageAddr string `yaml:"message_addr" toml:"message_addr" env:"MESSAGE_ADDR" flag:"message-addr" usage:"listen address of the message server"`
+	AuthDb      string `yaml:"auth_db" toml:"auth_db" env:"AUTH_DB" flag:"auth-db" usage:"users database file"`
+	MessageDb   string `yaml:"message_db" toml:"message_db" env:"MESSAGE_DB" flag:"message-db" usage:"messages database file"`
+	// the token issuer, shared with the auth server binary
+	api.IssuerConfig `yaml:",inline"`
+	// audience name of the message server, which must be one of Audiences
+	MessageName string `yaml:"message_name" toml:"message_name" env:"MESSAGE_NAME" flag:"message-name" usage:"audience name of the message server"`
+	// TLS on every listener, logs and traces, shared with the other
+	// binaries
+	server.Config `yaml:",inline"`
+	// token buckets per client IP and per token subject, keyed by route
+	// pattern, with "*" for the other routes; only set by the config file
+	RateLimits ratelimit.Routes `yaml:"rate_limits" toml:"rate_limits"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		AuthAddr:     "127.0.0.1:8081",
+		MessageAddr:  "127.0.0.1:8082",
+		AuthDb:       "users.sqlite",
+		MessageDb:    messagedb.DbFileName,
+		IssuerConfig: api.DefaultIssuerConfig(),
+		MessageName:  "MESSAGE_API",
+		Config:       server.DefaultConfig(),
+		RateLimits:   defaultRateLimits(),
+	}
+}
+
+// the limits of both servers, whose routes don't overlap
+func defaultRateLimits() ratelimit.Routes {
+	routes := messageapi.DefaultRateLimits()
+	for pattern, limits := range api.DefaultRateLimits() {
+		routes[pattern] = limits
+	}
+	return routes
+}
+
+func (c *Config) Validate() error {
+	if c.Addr != "" {
+		if err := config.CheckAddr("addr", c.Addr); err != nil {
+			return err
+		}
+	} else {
+		if err := config.CheckAddr("auth-addr", c.AuthAddr); err != nil {
+			return err
+		}
+		if err := config.CheckAddr("message-addr", c.MessageAddr); err != nil {
+			return err
+		}
+		if c.AuthAddr == c.MessageAddr {
+			return fmt.Errorf("auth-addr and message-addr are the same, set addr to share a listener")
+		}
+	}
+
+	err := config.CheckNotEmpty(map[string]string{
+		"auth-db":      c.AuthDb,
+		"message-db":   c.MessageDb,
+		"message-name": c.MessageName,
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.AuthDb == c.MessageDb {
+		return fmt.Errorf("auth-db and message-db must be different files")
+	}
+
+	if err := c.IssuerConfig.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.RateLimits.Validate(); err != nil {
+		return err
+	}
+
+	if _, ok := c.Audiences[c.MessageName]; !ok {
+		return fmt.Errorf("message-name: %v is not one of the audiences", c.MessageName)
+	}
+
+	return nil
+}
+
+// The TLS options of the listeners, on Addr or else AuthAddr and
+// MessageAddr
+func (c *Config) ListenerTlsOptions() certs.ServerOptions {
+	if c.Addr != "" {
+		return c.TlsOptions(c.Addr)
+	}
+	return c.TlsOptions(c.AuthAddr, c.MessageAddr)
+}
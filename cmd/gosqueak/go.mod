@@ -0,0 +1,10 @@
+module github.com/rebeljah/gosqueak/cmd/gosqueak
+
+go 1.22
+
+require (
+	github.com/rebeljah/gosqueak/jwt v0.0.0-20221127075846-6d7df96b1b31
+	github.com/rebeljah/gosqueak/kit v0.0.0-00010101000000-000000000000
+	github.com/rebeljah/gosqueak/services/auth v0.0.0-00010101000000-000000000000
+	github.com/rebeljah/gosqueak/services/message v0.0.0-00010101000000-000000000000
+)
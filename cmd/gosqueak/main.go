@@ -0,0 +1,112 @@
+// Command gosqueak runs the auth and message servers in one process, for
+// small deployments and local development. The message server verifies
+// tokens with the issuer's keys and checks revocations in the users
+// database directly, without requests to the auth server.
+//
+// Both servers listen on their own address, or share one when -addr is
+// set; their routes don't overlap. See -h for the configuration.
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/kit/certs"
+	"github.com/rebeljah/gosqueak/kit/config"
+	"github.com/rebeljah/gosqueak/kit/health"
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/kit/metrics"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/server"
+	"github.com/rebeljah/gosqueak/kit/tracing"
+	authapi "github.com/rebeljah/gosqueak/services/auth/api"
+	authdb "github.com/rebeljah/gosqueak/services/auth/database"
+	messageapi "github.com/rebeljah/gosqueak/services/message/api"
+	"github.com/rebeljah/gosqueak/services/message/chat"
+	messagedb "github.com/rebeljah/gosqueak/services/message/database"
+)
+
+// secrets are not part of the Config, so they stay out of config files
+const JwtKeyPassphraseEnv = "GOSQUEAK_JWT_KEY_PASSPHRASE"
+
+func main() {
+	cfg := DefaultConfig()
+	config.MustLoad(&cfg, EnvPrefix)
+
+	// before anything logs, the standard logger writes to it too
+	logger, err := logging.NewLogger(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	stopTracing, err := tracing.Setup(context.Background(), cfg.TraceOptions(ServiceName))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	usersDb := authdb.Load(cfg.AuthDb)
+	if err := authapi.GrantAdmins(context.Background(), usersDb, cfg.AdminUsers); err != nil {
+		log.Fatal(err)
+	}
+
+	iss, authAud, err := cfg.LoadIssuer([]byte(os.Getenv(JwtKeyPassphraseEnv)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authServ := authapi.NewServer(cfg.AuthAddr, usersDb, iss, authAud, cfg.Audiences)
+	authServ.UsePublicUrl(cfg.PublicUrl)
+
+	dataDb := messagedb.Load(cfg.MessageDb)
+	messageAud := jwt.NewKeySetAudience(iss.KeySet(), cfg.MessageName)
+	deny := authdb.DenyList{DB: usersDb}
+
+	messageServ := messageapi.NewServer(cfg.MessageAddr, dataDb, messageAud, deny, chat.NewRelay(dataDb))
+
+	// one limiter, the routes of the servers don't overlap
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), cfg.RateLimits)
+	authServ.UseRateLimits(limiter)
+	messageServ.UseRateLimits(limiter)
+
+	tlsCfg, err := certs.ServerConfig(cfg.ListenerTlsOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsCfg != nil {
+		authServ.UseTLS(tlsCfg)
+		messageServ.UseTLS(tlsCfg)
+	}
+
+	// the message server goes first, its deny-list reads the users database
+	serve := []func() error{messageServ.ListenAndServe, authServ.ListenAndServe}
+	shutdown := []func(context.Context) error{messageServ.Shutdown, authServ.Shutdown}
+
+	if cfg.Addr != "" {
+		mux := http.NewServeMux()
+		authServ.Mount(mux)
+		messageServ.Mount(mux)
+		mux.Handle("GET /metrics", metrics.Handler())
+		mux.HandleFunc("GET /healthz", health.Live)
+		mux.Handle("GET /readyz", health.Join(authServ.Ready(), messageServ.Ready()))
+
+		shared := server.New(cfg.Addr, mux)
+		// the relay socket hijacks the connection of GET /ws
+		shared.DisableHTTP2()
+		if tlsCfg != nil {
+			shared.UseTLS(tlsCfg)
+		}
+
+		serve = []func() error{shared.ListenAndServe}
+		shutdown = append([]func(context.Context) error{shared.Shutdown}, shutdown...)
+	}
+
+	// the spans of the shutdown are flushed last
+	shutdown = append(shutdown, stopTracing)
+
+	server.Run(serve, shutdown)
+}
@@ -1,74 +1,196 @@
 package jwt
 
 import (
-	"crypto/rsa"
+	"crypto"
 	b64 "encoding/base64"
-	"strconv"
-	"strings"
+	"fmt"
 	"time"
-
-	"github.com/rebeljah/gosqueak/jwt/rs256"
 )
 
 type Audience struct {
-	pub  *rsa.PublicKey
+	keys KeySet
 	Name string
+	// the token type accepted by the audience, TypAccess unless the
+	// audience is the issuer accepting its refresh tokens
+	TokenType string
+}
+
+// NewAudience returns an Audience that verifies every token with one key.
+func NewAudience(verifier Verifier, indentifier string) Audience {
+	return Audience{singleKey{verifier}, indentifier, TypAccess}
 }
 
-func NewAudience(pub *rsa.PublicKey, indentifier string) Audience {
-	return Audience{pub, indentifier}
+// NewKeySetAudience returns an Audience that verifies tokens with the key
+// named by their "kid" header.
+func NewKeySetAudience(keys KeySet, indentifier string) Audience {
+	return Audience{keys, indentifier, TypAccess}
 }
 
-// true IFF signature is real and claim aud is service audience name
+// true IFF signature is real, claim aud is service audience name and the
+// token is of the type accepted by the audience
 func (a Audience) JwtIsValid(jwt Jwt) bool {
-	if jwt.Body.Audience != a.Name {
+	if !jwt.Body.Audience.Contains(a.Name) || !jwt.Header.TypeIs(a.TokenType) {
+		return false
+	}
+
+	return SignatureIsValid(a.keys, jwt)
+}
+
+// true IFF the token is signed by the key in keys named by its kid header,
+// using the algorithm of that key. Claims are not checked.
+func SignatureIsValid(keys KeySet, jwt Jwt) bool {
+	verifier, ok := keys.Verifier(jwt.Header.KeyId)
+	if !ok {
+		return false
+	}
+
+	// only accept tokens signed with the algorithm of the selected key,
+	// anything else (including "none") is rejected outright
+	if jwt.Header.Algorithm != verifier.Alg() {
+		return false
+	}
+
+	// tokens that were never parsed have nothing to verify
+	if jwt.signed == "" {
 		return false
 	}
 
-	return rs256.VerifySignature(
-		append(toBytes(jwt.Header), toBytes(jwt.Body)...),
-		jwt.Signature,
-		a.pub,
-	)
+	return verifier.Verify(jwt.SigningInput(), jwt.Signature)
+}
+
+// KeySet holding a single key which is used whatever the requested kid
+type singleKey struct {
+	verifier Verifier
+}
+
+func (k singleKey) Verifier(kid string) (Verifier, bool) {
+	return k.verifier, true
+}
+
+type signingKey struct {
+	Signer
+	kid string
+}
+
+func newSigningKey(s Signer) signingKey {
+	// keys that can't be described as a JWK are used without a key id
+	jwk, _ := NewJwk(s.Alg(), s.Public())
+	return signingKey{s, jwk.KeyId}
 }
 
 type Issuer struct {
-	priv *rsa.PrivateKey
-	Name string
+	active   signingKey
+	retiring []signingKey
+	Name     string
 }
 
-func NewIssuer(priv *rsa.PrivateKey, indentifier string) Issuer {
-	return Issuer{priv, indentifier}
+// NewIssuer returns an Issuer that signs with signer. Retiring signers are
+// never used to sign, their keys are only published in the issuer's key set
+// so that tokens signed before a key rotation can still be verified, and
+// keys staged for the next rotation are known to audiences before use.
+func NewIssuer(signer Signer, indentifier string, retiring ...Signer) Issuer {
+	i := Issuer{active: newSigningKey(signer), Name: indentifier}
+
+	for _, s := range retiring {
+		i.retiring = append(i.retiring, newSigningKey(s))
+	}
+
+	return i
 }
 
-func (i Issuer) PublicKey() *rsa.PublicKey {
-	return &i.priv.PublicKey
+func (i Issuer) PublicKey() crypto.PublicKey {
+	return i.active.Public()
 }
 
+// Algorithm returns the "alg" header value of tokens minted by the issuer.
+func (i Issuer) Algorithm() string {
+	return i.active.Alg()
+}
+
+// KeyId returns the "kid" header value of tokens minted by the issuer.
+func (i Issuer) KeyId() string {
+	return i.active.kid
+}
+
+// KeySet returns the public keys of the active and retiring signers.
+func (i Issuer) KeySet() Jwks {
+	keys := Jwks{Keys: make([]Jwk, 0, 1+len(i.retiring))}
+
+	for _, k := range append([]signingKey{i.active}, i.retiring...) {
+		jwk, err := NewJwk(k.Alg(), k.Public())
+		if err != nil {
+			continue
+		}
+		keys.Keys = append(keys.Keys, jwk)
+	}
+
+	return keys
+}
+
+// CheckKey signs a probe with the active key and verifies it against the
+// key set, for the health checks of servers whose key may have become
+// unusable, such as one held by a remote signer.
+func (i Issuer) CheckKey() error {
+	if i.active.Signer == nil {
+		return fmt.Errorf("no signing key")
+	}
+
+	probe := []byte("gosqueak signing key check")
+	sig, err := i.active.Sign(probe)
+	if err != nil {
+		return err
+	}
+
+	v, ok := i.KeySet().Verifier(i.active.kid)
+	if !ok || !v.Verify(probe, sig) {
+		return fmt.Errorf("signing key %v does not match the key set", i.active.kid)
+	}
+	return nil
+}
+
+// Mint an access token for the audience aud
 func (i Issuer) MintToken(sub, aud string, duration time.Duration) Jwt {
-	exp := strconv.Itoa(int(time.Now().Add(duration).Unix()))
+	return i.mint(TypAccess, sub, aud, duration)
+}
+
+// Mint a refresh token, the audience of which is the issuer itself
+func (i Issuer) MintRefreshToken(sub string, duration time.Duration) Jwt {
+	return i.mint(TypRefresh, sub, i.Name, duration)
+}
+
+func (i Issuer) mint(typ, sub, aud string, duration time.Duration) Jwt {
+	exp := NumericDate(time.Now().Add(duration).Unix())
 
 	return Jwt{
-		Header{Alg, Typ},
-		Body{sub, aud, i.Name, exp, NewJwtId()},
+		Header{i.active.Alg(), typ, i.active.kid},
+		Body{sub, ClaimStrings{aud}, i.Name, exp, NewJwtId(), "", nil},
 		make([]byte, 0),
+		"",
 	}
 }
 
-// this method is non-deterministic
-func (i Issuer) StringifyJwt(jwt Jwt) string {
-	enc := b64.RawURLEncoding
-
-	var parts = make([]string, 0, 3)
-
-	h := toBytes(jwt.Header)
-	b := toBytes(jwt.Body)
+// Sign the token with the active key, returning its compact serialization.
+// Fails when the signer does, as a remote or misconfigured key may. This
+// method is non-deterministic.
+func (i Issuer) StringifyJwt(jwt Jwt) (string, error) {
+	// the header must name the algorithm and key actually used to sign
+	jwt.Header.Algorithm = i.active.Alg()
+	jwt.Header.KeyId = i.active.kid
+
+	input := signingInput(toBytes(jwt.Header), toBytes(jwt.Body))
+	sig, err := i.active.Sign(input)
+	if err != nil {
+		return "", err
+	}
 
-	parts = append(parts,
-		enc.EncodeToString(h),
-		enc.EncodeToString(b),
-		enc.EncodeToString(rs256.Signature(append(h, b...), i.priv)),
-	)
+	return string(input) + "." + b64.RawURLEncoding.EncodeToString(sig), nil
+}
 
-	return strings.Join(parts, ".")
+// StringifyJwt that panics when signing fails, for tests and tools.
+func (i Issuer) MustStringifyJwt(jwt Jwt) string {
+	s, err := i.StringifyJwt(jwt)
+	if err != nil {
+		panic(err)
+	}
+	return s
 }
@@ -0,0 +1,304 @@
+package jwt_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/eddsa"
+	"github.com/rebeljah/gosqueak/jwt/es256"
+	"github.com/rebeljah/gosqueak/jwt/ps256"
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+)
+
+var privKey *rsa.PrivateKey
+var ecKey *ecdsa.PrivateKey
+var edKey ed25519.PrivateKey
+
+func TestMain(m *testing.M) {
+	privKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey = es256.MustGeneratePrivateKey()
+	edKey = eddsa.MustGeneratePrivateKey()
+	m.Run()
+}
+
+func signers() []jwt.Signer {
+	return []jwt.Signer{
+		rs256.NewSigner(privKey),
+		ps256.NewSigner(privKey),
+		ecSigner(ecKey),
+		eddsa.NewSigner(edKey),
+	}
+}
+
+func ecSigner(k *ecdsa.PrivateKey) jwt.Signer {
+	s, err := es256.NewSigner(k)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func ecVerifier(k *ecdsa.PublicKey) jwt.Verifier {
+	v, err := es256.NewVerifier(k)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func verifiers() []jwt.Verifier {
+	return []jwt.Verifier{
+		rs256.NewVerifier(&privKey.PublicKey),
+		ps256.NewVerifier(&privKey.PublicKey),
+		ecVerifier(&ecKey.PublicKey),
+		eddsa.NewVerifier(edKey.Public().(ed25519.PublicKey)),
+	}
+}
+
+func TestRS256IsPKCS1v15(t *testing.T) {
+	iss := jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+	token := iss.MustStringifyJwt(iss.MintToken("sub", "aud", time.Minute))
+
+	parts := strings.Split(token, ".")
+	sig, err := b64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// any standard RS256 implementation must be able to verify the token
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&privKey.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Log(token)
+		t.Fatal(err)
+	}
+}
+
+func TestAlgorithmHeader(t *testing.T) {
+	for _, signer := range signers() {
+		iss := jwt.NewIssuer(signer, "TEST")
+		j, err := jwt.FromString(iss.MustStringifyJwt(iss.MintToken("sub", "aud", time.Minute)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if j.Header.Algorithm != signer.Alg() {
+			t.Fatalf("header alg %v, expected %v", j.Header.Algorithm, signer.Alg())
+		}
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	verifiers := verifiers()
+
+	for i, signer := range signers() {
+		iss := jwt.NewIssuer(signer, "TEST")
+		token, err := jwt.FromString(iss.MustStringifyJwt(iss.MintToken("sub", "aud", time.Minute)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// only the verifier for the same algorithm and key may accept the token
+		for j, verifier := range verifiers {
+			if jwt.NewAudience(verifier, "aud").JwtIsValid(token) != (i == j) {
+				t.Fatalf("%v token, %v audience: wrong validity", signer.Alg(), verifier.Alg())
+			}
+		}
+	}
+}
+
+// sign header and body as given, like a third party JWT library would
+func foreignToken(header, body string) string {
+	enc := b64.RawURLEncoding
+	input := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(body))
+	digest := sha256.Sum256([]byte(input))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, privKey, crypto.SHA256, digest[:])
+
+	return input + "." + enc.EncodeToString(sig)
+}
+
+func TestVerifyForeignToken(t *testing.T) {
+	aud := jwt.NewAudience(rs256.NewVerifier(&privKey.PublicKey), "aud")
+	exp := strconv.Itoa(int(time.Now().Add(time.Minute).Unix()))
+
+	// different key order and whitespace than encoding/json would produce,
+	// with a NumericDate exp and the aud array of RFC 7519
+	tokenString := foreignToken(
+		`{"typ": "application/at+jwt", "alg": "RS256"}`,
+		`{ "jti":"1", "exp":`+exp+`, "iss":"TEST", "aud":["other", "aud"], "sub":"sub" }`,
+	)
+
+	token, err := jwt.FromString(tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !aud.JwtIsValid(token) || token.Expired() {
+		t.Fatal("foreign token rejected")
+	}
+}
+
+func TestClaimEncoding(t *testing.T) {
+	iss := jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+
+	// minted tokens carry a numeric exp, and a single aud as a string
+	parts := strings.Split(iss.MustStringifyJwt(iss.MintToken("sub", "aud", time.Minute)), ".")
+	body, _ := b64.RawURLEncoding.DecodeString(parts[1])
+	if !strings.Contains(string(body), `"aud":"aud"`) || strings.Contains(string(body), `"exp":"`) {
+		t.Fatalf("minted claims not standard: %s", body)
+	}
+
+	for body, want := range map[string]int64{
+		`{"exp":1700000000}`:     1700000000,
+		`{"exp":1700000000.75}`:  1700000000,
+		`{"exp":1.7e9}`:          1700000000,
+		`{"exp":"1700000000"}`:   1700000000,
+		`{"aud":[],"sub":"sub"}`: 0,
+	} {
+		token, err := jwt.FromString(foreignToken(`{"alg":"RS256"}`, body))
+		if err != nil {
+			t.Fatalf("%v: %v", body, err)
+		}
+		if int64(token.Body.Expiration) != want {
+			t.Fatalf("%v: exp %v, want %v", body, token.Body.Expiration, want)
+		}
+	}
+
+	for _, body := range []string{`{"exp":"soon"}`, `{"exp":true}`, `{"aud":1}`, `{"aud":["a", 1]}`} {
+		if _, err := jwt.FromString(foreignToken(`{"alg":"RS256"}`, body)); err == nil {
+			t.Fatalf("parsed malformed claims %v", body)
+		}
+	}
+}
+
+func TestES256RequiresP256(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	if _, err := es256.NewSigner(key); err != es256.ErrCurve {
+		t.Fatalf("P-384 signer: %v", err)
+	}
+	if _, err := es256.NewVerifier(&key.PublicKey); err != es256.ErrCurve {
+		t.Fatalf("P-384 verifier: %v", err)
+	}
+	if _, err := jwt.NewSigner(jwt.AlgES256, key); err == nil {
+		t.Fatal("P-384 signer from jwt.NewSigner")
+	}
+	if _, err := es256.Signature([]byte("input"), key); err != es256.ErrCurve {
+		t.Fatalf("P-384 signature: %v", err)
+	}
+}
+
+// Signer whose key is unusable, as a remote signer's may become
+type failingSigner struct{ jwt.Signer }
+
+func (s failingSigner) Sign(b []byte) ([]byte, error) {
+	return nil, errors.New("signer unavailable")
+}
+
+func TestStringifyJwtSignError(t *testing.T) {
+	iss := jwt.NewIssuer(failingSigner{rs256.NewSigner(privKey)}, "TEST")
+
+	if _, err := iss.StringifyJwt(iss.MintToken("sub", "aud", time.Minute)); err == nil {
+		t.Fatal("token stringified without a signature")
+	}
+}
+
+func TestRejectUnexpectedAlg(t *testing.T) {
+	aud := jwt.NewAudience(rs256.NewVerifier(&privKey.PublicKey), "aud")
+	body := `{"sub":"sub","aud":"aud","iss":"TEST","exp":0,"jti":"1"}`
+
+	for _, header := range []string{
+		`{"alg":"none","typ":"JWT"}`,
+		`{"alg":"PS256","typ":"JWT"}`,
+		`{"alg":"HS256","typ":"JWT"}`,
+	} {
+		token, err := jwt.FromString(foreignToken(header, body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if aud.JwtIsValid(token) {
+			t.Fatalf("accepted token with header %v", header)
+		}
+	}
+
+	if _, err := jwt.FromString(foreignToken(`{"typ":"JWT"}`, body)); err == nil {
+		t.Fatal("parsed token without alg")
+	}
+}
+
+func TestRejectTamperedBody(t *testing.T) {
+	iss := jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+	aud := jwt.NewAudience(rs256.NewVerifier(&privKey.PublicKey), "aud")
+
+	parts := strings.Split(iss.MustStringifyJwt(iss.MintToken("sub", "aud", time.Minute)), ".")
+	parts[1] = b64.RawURLEncoding.EncodeToString(
+		[]byte(`{"sub":"admin","aud":"aud","iss":"TEST","exp":0,"jti":"1"}`),
+	)
+
+	token, err := jwt.FromString(strings.Join(parts, "."))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aud.JwtIsValid(token) {
+		t.Fatal("tampered token accepted")
+	}
+}
+
+func TestRejectUnsignedToken(t *testing.T) {
+	iss := jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+	aud := jwt.NewAudience(rs256.NewVerifier(&privKey.PublicKey), "aud")
+
+	if aud.JwtIsValid(iss.MintToken("sub", "aud", time.Minute)) {
+		t.Fatal("token without signature accepted")
+	}
+}
+
+func TestTokenTypes(t *testing.T) {
+	iss := jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+	access := jwt.NewAudience(rs256.NewVerifier(&privKey.PublicKey), "TEST")
+	refresh := jwt.NewAudience(rs256.NewVerifier(&privKey.PublicKey), "TEST")
+	refresh.TokenType = jwt.TypRefresh
+
+	accessToken, _ := jwt.FromString(iss.MustStringifyJwt(iss.MintToken("sub", "TEST", time.Minute)))
+	refreshToken, _ := jwt.FromString(iss.MustStringifyJwt(iss.MintRefreshToken("sub", time.Minute)))
+	untyped, _ := jwt.FromString(foreignToken(
+		`{"alg":"RS256","typ":"JWT"}`, `{"sub":"sub","aud":"TEST","iss":"TEST","exp":0,"jti":"1"}`,
+	))
+
+	if !access.JwtIsValid(accessToken) || refresh.JwtIsValid(accessToken) {
+		t.Fatal("access token accepted as a refresh token")
+	}
+
+	if !refresh.JwtIsValid(refreshToken) || access.JwtIsValid(refreshToken) {
+		t.Fatal("refresh token accepted as an access token")
+	}
+
+	if access.JwtIsValid(untyped) || refresh.JwtIsValid(untyped) {
+		t.Fatal("untyped token accepted")
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	for _, signer := range signers() {
+		if err := jwt.NewIssuer(signer, "TEST").CheckKey(); err != nil {
+			t.Fatalf("%v: %v", signer.Alg(), err)
+		}
+	}
+
+	if err := (jwt.Issuer{}).CheckKey(); err == nil {
+		t.Fatal("issuer without a key passed")
+	}
+}
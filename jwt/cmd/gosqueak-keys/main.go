@@ -0,0 +1,252 @@
+// Command gosqueak-keys generates and rotates the keys used to sign JWTs.
+//
+// Usage:
+//
+//	gosqueak-keys generate [-alg ES256] [-bits 2048] -out key.pem
+//	gosqueak-keys init     [-dir keys] [-alg ES256] [-bits 2048]
+//	gosqueak-keys stage    [-dir keys] [-alg ES256] [-bits 2048]
+//	gosqueak-keys activate [-dir keys] -kid KID
+//	gosqueak-keys remove   [-dir keys] -kid KID
+//	gosqueak-keys list     [-dir keys]
+//	gosqueak-keys jwks     [-dir keys]
+//
+// A rotation is three steps: stage a new key so that audiences learn it
+// from the JWKS endpoint, activate it once they have had time to refresh
+// (the JWKS max-age), then remove the old key once every token it signed
+// has expired. The auth service must be restarted to pick up each step.
+//
+// Private keys are written as PKCS#8 PEM files with 0600 permissions. When
+// GOSQUEAK_JWT_KEY_PASSPHRASE is set the keys are encrypted with it.
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/keyfile"
+	"github.com/rebeljah/gosqueak/jwt/keyring"
+)
+
+const (
+	DefaultDir    = "keys"
+	DefaultAlg    = jwt.AlgES256
+	PassphraseEnv = "GOSQUEAK_JWT_KEY_PASSPHRASE"
+)
+
+var commands = map[string]func(args []string) error{
+	"generate": generate,
+	"init":     initKeyring,
+	"stage":    stage,
+	"activate": activate,
+	"remove":   remove,
+	"list":     list,
+	"jwks":     printJwks,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: gosqueak-keys generate|init|stage|activate|remove|list|jwks [flags]")
+		os.Exit(2)
+	}
+
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "gosqueak-keys:", err)
+		os.Exit(1)
+	}
+}
+
+func passphrase() []byte {
+	return []byte(os.Getenv(PassphraseEnv))
+}
+
+// write a single key file, outside of any keyring
+func generate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	alg := fs.String("alg", DefaultAlg, "signing algorithm: RS256, PS256, ES256 or EdDSA")
+	bits := fs.Int("bits", keyring.DefaultRsaBits, "RSA key size")
+	out := fs.String("out", "", "private key file to create")
+	fs.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+
+	priv, err := keyring.Generate(*alg, *bits)
+	if err != nil {
+		return err
+	}
+
+	b, err := keyfile.MarshalPKCS8PEM(priv, passphrase())
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, keyring.FileMode)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return printPublic(*alg, priv)
+}
+
+func initKeyring(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	dir := fs.String("dir", DefaultDir, "keyring directory")
+	alg := fs.String("alg", DefaultAlg, "signing algorithm: RS256, PS256, ES256 or EdDSA")
+	bits := fs.Int("bits", keyring.DefaultRsaBits, "RSA key size")
+	fs.Parse(args)
+
+	k, err := keyring.Create(*dir)
+	if err != nil {
+		return err
+	}
+
+	return addKey(k, *alg, *bits)
+}
+
+// add a key that is published but not used to sign until activated
+func stage(args []string) error {
+	fs := flag.NewFlagSet("stage", flag.ExitOnError)
+	dir := fs.String("dir", DefaultDir, "keyring directory")
+	alg := fs.String("alg", DefaultAlg, "signing algorithm: RS256, PS256, ES256 or EdDSA")
+	bits := fs.Int("bits", keyring.DefaultRsaBits, "RSA key size")
+	fs.Parse(args)
+
+	k, err := keyring.Open(*dir)
+	if err != nil {
+		return err
+	}
+
+	return addKey(k, *alg, *bits)
+}
+
+func addKey(k *keyring.Keyring, alg string, bits int) error {
+	priv, err := keyring.Generate(alg, bits)
+	if err != nil {
+		return err
+	}
+
+	key, err := k.Add(alg, priv, passphrase())
+	if err != nil {
+		return err
+	}
+
+	state := "staged"
+	if k.Active == key.KeyId {
+		state = "active"
+	}
+	fmt.Fprintf(os.Stderr, "added %v key %v (%v)\n", alg, key.KeyId, state)
+
+	return printPublic(alg, priv)
+}
+
+func activate(args []string) error {
+	fs := flag.NewFlagSet("activate", flag.ExitOnError)
+	dir := fs.String("dir", DefaultDir, "keyring directory")
+	kid := fs.String("kid", "", "id of the key to sign with")
+	fs.Parse(args)
+
+	k, err := keyring.Open(*dir)
+	if err != nil {
+		return err
+	}
+
+	return k.Activate(*kid)
+}
+
+func remove(args []string) error {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	dir := fs.String("dir", DefaultDir, "keyring directory")
+	kid := fs.String("kid", "", "id of the key to delete")
+	fs.Parse(args)
+
+	k, err := keyring.Open(*dir)
+	if err != nil {
+		return err
+	}
+
+	return k.Remove(*kid)
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dir := fs.String("dir", DefaultDir, "keyring directory")
+	fs.Parse(args)
+
+	k, err := keyring.Open(*dir)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range k.Keys {
+		state := ""
+		if key.KeyId == k.Active {
+			state = "active"
+		}
+		fmt.Printf("%v\t%v\t%v\t%v\n", key.KeyId, key.Alg, key.Created.Format("2006-01-02"), state)
+	}
+
+	return nil
+}
+
+// print the key set the auth service will publish for the keyring
+func printJwks(args []string) error {
+	fs := flag.NewFlagSet("jwks", flag.ExitOnError)
+	dir := fs.String("dir", DefaultDir, "keyring directory")
+	fs.Parse(args)
+
+	k, err := keyring.Open(*dir)
+	if err != nil {
+		return err
+	}
+
+	active, others, err := k.Signers(passphrase())
+	if err != nil {
+		return err
+	}
+
+	return printJson(jwt.NewIssuer(active, "", others...).KeySet())
+}
+
+// print the public key as a JWK and as a PEM SPKI block
+func printPublic(alg string, priv crypto.PrivateKey) error {
+	signer, err := jwt.NewSigner(alg, priv)
+	if err != nil {
+		return err
+	}
+
+	jwk, err := jwt.NewJwk(alg, signer.Public())
+	if err != nil {
+		return err
+	}
+
+	if err := printJson(jwk); err != nil {
+		return err
+	}
+
+	b, err := keyfile.MarshalSPKIPEM(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+func printJson(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
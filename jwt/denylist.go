@@ -0,0 +1,99 @@
+package jwt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DenyList reports whether the token with the given jti was revoked before
+// it expired. Checking costs a round trip to the issuer, so audiences only
+// consult it for high risk operations and otherwise trust tokens until exp.
+// ctx is that of the request being authorized.
+type DenyList interface {
+	Revoked(ctx context.Context, jti string) (bool, error)
+}
+
+// RemoteDenyList asks the issuer's revocation endpoint about each jti.
+// Revocation is permanent, so revoked ids are cached until the exp of
+// their token; unrevoked ids are always looked up again.
+type RemoteDenyList struct {
+	url    string
+	client *http.Client
+
+	mu sync.RWMutex
+	// exp of each revoked token
+	revoked map[string]time.Time
+}
+
+// NewRemoteDenyList returns a DenyList querying url?jti=<jti>. A nil client
+// uses a default client with a KeyFetchTimeout timeout.
+func NewRemoteDenyList(url string, client *http.Client) *RemoteDenyList {
+	if client == nil {
+		client = &http.Client{Timeout: KeyFetchTimeout}
+	}
+
+	return &RemoteDenyList{url: url, client: client, revoked: make(map[string]time.Time)}
+}
+
+func (d *RemoteDenyList) Revoked(ctx context.Context, jti string) (bool, error) {
+	d.mu.RLock()
+	exp, revoked := d.revoked[jti]
+	d.mu.RUnlock()
+
+	if revoked && time.Now().Before(exp) {
+		return true, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url+"?jti="+url.QueryEscape(jti), nil)
+	if err != nil {
+		return false, err
+	}
+
+	r, err := d.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("revocation check: %v", r.Status)
+	}
+
+	var body struct {
+		Revoked    bool        `json:"revoked"`
+		Expiration NumericDate `json:"exp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return false, err
+	}
+
+	// without an exp there is no telling when the entry can be dropped
+	if body.Revoked && body.Expiration != 0 {
+		d.cache(jti, time.Unix(int64(body.Expiration), 0))
+	}
+
+	return body.Revoked, nil
+}
+
+// Cache the revocation until exp, dropping the entries of expired tokens,
+// which are rejected without asking the deny-list
+func (d *RemoteDenyList) cache(jti string, exp time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for id, idExp := range d.revoked {
+		if !now.Before(idExp) {
+			delete(d.revoked, id)
+		}
+	}
+
+	if now.Before(exp) {
+		d.revoked[jti] = exp
+	}
+}
@@ -0,0 +1,52 @@
+package jwt_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+)
+
+func TestRemoteDenyList(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		jti := r.URL.Query().Get("jti")
+
+		body := map[string]any{"jti": jti, "revoked": jti != "fine"}
+		switch jti {
+		case "revoked":
+			body["exp"] = time.Now().Add(time.Minute).Unix()
+		case "expired":
+			body["exp"] = time.Now().Add(-time.Minute).Unix()
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer srv.Close()
+
+	deny := jwt.NewRemoteDenyList(srv.URL, nil)
+
+	for i := 0; i < 2; i++ {
+		if revoked, err := deny.Revoked(context.Background(), "revoked"); err != nil || !revoked {
+			t.Fatalf("revoked jti not denied: %v", err)
+		}
+
+		if revoked, err := deny.Revoked(context.Background(), "fine"); err != nil || revoked {
+			t.Fatalf("jti denied: %v", err)
+		}
+
+		if revoked, err := deny.Revoked(context.Background(), "expired"); err != nil || !revoked {
+			t.Fatalf("revoked jti not denied: %v", err)
+		}
+	}
+
+	// revocations are cached until the token expires, unrevoked ids are
+	// not cached
+	if requests != 5 {
+		t.Fatalf("expected 5 requests, got %v", requests)
+	}
+}
@@ -0,0 +1,77 @@
+// Package eddsa implements the EdDSA JWS algorithm using Ed25519 keys.
+package eddsa
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+)
+
+// Alg is the JWS "alg" header value for signatures made by this package.
+const Alg = "EdDSA"
+
+func Signature(b []byte, priv ed25519.PrivateKey) []byte {
+	return ed25519.Sign(priv, b)
+}
+
+func VerifySignature(b, sig []byte, pub ed25519.PublicKey) bool {
+	if len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(pub, b, sig)
+}
+
+func GeneratePrivateKey() (ed25519.PrivateKey, error) {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	return k, err
+}
+
+func MustGeneratePrivateKey() ed25519.PrivateKey {
+	k, err := GeneratePrivateKey()
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// Signer signs JWS signing input with EdDSA.
+type Signer struct {
+	key ed25519.PrivateKey
+}
+
+func NewSigner(priv ed25519.PrivateKey) Signer {
+	return Signer{priv}
+}
+
+func (s Signer) Alg() string {
+	return Alg
+}
+
+func (s Signer) Public() crypto.PublicKey {
+	return s.key.Public()
+}
+
+func (s Signer) Sign(b []byte) ([]byte, error) {
+	return Signature(b, s.key), nil
+}
+
+// Verifier verifies EdDSA signatures.
+type Verifier struct {
+	key ed25519.PublicKey
+}
+
+func NewVerifier(pub ed25519.PublicKey) Verifier {
+	return Verifier{pub}
+}
+
+func (v Verifier) Alg() string {
+	return Alg
+}
+
+func (v Verifier) Public() crypto.PublicKey {
+	return v.key
+}
+
+func (v Verifier) Verify(b, sig []byte) bool {
+	return VerifySignature(b, sig, v.key)
+}
@@ -0,0 +1,118 @@
+// Package es256 implements the ES256 JWS algorithm (ECDSA using P-256 and
+// SHA-256).
+package es256
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// Alg is the JWS "alg" header value for signatures made by this package.
+const Alg = "ES256"
+
+// JWS encodes an ES256 signature as the 32 byte big-endian R and S values
+// concatenated, rather than the ASN.1 encoding used by crypto/ecdsa.
+const coordLen = 32
+
+// ErrCurve is returned for keys that are not on P-256, whose coordinates
+// don't fit the signature encoding
+var ErrCurve = errors.New("es256: key is not on P-256")
+
+func HashDigest(b []byte) []byte {
+	hash := sha256.New()
+	hash.Write(b)
+	return hash.Sum(nil)
+}
+
+func Signature(b []byte, priv *ecdsa.PrivateKey) ([]byte, error) {
+	if priv.Curve != elliptic.P256() {
+		return nil, ErrCurve
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, priv, HashDigest(b))
+	if err != nil {
+		return nil, err
+	}
+
+	sig := make([]byte, 2*coordLen)
+	r.FillBytes(sig[:coordLen])
+	s.FillBytes(sig[coordLen:])
+
+	return sig, nil
+}
+
+func VerifySignature(b, sig []byte, pub *ecdsa.PublicKey) bool {
+	if len(sig) != 2*coordLen || pub.Curve != elliptic.P256() {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(sig[:coordLen])
+	s := new(big.Int).SetBytes(sig[coordLen:])
+
+	return ecdsa.Verify(pub, HashDigest(b), r, s)
+}
+
+func GeneratePrivateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func MustGeneratePrivateKey() *ecdsa.PrivateKey {
+	k, err := GeneratePrivateKey()
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// Signer signs JWS signing input with ES256. The key must be on P-256.
+type Signer struct {
+	key *ecdsa.PrivateKey
+}
+
+func NewSigner(priv *ecdsa.PrivateKey) (Signer, error) {
+	if priv.Curve != elliptic.P256() {
+		return Signer{}, ErrCurve
+	}
+	return Signer{priv}, nil
+}
+
+func (s Signer) Alg() string {
+	return Alg
+}
+
+func (s Signer) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s Signer) Sign(b []byte) ([]byte, error) {
+	return Signature(b, s.key)
+}
+
+// Verifier verifies ES256 signatures. The key must be on P-256.
+type Verifier struct {
+	key *ecdsa.PublicKey
+}
+
+func NewVerifier(pub *ecdsa.PublicKey) (Verifier, error) {
+	if pub.Curve != elliptic.P256() {
+		return Verifier{}, ErrCurve
+	}
+	return Verifier{pub}, nil
+}
+
+func (v Verifier) Alg() string {
+	return Alg
+}
+
+func (v Verifier) Public() crypto.PublicKey {
+	return v.key
+}
+
+func (v Verifier) Verify(b, sig []byte) bool {
+	return VerifySignature(b, sig, v.key)
+}
@@ -1,3 +1,5 @@
 module github.com/rebeljah/gosqueak/jwt
 
 go 1.18
+
+require golang.org/x/crypto v0.3.0
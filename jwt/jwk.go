@@ -0,0 +1,239 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"fmt"
+	"math/big"
+
+	"github.com/rebeljah/gosqueak/jwt/eddsa"
+	"github.com/rebeljah/gosqueak/jwt/es256"
+	"github.com/rebeljah/gosqueak/jwt/ps256"
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+)
+
+// Public JSON Web Key (RFC 7517). Only the members needed to describe RSA,
+// P-256 and Ed25519 public keys are modeled.
+type Jwk struct {
+	KeyType string `json:"kty"`
+	KeyId   string `json:"kid,omitempty"`
+	Alg     string `json:"alg,omitempty"`
+	Use     string `json:"use,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JSON Web Key Set, as served at /.well-known/jwks.json
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+// KeySet finds the Verifier for the key named by a token's "kid" header.
+type KeySet interface {
+	Verifier(kid string) (Verifier, bool)
+}
+
+var errUnsupportedKey = fmt.Errorf("unsupported jwk")
+
+// Build the JWK for a public key that will verify alg signatures. The key id
+// is set to the RFC 7638 thumbprint of the key.
+func NewJwk(alg string, pub crypto.PublicKey) (Jwk, error) {
+	enc := b64.RawURLEncoding
+	var k Jwk
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		k = Jwk{
+			KeyType: "RSA",
+			N:       enc.EncodeToString(pub.N.Bytes()),
+			E:       enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return k, errUnsupportedKey
+		}
+		k = Jwk{
+			KeyType: "EC",
+			Curve:   "P-256",
+			X:       enc.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			Y:       enc.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+		}
+	case ed25519.PublicKey:
+		k = Jwk{
+			KeyType: "OKP",
+			Curve:   "Ed25519",
+			X:       enc.EncodeToString(pub),
+		}
+	default:
+		return k, errUnsupportedKey
+	}
+
+	k.Alg = alg
+	k.Use = "sig"
+	k.KeyId = k.Thumbprint()
+
+	return k, nil
+}
+
+// RFC 7638 thumbprint: hash of the required members in lexicographic order.
+func (k Jwk) Thumbprint() string {
+	var members string
+
+	switch k.KeyType {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, k.E, k.KeyType, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Curve, k.KeyType, k.X, k.Y)
+	default:
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Curve, k.KeyType, k.X)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return b64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (k Jwk) PublicKey() (crypto.PublicKey, error) {
+	dec := b64.RawURLEncoding
+
+	switch {
+	case k.KeyType == "RSA":
+		n, err := dec.DecodeString(k.N)
+		e, err1 := dec.DecodeString(k.E)
+		if err != nil || err1 != nil || len(e) > 4 {
+			return nil, errUnsupportedKey
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case k.KeyType == "EC" && k.Curve == "P-256":
+		x, err := dec.DecodeString(k.X)
+		y, err1 := dec.DecodeString(k.Y)
+		if err != nil || err1 != nil {
+			return nil, errUnsupportedKey
+		}
+
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errUnsupportedKey
+		}
+
+		return pub, nil
+
+	case k.KeyType == "OKP" && k.Curve == "Ed25519":
+		x, err := dec.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errUnsupportedKey
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, errUnsupportedKey
+}
+
+// Verifier for signatures made with the key. When the JWK does not name an
+// algorithm, the usual one for the key type is assumed.
+func (k Jwk) Verifier() (Verifier, error) {
+	pub, err := k.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	alg := k.Alg
+	if alg == "" {
+		alg = map[string]string{"RSA": AlgRS256, "EC": AlgES256, "OKP": AlgEdDSA}[k.KeyType]
+	}
+
+	return NewVerifier(alg, pub)
+}
+
+// Verifier returns the verifier for the key with the given id. Tokens without
+// a kid are accepted only when the set holds a single key.
+func (s Jwks) Verifier(kid string) (Verifier, bool) {
+	for _, k := range s.Keys {
+		if k.KeyId != kid && !(kid == "" && len(s.Keys) == 1) {
+			continue
+		}
+
+		v, err := k.Verifier()
+		if err != nil {
+			return nil, false
+		}
+		return v, true
+	}
+
+	return nil, false
+}
+
+// NewVerifier returns the Verifier for alg signatures made by pub's private key.
+func NewVerifier(alg string, pub crypto.PublicKey) (Verifier, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case AlgRS256:
+			return rs256.NewVerifier(pub), nil
+		case AlgPS256:
+			return ps256.NewVerifier(pub), nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == AlgES256 {
+			v, err := es256.NewVerifier(pub)
+			if err != nil {
+				return nil, err
+			}
+			return v, nil
+		}
+	case ed25519.PublicKey:
+		if alg == AlgEdDSA {
+			return eddsa.NewVerifier(pub), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %v verifier for key type %T", alg, pub)
+}
+
+// NewSigner returns the Signer making alg signatures with priv.
+func NewSigner(alg string, priv crypto.PrivateKey) (Signer, error) {
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		switch alg {
+		case AlgRS256:
+			return rs256.NewSigner(priv), nil
+		case AlgPS256:
+			return ps256.NewSigner(priv), nil
+		}
+	case *ecdsa.PrivateKey:
+		if alg == AlgES256 {
+			s, err := es256.NewSigner(priv)
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+	case ed25519.PrivateKey:
+		if alg == AlgEdDSA {
+			return eddsa.NewSigner(priv), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %v signer for key type %T", alg, priv)
+}
@@ -0,0 +1,87 @@
+package jwt_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/es256"
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+)
+
+func TestThumbprint(t *testing.T) {
+	// example key and thumbprint from RFC 7638 section 3.1
+	k := jwt.Jwk{
+		KeyType: "RSA",
+		N:       "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:       "AQAB",
+	}
+
+	if k.Thumbprint() != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Fatalf("wrong thumbprint %v", k.Thumbprint())
+	}
+}
+
+func TestJwkRoundTrip(t *testing.T) {
+	for i, signer := range signers() {
+		k, err := jwt.NewJwk(signer.Alg(), signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := json.Marshal(k)
+		var parsed jwt.Jwk
+		if err := json.Unmarshal(b, &parsed); err != nil {
+			t.Fatal(err)
+		}
+
+		verifier, err := parsed.Verifier()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sig, _ := signer.Sign([]byte("input"))
+		if !verifier.Verify([]byte("input"), sig) {
+			t.Fatalf("%v: verifier from jwk rejected signature", signer.Alg())
+		}
+
+		if verifier.Alg() != verifiers()[i].Alg() {
+			t.Fatalf("%v: jwk verifier has alg %v", signer.Alg(), verifier.Alg())
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldIss := jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+	newKey := es256.MustGeneratePrivateKey()
+	newIss := jwt.NewIssuer(ecSigner(newKey), "TEST", rs256.NewSigner(privKey))
+
+	if oldIss.KeyId() == newIss.KeyId() || len(newIss.KeySet().Keys) != 2 {
+		t.Fatal("rotated issuer should publish two distinct keys")
+	}
+
+	aud := jwt.NewKeySetAudience(newIss.KeySet(), "aud")
+
+	for _, iss := range []jwt.Issuer{oldIss, newIss} {
+		token, err := jwt.FromString(iss.MustStringifyJwt(iss.MintToken("sub", "aud", time.Minute)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token.Header.KeyId != iss.KeyId() {
+			t.Fatal("token kid does not match issuer")
+		}
+
+		if !aud.JwtIsValid(token) {
+			t.Fatalf("token signed with %v key rejected", iss.Algorithm())
+		}
+	}
+
+	// keys outside of the set are unknown to the audience
+	strangerIss := jwt.NewIssuer(ecSigner(es256.MustGeneratePrivateKey()), "TEST")
+	token, _ := jwt.FromString(strangerIss.MustStringifyJwt(strangerIss.MintToken("sub", "aud", time.Minute)))
+	if aud.JwtIsValid(token) {
+		t.Fatal("token signed with unknown key accepted")
+	}
+}
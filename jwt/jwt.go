@@ -5,42 +5,192 @@ import (
 	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/rebeljah/gosqueak/jwt/eddsa"
+	"github.com/rebeljah/gosqueak/jwt/es256"
+	"github.com/rebeljah/gosqueak/jwt/ps256"
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+)
+
+// supported signing algorithms
+const (
+	AlgRS256 string = rs256.Alg
+	AlgPS256 string = ps256.Alg
+	AlgES256 string = es256.Alg
+	AlgEdDSA string = eddsa.Alg
 )
 
-const Alg string = "RS256"
+// Generic typ header, not accepted by any Audience
 const Typ string = "JWT"
 
+// Role that unlocks the moderation and management endpoints of the services
+const RoleAdmin string = "admin"
+
+// Token types, carried in the typ header so that a token of one kind is
+// never accepted where the other is expected.
+const (
+	// RFC 9068 access token
+	TypAccess string = "at+jwt"
+	// refresh token, only accepted by the issuer itself
+	TypRefresh string = "rt+jwt"
+	// RFC 7523 assertion a client authenticates to the issuer with
+	TypClientAssertion string = "client-authentication+jwt"
+)
+
 type Header struct {
 	Algorithm string `json:"alg"`
 	Type      string `json:"typ"`
+	KeyId     string `json:"kid,omitempty"`
 }
 
 type Body struct {
-	Subject    string `json:"sub"`
-	Audience   string `json:"aud"`
-	Issuer     string `json:"iss"`
-	Expiration string `json:"exp"`
-	JwtId      string `json:"jti"`
+	Subject    string       `json:"sub"`
+	Audience   ClaimStrings `json:"aud"`
+	Issuer     string       `json:"iss"`
+	Expiration NumericDate  `json:"exp"`
+	JwtId      string       `json:"jti"`
+	// space separated list of scopes granted to the subject (RFC 8693)
+	Scope string `json:"scope,omitempty"`
+	// roles of the subject (RFC 9068)
+	Roles []string `json:"roles,omitempty"`
+}
+
+// RFC 7519 NumericDate, seconds since the epoch. Fractional seconds are
+// truncated, and the quoted form minted by earlier versions of this package
+// is accepted so that their tokens stay usable until they expire.
+type NumericDate int64
+
+func (d *NumericDate) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*d = NumericDate(i)
+		return nil
+	}
+
+	// only numbers may have a fraction or exponent
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return fmt.Errorf("invalid NumericDate %s", b)
+	}
+	*d = NumericDate(f)
+	return nil
+}
+
+// A claim that is either a single string or an array of strings, like aud
+// (RFC 7519 section 4.1.3). Marshalled as a string when it holds one.
+type ClaimStrings []string
+
+// true IFF s is one of the strings of the claim
+func (c ClaimStrings) Contains(s string) bool {
+	for _, v := range c {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ClaimStrings) MarshalJSON() ([]byte, error) {
+	if len(c) == 1 {
+		return json.Marshal(c[0])
+	}
+	return json.Marshal([]string(c))
+}
+
+func (c *ClaimStrings) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*c = ClaimStrings{s}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*c = list
+	return nil
+}
+
+// true IFF the typ header names the token type typ. Compared case
+// insensitively, and the "application/" prefix may be omitted (RFC 7515).
+func (h Header) TypeIs(typ string) bool {
+	t := h.Type
+	if len(t) > len("application/") && strings.EqualFold(t[:len("application/")], "application/") {
+		t = t[len("application/"):]
+	}
+	return strings.EqualFold(t, typ)
+}
+
+// true IFF the subject has the role
+func (b Body) HasRole(role string) bool {
+	for _, r := range b.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// The scopes granted by the token
+func (b Body) Scopes() []string {
+	return strings.Fields(b.Scope)
+}
+
+// true IFF scope was granted by the token
+func (b Body) HasScope(scope string) bool {
+	for _, s := range b.Scopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
 }
 
 type Jwt struct {
 	Header    Header
 	Body      Body
 	Signature []byte
+
+	// BASE64URL(header) '.' BASE64URL(body) exactly as it was received, the
+	// signature is verified over these bytes. Empty for unparsed tokens.
+	signed string
+}
+
+// SigningInput returns the encoded header and body that the signature of a
+// parsed token covers.
+func (j Jwt) SigningInput() []byte {
+	return []byte(j.signed)
 }
 
-// Returns true if the current time is > the exp time of the JWT
+// Returns true if the current time is > the exp time of the JWT. Tokens
+// without an exp are always expired.
 func (j Jwt) Expired() bool {
-	exp, err := strconv.Atoi(j.Body.Expiration)
-	if err != nil {
-		panic(err)
+	return time.Now().After(j.ExpiresAt())
+}
+
+// Returns the exp time of the JWT, the zero time if there is no exp.
+func (j Jwt) ExpiresAt() time.Time {
+	if j.Body.Expiration == 0 {
+		return time.Time{}
 	}
-	expireTime := time.Unix(int64(exp), 0)
 
-	return time.Now().After(expireTime)
+	return time.Unix(int64(j.Body.Expiration), 0)
+}
+
+// The token in the Authorization header of r. Both the bare token and the
+// OAuth2 "Bearer <token>" form (RFC 6750) are accepted.
+func BearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return auth[len("Bearer "):]
+	}
+	return auth
 }
 
 // parse JWT from string. Does not verify JWT.
@@ -55,22 +205,32 @@ func FromString(j string) (Jwt, error) {
 		return zeroVal, parseErr
 	}
 
-	// header not currently needed (default header is always used)
-	// header, err := enc.DecodeString(parts[0])
+	header, err := enc.DecodeString(parts[0])
 	body, err1 := enc.DecodeString(parts[1])
 	sig, err2 := enc.DecodeString(parts[2])
-	// if err != nil || err1 != nil || err2 != nil {
-	if !(err1 == nil && err2 == nil) {
+	if !(err == nil && err1 == nil && err2 == nil) {
+		return zeroVal, parseErr
+	}
+
+	var parsedHeader Header
+	err = json.Unmarshal(header, &parsedHeader)
+	if err != nil || parsedHeader.Algorithm == "" {
 		return zeroVal, parseErr
 	}
 
 	var parsedBody Body
-	err := json.Unmarshal(body, &parsedBody)
+	err = json.Unmarshal(body, &parsedBody)
 	if err != nil {
 		return zeroVal, parseErr
 	}
 
-	return Jwt{Header{Alg, Typ}, parsedBody, sig}, nil
+	return Jwt{parsedHeader, parsedBody, sig, parts[0] + "." + parts[1]}, nil
+}
+
+// JWS signing input: BASE64URL(header) || '.' || BASE64URL(body)
+func signingInput(header, body []byte) []byte {
+	enc := b64.RawURLEncoding
+	return []byte(enc.EncodeToString(header) + "." + enc.EncodeToString(body))
 }
 
 type serializable interface {
@@ -0,0 +1,158 @@
+// Package keyfile reads and writes signing keys in the formats produced by
+// common tooling: PEM or DER encoded PKCS#1, SEC 1, PKCS#8 and SPKI keys,
+// and passphrase protected private keys.
+package keyfile
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// PEM block types
+const (
+	PKCS1PrivateType   = "RSA PRIVATE KEY"
+	PKCS1PublicType    = "RSA PUBLIC KEY"
+	SEC1PrivateType    = "EC PRIVATE KEY"
+	PKCS8PrivateType   = "PRIVATE KEY"
+	PKCS8EncryptedType = "ENCRYPTED PRIVATE KEY"
+	SPKIPublicType     = "PUBLIC KEY"
+)
+
+// errors
+var (
+	ErrInvalidKey          = errors.New("invalid key")
+	ErrPassphraseRequired  = errors.New("key is encrypted, passphrase required")
+	ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+)
+
+//
+
+// ParsePrivateKey parses a PEM or DER encoded private key, detecting the
+// format. The passphrase is only used when the key is encrypted. The result
+// is an *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey.
+func ParsePrivateKey(b, passphrase []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return parsePrivateDer(b)
+	}
+
+	der := block.Bytes
+
+	switch {
+	case block.Type == PKCS8EncryptedType:
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+
+		var err error
+		der, err = decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+	// legacy OpenSSL "Proc-Type: 4,ENCRYPTED" keys, read-only
+	case x509.IsEncryptedPEMBlock(block):
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+
+		var err error
+		der, err = x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, ErrIncorrectPassphrase
+		}
+	}
+
+	k, err := parsePrivateDer(der)
+	if err != nil && block.Type == PKCS8EncryptedType {
+		// garbage out of a wrong passphrase that happened to be padded right
+		return nil, ErrIncorrectPassphrase
+	}
+
+	return k, err
+}
+
+func parsePrivateDer(der []byte) (crypto.PrivateKey, error) {
+	if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return k, nil
+	}
+
+	if k, err := x509.ParseECPrivateKey(der); err == nil {
+		return k, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not PKCS#1, SEC 1 or PKCS#8", ErrInvalidKey)
+	}
+
+	// PKCS#8 parses Ed25519 keys to a value type, RSA and EC to pointers
+	switch k.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, k)
+}
+
+// ParsePublicKey parses a PEM or DER encoded PKCS#1 or SPKI public key. The
+// result is an *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	der := b
+	if block, _ := pem.Decode(b); block != nil {
+		der = block.Bytes
+	}
+
+	if k, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return k, nil
+	}
+
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not PKCS#1 or SPKI", ErrInvalidKey)
+	}
+
+	switch k.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported key type %T", ErrInvalidKey, k)
+}
+
+// MarshalPKCS8PEM encodes a private key as a PEM PKCS#8 block. A non-empty
+// passphrase encrypts the key with PBES2 (PBKDF2-SHA256, AES-256-CBC), the
+// same scheme used by `openssl pkcs8 -topk8 -v2 aes256`.
+func MarshalPKCS8PEM(key crypto.PrivateKey, passphrase []byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	if len(passphrase) == 0 {
+		return pem.EncodeToMemory(&pem.Block{Type: PKCS8PrivateType, Bytes: der}), nil
+	}
+
+	der, err = encryptPKCS8(der, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: PKCS8EncryptedType, Bytes: der}), nil
+}
+
+// MarshalSPKIPEM encodes a public key as a PEM SPKI ("PUBLIC KEY") block.
+func MarshalSPKIPEM(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: SPKIPublicType, Bytes: der}), nil
+}
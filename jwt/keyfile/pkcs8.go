@@ -0,0 +1,195 @@
+package keyfile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Encrypted PKCS#8 (RFC 5958) using PBES2 (RFC 8018). Reading accepts
+// PBKDF2 with HMAC-SHA1 or HMAC-SHA256 and AES-CBC of any key size, which
+// covers what OpenSSL writes; writing always uses HMAC-SHA256 and AES-256.
+
+const (
+	pbkdf2Iterations = 600000
+	pbkdf2SaltLen    = 16
+	// the iteration count is read from the key file, so it is bounded to
+	// keep a crafted file from hanging whoever loads it
+	maxPbkdf2Iterations = 10000000
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	Prf            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	unsupported := fmt.Errorf("%w: unsupported key encryption", ErrInvalidKey)
+
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, unsupported
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, unsupported
+	}
+
+	var kdf pbkdf2Params
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, unsupported
+	}
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, unsupported
+	}
+	if kdf.IterationCount < 1 || kdf.IterationCount > maxPbkdf2Iterations {
+		return nil, fmt.Errorf("%w: %v PBKDF2 iterations, at most %v are allowed", ErrInvalidKey, kdf.IterationCount, maxPbkdf2Iterations)
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.Prf.Algorithm) == 0, kdf.Prf.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.Prf.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, unsupported
+	}
+
+	var keyLen int
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen = 16
+	case alg.Equal(oidAES192CBC):
+		keyLen = 24
+	case alg.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, unsupported
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, unsupported
+	}
+
+	key := pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keyLen, prf)
+	block, err := aes.NewCipher(key)
+	if err != nil || len(iv) != block.BlockSize() {
+		return nil, unsupported
+	}
+
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("%w: bad encrypted data length", ErrInvalidKey)
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// a wrong passphrase almost always shows up as bad padding
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() ||
+		!bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, ErrIncorrectPassphrase
+	}
+
+	return plain[:len(plain)-pad], nil
+}
+
+func encryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, pbkdf2SaltLen)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2.Key(passphrase, salt, pbkdf2Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	plain := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		KeyLength:      32,
+		Prf:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	schemeParams, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBKDF2,
+			Parameters: asn1.RawValue{FullBytes: kdfParams},
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAES256CBC,
+			Parameters: asn1.RawValue{FullBytes: ivParam},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBES2,
+			Parameters: asn1.RawValue{FullBytes: schemeParams},
+		},
+		EncryptedData: encrypted,
+	})
+}
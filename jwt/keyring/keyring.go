@@ -0,0 +1,266 @@
+// Package keyring stores an issuer's signing keys in a directory so they can
+// be rotated without downtime. Each key lives in its own PKCS#8 PEM file,
+// named by key id, next to a keyring.json manifest recording the algorithm
+// of every key and which one is active. Keys that are not active are still
+// published in the issuer's key set: either staged for the next rotation or
+// retiring after one.
+package keyring
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/eddsa"
+	"github.com/rebeljah/gosqueak/jwt/es256"
+	"github.com/rebeljah/gosqueak/jwt/keyfile"
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+)
+
+const (
+	ManifestFile = "keyring.json"
+
+	// private keys and the manifest are only readable by their owner
+	FileMode = 0600
+	DirMode  = 0700
+
+	DefaultRsaBits = 2048
+	MinRsaBits     = 2048
+)
+
+// errors
+var (
+	ErrNoActiveKey = errors.New("keyring has no active key")
+	ErrNoSuchKey   = errors.New("no such key id")
+	ErrKeyIsActive = errors.New("key is active")
+)
+
+//
+
+type Key struct {
+	KeyId   string    `json:"kid"`
+	Alg     string    `json:"alg"`
+	File    string    `json:"file"`
+	Created time.Time `json:"created"`
+}
+
+type Keyring struct {
+	dir    string
+	Active string `json:"active"`
+	Keys   []Key  `json:"keys"`
+}
+
+// Open the keyring in dir. The error wraps fs.ErrNotExist when dir holds
+// no keyring.
+func Open(dir string) (*Keyring, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{dir: dir}
+	if err := json.Unmarshal(b, k); err != nil {
+		return nil, fmt.Errorf("%v: %w", ManifestFile, err)
+	}
+
+	return k, nil
+}
+
+// Create an empty keyring in dir, creating the directory if needed.
+func Create(dir string) (*Keyring, error) {
+	if _, err := os.Stat(filepath.Join(dir, ManifestFile)); err == nil {
+		return nil, fmt.Errorf("%v already holds a keyring", dir)
+	}
+
+	if err := os.MkdirAll(dir, DirMode); err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{dir: dir, Keys: make([]Key, 0)}
+	return k, k.Save()
+}
+
+// Save the manifest. The file is replaced atomically so the auth service
+// never reads a partially written keyring.
+func (k *Keyring) Save() error {
+	b, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(k.dir, ManifestFile+".tmp")
+	if err := os.WriteFile(tmp, b, FileMode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(k.dir, ManifestFile))
+}
+
+// Add a key to the keyring, encrypting it with passphrase when it is not
+// empty. The key id is the JWK thumbprint of the public key. The first key
+// added becomes active, later keys are staged until activated.
+func (k *Keyring) Add(alg string, priv crypto.PrivateKey, passphrase []byte) (Key, error) {
+	signer, err := jwt.NewSigner(alg, priv)
+	if err != nil {
+		return Key{}, err
+	}
+
+	jwk, err := jwt.NewJwk(alg, signer.Public())
+	if err != nil {
+		return Key{}, err
+	}
+
+	b, err := keyfile.MarshalPKCS8PEM(priv, passphrase)
+	if err != nil {
+		return Key{}, err
+	}
+
+	key := Key{jwk.KeyId, alg, jwk.KeyId + ".pem", time.Now().UTC()}
+
+	// O_EXCL, never overwrite an existing key
+	f, err := os.OpenFile(filepath.Join(k.dir, key.File), os.O_WRONLY|os.O_CREATE|os.O_EXCL, FileMode)
+	if err != nil {
+		return Key{}, err
+	}
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	k.Keys = append(k.Keys, key)
+	if k.Active == "" {
+		k.Active = key.KeyId
+	}
+
+	return key, k.Save()
+}
+
+// Activate makes kid the signing key. The previously active key stays in
+// the keyring as a retiring key until it is removed.
+func (k *Keyring) Activate(kid string) error {
+	if _, ok := k.find(kid); !ok {
+		return ErrNoSuchKey
+	}
+
+	k.Active = kid
+	return k.Save()
+}
+
+// Remove a key which is not active and delete its file.
+func (k *Keyring) Remove(kid string) error {
+	if kid == k.Active {
+		return ErrKeyIsActive
+	}
+
+	i, ok := k.find(kid)
+	if !ok {
+		return ErrNoSuchKey
+	}
+
+	file := filepath.Join(k.dir, k.Keys[i].File)
+	k.Keys = append(k.Keys[:i], k.Keys[i+1:]...)
+
+	if err := k.Save(); err != nil {
+		return err
+	}
+
+	return os.Remove(file)
+}
+
+// Signers loads every key. The active signer is returned separately from
+// the staged and retiring ones, ready to pass to jwt.NewIssuer.
+func (k *Keyring) Signers(passphrase []byte) (active jwt.Signer, others []jwt.Signer, err error) {
+	for _, key := range k.Keys {
+		b, err := os.ReadFile(filepath.Join(k.dir, key.File))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		priv, err := keyfile.ParsePrivateKey(b, passphrase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v: %w", key.File, err)
+		}
+
+		signer, err := jwt.NewSigner(key.Alg, priv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v: %w", key.File, err)
+		}
+
+		if key.KeyId == k.Active {
+			active = signer
+		} else {
+			others = append(others, signer)
+		}
+	}
+
+	if active == nil {
+		return nil, nil, ErrNoActiveKey
+	}
+
+	return active, others, nil
+}
+
+// LoadSigners loads the signers of the keyring in dir, falling back to the
+// single RSA key in rsaKeyFile when dir is empty or holds no keyring.
+func LoadSigners(dir, rsaKeyFile string, passphrase []byte) (active jwt.Signer, others []jwt.Signer, err error) {
+	if dir != "" {
+		k, err := Open(dir)
+		if err == nil {
+			return k.Signers(passphrase)
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+
+	// PEM or DER, PKCS#1 or PKCS#8, optionally passphrase protected
+	key, err := rs256.LoadPrivateKey(rsaKeyFile, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rs256.NewSigner(key), nil, nil
+}
+
+func (k *Keyring) find(kid string) (int, bool) {
+	for i, key := range k.Keys {
+		if key.KeyId == kid {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Generate a private key for alg. bits is the RSA modulus size and is
+// ignored for other algorithms, 0 selects DefaultRsaBits.
+func Generate(alg string, bits int) (crypto.PrivateKey, error) {
+	switch alg {
+	case jwt.AlgRS256, jwt.AlgPS256:
+		if bits == 0 {
+			bits = DefaultRsaBits
+		}
+		if bits < MinRsaBits {
+			return nil, fmt.Errorf("RSA keys must be at least %v bits", MinRsaBits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case jwt.AlgES256:
+		return es256.GeneratePrivateKey()
+	case jwt.AlgEdDSA:
+		return eddsa.GeneratePrivateKey()
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm %v", alg)
+}
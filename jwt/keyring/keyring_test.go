@@ -0,0 +1,140 @@
+package keyring_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/keyring"
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+)
+
+func TestRotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	passphrase := []byte("secret")
+
+	if _, err := keyring.Open(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	k, err := keyring.Create(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, _ := keyring.Generate(jwt.AlgEdDSA, 0)
+	oldKey, err := k.Add(jwt.AlgEdDSA, priv, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, _ = keyring.Generate(jwt.AlgES256, 0)
+	newKey, err := k.Add(jwt.AlgES256, priv, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, newKey.File))
+	if err != nil || info.Mode().Perm() != keyring.FileMode {
+		t.Fatalf("key file permissions %v", info.Mode().Perm())
+	}
+
+	// staged key is published, but the first key still signs
+	iss := issuerFor(t, dir, passphrase)
+	if iss.KeyId() != oldKey.KeyId || len(iss.KeySet().Keys) != 2 {
+		t.Fatal("staged key should be published without signing")
+	}
+	token := iss.MustStringifyJwt(iss.MintToken("sub", "aud", time.Minute))
+
+	k, _ = keyring.Open(dir)
+	if err := k.Activate(newKey.KeyId); err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens signed before the rotation still verify
+	iss = issuerFor(t, dir, passphrase)
+	parsed, _ := jwt.FromString(token)
+	if iss.KeyId() != newKey.KeyId || !jwt.NewKeySetAudience(iss.KeySet(), "aud").JwtIsValid(parsed) {
+		t.Fatal("rotation broke tokens signed with the retiring key")
+	}
+
+	if err := k.Remove(newKey.KeyId); !errors.Is(err, keyring.ErrKeyIsActive) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if err := k.Remove(oldKey.KeyId); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(issuerFor(t, dir, passphrase).KeySet().Keys) != 1 {
+		t.Fatal("removed key still published")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, oldKey.File)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("removed key file still exists")
+	}
+}
+
+func TestGenerateRejectsSmallRsaKeys(t *testing.T) {
+	if _, err := keyring.Generate(jwt.AlgRS256, 1024); err == nil {
+		t.Fatal("generated 1024 bit RSA key")
+	}
+}
+
+func TestLoadSigners(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	rsaFile := filepath.Join(t.TempDir(), "jwtrsa.private")
+
+	priv := rs256.MustGeneratePrivateKey()
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	if err := rs256.SaveBytes(pemBytes, rsaFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a keyring, the RSA key is used
+	for _, d := range []string{dir, ""} {
+		active, others, err := keyring.LoadSigners(d, rsaFile, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if active.Alg() != jwt.AlgRS256 || len(others) != 0 {
+			t.Fatalf("expected the RSA key alone, got %v and %v others", active.Alg(), len(others))
+		}
+	}
+
+	k, _ := keyring.Create(dir)
+	key, _ := keyring.Generate(jwt.AlgEdDSA, 0)
+	added, _ := k.Add(jwt.AlgEdDSA, key, nil)
+	k.Activate(added.KeyId)
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	active, _, err := keyring.LoadSigners(dir, rsaFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.Alg() != jwt.AlgEdDSA {
+		t.Fatalf("keyring not used, got %v", active.Alg())
+	}
+}
+
+func issuerFor(t *testing.T, dir string, passphrase []byte) jwt.Issuer {
+	k, err := keyring.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, others, err := k.Signers(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jwt.NewIssuer(active, "TEST", others...)
+}
@@ -0,0 +1,221 @@
+// Package oauth is the client side of the OAuth2 client_credentials grant,
+// used by services to get tokens of their own from the auth server.
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+)
+
+const (
+	// RFC 7523 client_assertion_type of private_key_jwt client authentication
+	ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// lifetime of the assertions clients authenticate with
+	AssertionTTL = time.Minute
+	FetchTimeout = time.Second * 10
+	// lifetime assumed for tokens whose response has no expires_in
+	DefaultTokenLifetime = time.Minute
+)
+
+// Error response of the token endpoint
+type TokenError struct {
+	StatusCode  int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *TokenError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("token request failed: %v (%v)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("token request failed: %v: %v (%v)", e.Code, e.Description, e.StatusCode)
+}
+
+// How the client authenticates to the token endpoint
+type ClientAuth interface {
+	authenticate(r *http.Request, form url.Values) error
+}
+
+type clientSecret struct{ clientId, secret string }
+
+// Authenticate with the client's secret, using HTTP Basic
+func ClientSecret(clientId, secret string) ClientAuth {
+	return clientSecret{clientId, secret}
+}
+
+func (c clientSecret) authenticate(r *http.Request, form url.Values) error {
+	r.SetBasicAuth(c.clientId, c.secret)
+	return nil
+}
+
+type privateKeyJwt struct {
+	issuer   jwt.Issuer
+	audience string
+}
+
+// Authenticate with an assertion signed by the client's key. audience is
+// the name of the auth server's issuer, which the assertion is meant for.
+func PrivateKeyJwt(clientId string, signer jwt.Signer, audience string) ClientAuth {
+	return privateKeyJwt{jwt.NewIssuer(signer, clientId), audience}
+}
+
+func (c privateKeyJwt) authenticate(r *http.Request, form url.Values) error {
+	assertion := c.issuer.MintToken(c.issuer.Name, c.audience, AssertionTTL)
+	assertion.Header.Type = jwt.TypClientAssertion
+
+	signed, err := c.issuer.StringifyJwt(assertion)
+	if err != nil {
+		return err
+	}
+
+	form.Set("client_assertion_type", ClientAssertionType)
+	form.Set("client_assertion", signed)
+	return nil
+}
+
+// TokenSource caches the access token of a client for one audience, and
+// renews it once three quarters of its lifetime have passed.
+type TokenSource struct {
+	tokenUrl string
+	audience string
+	scopes   []string
+	auth     ClientAuth
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	renewAt time.Time
+}
+
+// NewTokenSource returns a TokenSource requesting tokens for audience with
+// the given scopes from the token endpoint at tokenUrl. A nil client uses
+// an http.Client with FetchTimeout.
+func NewTokenSource(tokenUrl, audience string, auth ClientAuth, client *http.Client, scopes ...string) *TokenSource {
+	if client == nil {
+		client = &http.Client{Timeout: FetchTimeout}
+	}
+	return &TokenSource{tokenUrl: tokenUrl, audience: audience, scopes: scopes, auth: auth, client: client}
+}
+
+// The cached token, requesting a new one when it is due for renewal
+func (s *TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.renewAt) {
+		return s.token, nil
+	}
+
+	obtained := time.Now()
+	token, lifetime, err := s.fetch()
+	if err != nil {
+		return "", err
+	}
+
+	s.token = token
+	s.renewAt = obtained.Add(lifetime * 3 / 4)
+	return s.token, nil
+}
+
+// Drop the cached token, so that the next call to Token requests a new one.
+// For when a token is rejected before it was due for renewal.
+func (s *TokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+// An http.Client sending the token as a bearer token with every request
+func (s *TokenSource) Client() *http.Client {
+	return &http.Client{
+		Transport: &Transport{Source: s, Base: s.client.Transport},
+		Timeout:   s.client.Timeout,
+	}
+}
+
+func (s *TokenSource) fetch() (string, time.Duration, error) {
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"audience":   {s.audience},
+	}
+	if len(s.scopes) > 0 {
+		form.Set("scope", strings.Join(s.scopes, " "))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.tokenUrl, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// authentication may add params, so the body is set after it
+	if err := s.auth.authenticate(req, form); err != nil {
+		return "", 0, err
+	}
+
+	body := form.Encode()
+	req.Body = io.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		tokenErr := &TokenError{StatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(tokenErr)
+		return "", 0, tokenErr
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, err
+	}
+
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("token response without access_token")
+	}
+
+	// without a lifetime the token would be renewed on every call
+	if token.ExpiresIn <= 0 {
+		return token.AccessToken, DefaultTokenLifetime, nil
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// Transport adds the token of Source to each request as a bearer token
+type Transport struct {
+	Source *TokenSource
+	// nil uses http.DefaultTransport
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.Source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// a RoundTripper must not modify the request it was given
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return base.RoundTrip(r)
+}
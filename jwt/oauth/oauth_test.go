@@ -0,0 +1,124 @@
+package oauth_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt/oauth"
+)
+
+// token endpoint handing out numbered tokens to the client "svc"
+func tokenServer(t *testing.T, expiresIn int, issued *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "svc" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		if r.PostFormValue("grant_type") != "client_credentials" || r.PostFormValue("audience") != "aud" {
+			t.Errorf("bad token request %v", r.PostForm)
+		}
+
+		n := atomic.AddInt32(issued, 1)
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "token" + strconv.Itoa(int(n)),
+			"token_type":   "Bearer",
+			"expires_in":   expiresIn,
+		})
+	}))
+}
+
+func TestTokenIsCached(t *testing.T) {
+	var issued int32
+	srv := tokenServer(t, 60, &issued)
+	defer srv.Close()
+
+	tokens := oauth.NewTokenSource(srv.URL, "aud", oauth.ClientSecret("svc", "secret"), nil)
+
+	for i := 0; i < 3; i++ {
+		token, err := tokens.Token()
+		if err != nil || token != "token1" {
+			t.Fatalf("got %v, %v", token, err)
+		}
+	}
+
+	tokens.Invalidate()
+	if token, _ := tokens.Token(); token != "token2" {
+		t.Fatalf("invalidated token reused: %v", token)
+	}
+}
+
+func TestTokenIsRenewed(t *testing.T) {
+	var issued int32
+	srv := tokenServer(t, 1, &issued)
+	defer srv.Close()
+
+	tokens := oauth.NewTokenSource(srv.URL, "aud", oauth.ClientSecret("svc", "secret"), nil)
+	tokens.Token()
+
+	// renewed after three quarters of the lifetime
+	time.Sleep(time.Millisecond * 800)
+	if token, _ := tokens.Token(); token != "token2" {
+		t.Fatalf("token not renewed: %v", token)
+	}
+}
+
+func TestTokenWithoutLifetime(t *testing.T) {
+	var issued int32
+	srv := tokenServer(t, 0, &issued)
+	defer srv.Close()
+
+	tokens := oauth.NewTokenSource(srv.URL, "aud", oauth.ClientSecret("svc", "secret"), nil)
+
+	for i := 0; i < 3; i++ {
+		if token, _ := tokens.Token(); token != "token1" {
+			t.Fatalf("token without expires_in not cached: %v", token)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var issued int32
+	auth := tokenServer(t, 60, &issued)
+	defer auth.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer api.Close()
+
+	tokens := oauth.NewTokenSource(auth.URL, "aud", oauth.ClientSecret("svc", "secret"), nil)
+
+	resp, err := tokens.Client().Get(api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bearer token not sent: %v", resp.StatusCode)
+	}
+}
+
+func TestTokenError(t *testing.T) {
+	var issued int32
+	srv := tokenServer(t, 60, &issued)
+	defer srv.Close()
+
+	tokens := oauth.NewTokenSource(srv.URL, "aud", oauth.ClientSecret("svc", "wrong"), nil)
+
+	_, err := tokens.Token()
+	tokenErr, ok := err.(*oauth.TokenError)
+	if !ok || tokenErr.Code != "invalid_client" || tokenErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected invalid_client, got %v", err)
+	}
+}
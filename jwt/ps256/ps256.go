@@ -0,0 +1,68 @@
+// Package ps256 implements the PS256 JWS algorithm (RSASSA-PSS using SHA-256
+// and MGF1 with SHA-256). Keys are ordinary RSA keys, so the key helpers in
+// package rs256 can be used to load and store them.
+package ps256
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+)
+
+// Alg is the JWS "alg" header value for signatures made by this package.
+const Alg = "PS256"
+
+// RFC 7518 requires the PSS salt to be the same length as the hash output.
+var pssOptions = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+
+func Signature(b []byte, priv *rsa.PrivateKey) ([]byte, error) {
+	return rsa.SignPSS(rand.Reader, priv, crypto.SHA256, rs256.HashDigest(b), pssOptions)
+}
+
+func VerifySignature(b, sig []byte, pub *rsa.PublicKey) bool {
+	return rsa.VerifyPSS(pub, crypto.SHA256, rs256.HashDigest(b), sig, pssOptions) == nil
+}
+
+// Signer signs JWS signing input with PS256.
+type Signer struct {
+	key *rsa.PrivateKey
+}
+
+func NewSigner(priv *rsa.PrivateKey) Signer {
+	return Signer{priv}
+}
+
+func (s Signer) Alg() string {
+	return Alg
+}
+
+func (s Signer) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s Signer) Sign(b []byte) ([]byte, error) {
+	return Signature(b, s.key)
+}
+
+// Verifier verifies PS256 signatures.
+type Verifier struct {
+	key *rsa.PublicKey
+}
+
+func NewVerifier(pub *rsa.PublicKey) Verifier {
+	return Verifier{pub}
+}
+
+func (v Verifier) Alg() string {
+	return Alg
+}
+
+func (v Verifier) Public() crypto.PublicKey {
+	return v.key
+}
+
+func (v Verifier) Verify(b, sig []byte) bool {
+	return VerifySignature(b, sig, v.key)
+}
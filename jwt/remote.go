@@ -0,0 +1,230 @@
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// used when the issuer sends no usable Cache-Control max-age
+	DefaultKeyRefreshInterval = time.Minute * 5
+	// bounds for the refresh interval requested by the issuer
+	MinKeyRefreshInterval = time.Second * 30
+	MaxKeyRefreshInterval = time.Hour * 24
+	// unknown key ids trigger at most one refetch per interval
+	KeyRefetchInterval = time.Second * 10
+	KeyFetchTimeout    = time.Second * 10
+)
+
+// RemoteKeySet is a KeySet backed by an issuer's JWKS endpoint. Keys are
+// cached and refreshed in the background, honouring ETag and Cache-Control.
+// A token naming an unknown kid causes a rate limited refetch, so keys
+// added by a rotation are picked up without waiting for the next refresh.
+//
+// The set starts out empty and keeps retrying until the issuer answers, so
+// an unreachable issuer at startup only means that tokens are rejected
+// until it comes up.
+type RemoteKeySet struct {
+	url    string
+	client *http.Client
+
+	mu          sync.RWMutex
+	keys        Jwks
+	etag        string
+	updated     time.Time // time of last successful fetch
+	maxAge      time.Duration
+	lastAttempt time.Time
+
+	fetchMu sync.Mutex // one fetch at a time
+	done    chan struct{}
+	close   sync.Once
+}
+
+// NewRemoteKeySet starts refreshing the key set served at url. A nil client
+// uses a default client with a KeyFetchTimeout timeout.
+func NewRemoteKeySet(url string, client *http.Client) *RemoteKeySet {
+	if client == nil {
+		client = &http.Client{Timeout: KeyFetchTimeout}
+	}
+
+	s := &RemoteKeySet{
+		url:    url,
+		client: client,
+		done:   make(chan struct{}),
+	}
+
+	go s.refreshLoop()
+	return s
+}
+
+// Close stops the background refresh.
+func (s *RemoteKeySet) Close() {
+	s.close.Do(func() { close(s.done) })
+}
+
+// Time of the last successful fetch, the zero time if keys were never fetched.
+func (s *RemoteKeySet) Updated() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.updated
+}
+
+// Whether the keys were fetched within twice their refresh interval, so
+// that the set is stale once the issuer missed more than one refresh.
+func (s *RemoteKeySet) Fresh() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	maxAge := s.maxAge
+	if maxAge == 0 {
+		maxAge = DefaultKeyRefreshInterval
+	}
+	return !s.updated.IsZero() && time.Since(s.updated) <= 2*maxAge
+}
+
+func (s *RemoteKeySet) Verifier(kid string) (Verifier, bool) {
+	if v, ok := s.lookup(kid); ok {
+		return v, ok
+	}
+
+	// a fetch that is already running may bring the key
+	s.fetchMu.Lock()
+	s.fetchMu.Unlock()
+
+	if v, ok := s.lookup(kid); ok {
+		return v, ok
+	}
+
+	s.mu.RLock()
+	canRefetch := time.Since(s.lastAttempt) >= KeyRefetchInterval
+	s.mu.RUnlock()
+
+	if !canRefetch {
+		return nil, false
+	}
+
+	// the issuer may have rotated keys since the last fetch
+	s.fetch()
+
+	return s.lookup(kid)
+}
+
+func (s *RemoteKeySet) lookup(kid string) (Verifier, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys.Verifier(kid)
+}
+
+func (s *RemoteKeySet) refreshLoop() {
+	retry := time.Second
+
+	for {
+		var wait time.Duration
+
+		if err := s.fetch(); err != nil {
+			// back off until the issuer is reachable again
+			wait = retry
+			retry = minDuration(retry*2, DefaultKeyRefreshInterval)
+		} else {
+			retry = time.Second
+			s.mu.RLock()
+			wait = s.maxAge
+			s.mu.RUnlock()
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// fetch the key set, sending the ETag of the cached set so that an
+// unchanged set costs the issuer no more than a 304
+func (s *RemoteKeySet) fetch() error {
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+
+	s.mu.Lock()
+	s.lastAttempt = time.Now()
+	etag := s.etag
+	s.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	r, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	var keys Jwks
+
+	switch r.StatusCode {
+	case http.StatusNotModified:
+	case http.StatusOK:
+		if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("fetch jwks: %v", r.Status)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.StatusCode == http.StatusOK {
+		s.keys = keys
+		s.etag = r.Header.Get("ETag")
+	}
+	s.updated = time.Now()
+	s.maxAge = refreshInterval(r.Header.Get("Cache-Control"))
+
+	return nil
+}
+
+// refresh interval from the max-age directive of a Cache-Control header
+func refreshInterval(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			break
+		}
+
+		age := time.Duration(seconds) * time.Second
+		return minDuration(maxDuration(age, MinKeyRefreshInterval), MaxKeyRefreshInterval)
+	}
+
+	return DefaultKeyRefreshInterval
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
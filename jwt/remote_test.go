@@ -0,0 +1,135 @@
+package jwt_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/es256"
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+)
+
+// JWKS endpoint that serves the keys of iss, or 503 while down is set
+type jwksServer struct {
+	iss      atomic.Value
+	down     int32
+	requests int32
+}
+
+func (j *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&j.requests, 1)
+
+	if atomic.LoadInt32(&j.down) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	iss := j.iss.Load().(jwt.Issuer)
+	if r.Header.Get("If-None-Match") == iss.KeyId() {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", iss.KeyId())
+	w.Header().Set("Cache-Control", "max-age=3600")
+	json.NewEncoder(w).Encode(iss.KeySet())
+}
+
+func mintFor(iss jwt.Issuer) jwt.Jwt {
+	token, _ := jwt.FromString(iss.MustStringifyJwt(iss.MintToken("sub", "aud", time.Minute)))
+	return token
+}
+
+func TestRemoteKeySetRotation(t *testing.T) {
+	oldIss := jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+	newIss := jwt.NewIssuer(ecSigner(es256.MustGeneratePrivateKey()), "TEST", rs256.NewSigner(privKey))
+
+	jwks := &jwksServer{}
+	jwks.iss.Store(oldIss)
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	keys := jwt.NewRemoteKeySet(srv.URL, nil)
+	defer keys.Close()
+	aud := jwt.NewKeySetAudience(keys, "aud")
+
+	if !aud.JwtIsValid(mintFor(oldIss)) {
+		t.Fatal("token signed with published key rejected")
+	}
+
+	// rotated key is unknown until refetched, the refetch waits out the
+	// rate limit of the failed lookup
+	jwks.iss.Store(newIss)
+	deadline := time.Now().Add(jwt.KeyRefetchInterval * 2)
+	for !aud.JwtIsValid(mintFor(newIss)) {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated key never fetched")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	if !aud.JwtIsValid(mintFor(oldIss)) {
+		t.Fatal("token signed with retiring key rejected")
+	}
+}
+
+func TestRemoteKeySetRateLimit(t *testing.T) {
+	iss := jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+	stranger := jwt.NewIssuer(ecSigner(es256.MustGeneratePrivateKey()), "TEST")
+
+	jwks := &jwksServer{}
+	jwks.iss.Store(iss)
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	keys := jwt.NewRemoteKeySet(srv.URL, nil)
+	defer keys.Close()
+	aud := jwt.NewKeySetAudience(keys, "aud")
+
+	aud.JwtIsValid(mintFor(iss))
+	before := atomic.LoadInt32(&jwks.requests)
+
+	for i := 0; i < 20; i++ {
+		aud.JwtIsValid(mintFor(stranger))
+	}
+
+	if n := atomic.LoadInt32(&jwks.requests) - before; n > 1 {
+		t.Fatalf("unknown kid caused %v fetches", n)
+	}
+}
+
+func TestRemoteKeySetIssuerDown(t *testing.T) {
+	iss := jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+
+	jwks := &jwksServer{}
+	jwks.iss.Store(iss)
+	atomic.StoreInt32(&jwks.down, 1)
+	srv := httptest.NewServer(jwks)
+	defer srv.Close()
+
+	keys := jwt.NewRemoteKeySet(srv.URL, nil)
+	defer keys.Close()
+	aud := jwt.NewKeySetAudience(keys, "aud")
+
+	if aud.JwtIsValid(mintFor(iss)) || !keys.Updated().IsZero() || keys.Fresh() {
+		t.Fatal("keys available while issuer is down")
+	}
+
+	// background refresh keeps retrying until the issuer is up
+	atomic.StoreInt32(&jwks.down, 0)
+	deadline := time.Now().Add(time.Second * 5)
+	for keys.Updated().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("keys never fetched after issuer came up")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	if !aud.JwtIsValid(mintFor(iss)) || !keys.Fresh() {
+		t.Fatal("token rejected after issuer came up")
+	}
+}
@@ -1,3 +1,5 @@
+// Package rs256 implements the RS256 JWS algorithm (RSASSA-PKCS1-v1_5 using
+// SHA-256) along with helpers for loading and storing RSA keys.
 package rs256
 
 import (
@@ -6,30 +8,94 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/pem"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt/keyfile"
+)
+
+// Alg is the JWS "alg" header value for signatures made by this package.
+const Alg = "RS256"
+
+const (
+	KeyBits      = 2048
+	FetchTimeout = time.Second * 10
+)
+
+// errors
+
+var (
+	// wrapped by every error caused by malformed or non-RSA key bytes
+	ErrInvalidKey = keyfile.ErrInvalidKey
+	// returned when parsing an encrypted private key
+	ErrPassphraseRequired  = keyfile.ErrPassphraseRequired
+	ErrIncorrectPassphrase = keyfile.ErrIncorrectPassphrase
 )
 
-var keyCache = make(map[string][]byte)
+// KeyFileError is returned when a key file can't be read or written. The
+// underlying error can be inspected with errors.Is, e.g. for fs.ErrNotExist.
+type KeyFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *KeyFileError) Error() string {
+	return fmt.Sprintf("key file %s: %v", e.Path, e.Err)
+}
+
+func (e *KeyFileError) Unwrap() error {
+	return e.Err
+}
+
+// FetchError is returned when a public key can't be fetched. StatusCode is 0
+// when no response was received.
+type FetchError struct {
+	Url        string
+	StatusCode int
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("fetch %s: status %d", e.Url, e.StatusCode)
+	}
+	return fmt.Sprintf("fetch %s: %v", e.Url, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+//
+
+var fetchClient = &http.Client{Timeout: FetchTimeout}
 
-func FetchRsaPublicKey(url string) *rsa.PublicKey {
-	r, err := http.Get(url)
+func FetchRsaPublicKey(url string) (*rsa.PublicKey, error) {
+	r, err := fetchClient.Get(url)
 	if err != nil {
-		panic(err)
+		return nil, &FetchError{url, 0, err}
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, &FetchError{url, r.StatusCode, nil}
 	}
 
 	raw, err := io.ReadAll(r.Body)
 	if err != nil {
-		panic(err)
+		return nil, &FetchError{url, r.StatusCode, err}
 	}
 
-	k, err := x509.ParsePKCS1PublicKey(raw)
+	k, err := ParsePublicBytes(raw)
 	if err != nil {
-		panic(err)
+		return nil, &FetchError{url, r.StatusCode, err}
 	}
 
-	return k
+	return k, nil
 }
 
 func HashDigest(b []byte) []byte {
@@ -38,89 +104,219 @@ func HashDigest(b []byte) []byte {
 	return hash.Sum(nil)
 }
 
-func Signature(b []byte, priv *rsa.PrivateKey) []byte {
-	sig, err := rsa.SignPSS(rand.Reader, priv, crypto.SHA256, HashDigest(b), nil)
+func Signature(b []byte, priv *rsa.PrivateKey) ([]byte, error) {
+	return rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, HashDigest(b))
+}
+
+func VerifySignature(b, sig []byte, pub *rsa.PublicKey) bool {
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, HashDigest(b), sig) == nil
+}
+
+// Signer signs JWS signing input with RS256.
+type Signer struct {
+	key *rsa.PrivateKey
+}
+
+func NewSigner(priv *rsa.PrivateKey) Signer {
+	return Signer{priv}
+}
+
+func (s Signer) Alg() string {
+	return Alg
+}
+
+func (s Signer) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s Signer) Sign(b []byte) ([]byte, error) {
+	return Signature(b, s.key)
+}
+
+// Verifier verifies RS256 signatures.
+type Verifier struct {
+	key *rsa.PublicKey
+}
+
+func NewVerifier(pub *rsa.PublicKey) Verifier {
+	return Verifier{pub}
+}
+
+func (v Verifier) Alg() string {
+	return Alg
+}
+
+func (v Verifier) Public() crypto.PublicKey {
+	return v.key
+}
+
+func (v Verifier) Verify(b, sig []byte) bool {
+	return VerifySignature(b, sig, v.key)
+}
+
+// Parse an unencrypted private key. PEM and DER encoded PKCS#1 and PKCS#8
+// keys are accepted.
+func ParsePrivate(b []byte) (*rsa.PrivateKey, error) {
+	return ParsePrivateWithPassphrase(b, nil)
+}
 
+// Parse a private key like ParsePrivate, decrypting it with the passphrase
+// if the key is encrypted.
+func ParsePrivateWithPassphrase(b, passphrase []byte) (*rsa.PrivateKey, error) {
+	k, err := keyfile.ParsePrivateKey(b, passphrase)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return sig
-}
+	rsaKey, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T is not an RSA key", ErrInvalidKey, k)
+	}
 
-func VerifySignature(b, sig []byte, pub *rsa.PublicKey) bool {
-	return rsa.VerifyPSS(pub, crypto.SHA256, HashDigest(b), sig, nil) == nil
+	return rsaKey, nil
 }
 
-func ParsePrivate(b []byte) *rsa.PrivateKey {
-	k, err := x509.ParsePKCS1PrivateKey(b)
+func MustParsePrivate(b []byte) *rsa.PrivateKey {
+	k, err := ParsePrivate(b)
 	if err != nil {
 		panic(err)
 	}
-
 	return k
 }
 
-func GeneratePrivateKey() (k *rsa.PrivateKey) {
-	k, err := rsa.GenerateKey(rand.Reader, 2048)
+func GeneratePrivateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, KeyBits)
+}
+
+func MustGeneratePrivateKey() *rsa.PrivateKey {
+	k, err := GeneratePrivateKey()
 	if err != nil {
 		panic(err)
 	}
-	return
+	return k
 }
 
+// DER encoded PKCS#1
 func MarshallPrivateKey(k *rsa.PrivateKey) []byte {
 	return x509.MarshalPKCS1PrivateKey(k)
 }
 
-func ParsePublicBytes(b []byte) *rsa.PublicKey {
-	k, err := x509.ParsePKCS1PublicKey(b)
+// PEM encoded PKCS#1 ("RSA PRIVATE KEY")
+func MarshalPKCS1PrivatePEM(k *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  keyfile.PKCS1PrivateType,
+		Bytes: x509.MarshalPKCS1PrivateKey(k),
+	})
+}
+
+// PEM encoded PKCS#8, encrypted when the passphrase is not empty
+func MarshalPKCS8PrivatePEM(k *rsa.PrivateKey, passphrase []byte) ([]byte, error) {
+	return keyfile.MarshalPKCS8PEM(k, passphrase)
+}
+
+// Parse a public key. PEM and DER encoded PKCS#1 and SPKI keys are accepted.
+func ParsePublicBytes(b []byte) (*rsa.PublicKey, error) {
+	k, err := keyfile.ParsePublicKey(b)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return k
+	rsaKey, ok := k.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T is not an RSA key", ErrInvalidKey, k)
+	}
+
+	return rsaKey, nil
 }
 
+// DER encoded PKCS#1
 func MarshallPublicKey(k *rsa.PublicKey) []byte {
 	return x509.MarshalPKCS1PublicKey(k)
 }
 
-func LoadKey(fp string) []byte {
-	if bytes, ok := keyCache[fp]; ok {
-		return bytes
-	}
+// PEM encoded PKCS#1 ("RSA PUBLIC KEY")
+func MarshalPKCS1PublicPEM(k *rsa.PublicKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  keyfile.PKCS1PublicType,
+		Bytes: x509.MarshalPKCS1PublicKey(k),
+	})
+}
 
-	f, err := os.Open(fp)
-	defer f.Close()
+// PEM encoded SPKI ("PUBLIC KEY")
+func MarshalSPKIPublicPEM(k *rsa.PublicKey) ([]byte, error) {
+	return keyfile.MarshalSPKIPEM(k)
+}
+
+// Read the key file at fp. The file is read on every call, so that a key
+// rotated on disk is picked up by the next load.
+func LoadKey(fp string) ([]byte, error) {
+	bytes, err := os.ReadFile(fp)
 	if err != nil {
-		panic(err)
+		return nil, &KeyFileError{fp, err}
 	}
 
-	bytes, err := io.ReadAll(f)
+	return bytes, nil
+}
 
+// Load and parse the private key file at fp, detecting its format. The
+// passphrase is only used if the key is encrypted.
+func LoadPrivateKey(fp string, passphrase []byte) (*rsa.PrivateKey, error) {
+	b, err := LoadKey(fp)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	keyCache[fp] = bytes
+	k, err := ParsePrivateWithPassphrase(b, passphrase)
+	if err != nil {
+		return nil, &KeyFileError{fp, err}
+	}
 
-	return bytes
+	return k, nil
 }
 
-func SaveBytes(b []byte, fp string) error {
-	f, err := os.Create(fp)
-	defer f.Close()
+// Load and parse the public key file at fp, detecting its format.
+func LoadPublicKey(fp string) (*rsa.PublicKey, error) {
+	b, err := LoadKey(fp)
+	if err != nil {
+		return nil, err
+	}
 
+	k, err := ParsePublicBytes(b)
 	if err != nil {
-		panic(err)
+		return nil, &KeyFileError{fp, err}
 	}
 
-	_, err = f.Write(b)
+	return k, nil
+}
 
+func MustLoadKey(fp string) []byte {
+	b, err := LoadKey(fp)
 	if err != nil {
 		panic(err)
 	}
+	return b
+}
+
+// Write b to fp, only readable by the owner since b is usually a private key.
+// An existing file is made owner only before it is written.
+func SaveBytes(b []byte, fp string) error {
+	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return &KeyFileError{fp, err}
+	}
+
+	// the mode of OpenFile only applies to new files
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return &KeyFileError{fp, err}
+	}
 
 	return nil
 }
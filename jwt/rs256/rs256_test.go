@@ -0,0 +1,110 @@
+package rs256_test
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+)
+
+func TestLoadKeyMissingFile(t *testing.T) {
+	_, err := rs256.LoadKey(filepath.Join(t.TempDir(), "missing.private"))
+
+	var fileErr *rs256.KeyFileError
+	if !errors.As(err, &fileErr) || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestParseInvalidKey(t *testing.T) {
+	if _, err := rs256.ParsePrivate([]byte("junk")); !errors.Is(err, rs256.ErrInvalidKey) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if _, err := rs256.ParsePublicBytes([]byte("junk")); !errors.Is(err, rs256.ErrInvalidKey) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestSaveAndLoadKey(t *testing.T) {
+	k := rs256.MustGeneratePrivateKey()
+	fp := filepath.Join(t.TempDir(), "jwtrsa.private")
+
+	if err := rs256.SaveBytes(rs256.MarshallPrivateKey(k), fp); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := rs256.ParsePrivate(rs256.MustLoadKey(fp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !loaded.Equal(k) {
+		t.Fatal("loaded key differs from saved key")
+	}
+
+	os.Remove(fp)
+}
+
+func TestSaveKeyOverExistingFile(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "jwtrsa.private")
+	os.WriteFile(fp, rs256.MarshallPrivateKey(rs256.MustGeneratePrivateKey()), 0644)
+	if _, err := rs256.LoadPrivateKey(fp, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rotated key is read again, and the file is made owner only
+	k := rs256.MustGeneratePrivateKey()
+	if err := rs256.SaveBytes(rs256.MarshallPrivateKey(k), fp); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := rs256.LoadPrivateKey(fp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(k) {
+		t.Fatal("loaded the key replaced on disk")
+	}
+
+	info, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode %v", info.Mode().Perm())
+	}
+}
+
+func TestFetchRsaPublicKey(t *testing.T) {
+	k := rs256.MustGeneratePrivateKey()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jwtkeypub" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(rs256.MarshallPublicKey(&k.PublicKey))
+	}))
+	defer srv.Close()
+
+	pub, err := rs256.FetchRsaPublicKey(srv.URL + "/jwtkeypub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !pub.Equal(&k.PublicKey) {
+		t.Fatal("fetched key differs")
+	}
+
+	_, err = rs256.FetchRsaPublicKey(srv.URL + "/nothere")
+
+	var fetchErr *rs256.FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package jwt
+
+import "crypto"
+
+// Signer produces the signature of a token for a single algorithm and key.
+// The rs256, ps256, es256 and eddsa packages provide implementations.
+type Signer interface {
+	// JWS "alg" header value written to tokens signed by the Signer
+	Alg() string
+	Public() crypto.PublicKey
+	Sign(signingInput []byte) ([]byte, error)
+}
+
+// Verifier checks token signatures for a single algorithm and key.
+type Verifier interface {
+	// JWS "alg" header value of tokens the Verifier accepts
+	Alg() string
+	Public() crypto.PublicKey
+	Verify(signingInput, sig []byte) bool
+}
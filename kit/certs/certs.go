@@ -0,0 +1,345 @@
+// Package certs provides the TLS configuration of the gosqueak servers and
+// of their clients: certificates reloaded from disk when they are rotated,
+// self-signed certificates for development, and CA pools for mutual TLS.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the certificate files are checked for changes
+	CheckInterval = time.Second * 10
+	// lifetime of self-signed certificates
+	SelfSignedTTL = time.Hour * 24 * 365
+	// private keys are only readable by their owner
+	KeyFileMode = 0600
+)
+
+// Reloader serves the certificate in a pair of PEM files, loading it again
+// when the files change so that rotated certificates are picked up without
+// a restart. A pair that fails to load, such as one that is half written,
+// is retried on the next check while the previous certificate is served.
+type Reloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	loaded  time.Time
+	checked time.Time
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load the certificate files now
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.load()
+}
+
+func (r *Reloader) load() error {
+	modified, err := r.modified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert, r.loaded, r.checked = &cert, modified, time.Now()
+	return nil
+}
+
+// the latest modification time of the pair
+func (r *Reloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// The current certificate, reloaded if the files changed
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < CheckInterval {
+		return r.cert
+	}
+	r.checked = time.Now()
+
+	modified, err := r.modified()
+	if err == nil && modified.Equal(r.loaded) {
+		return r.cert
+	}
+
+	if err == nil {
+		err = r.load()
+	}
+	if err != nil {
+		slog.Error("keeping the current certificate", "err", err)
+	}
+
+	return r.cert
+}
+
+// For tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// For tls.Config.GetClientCertificate
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// SelfSigned generates an ECDSA P-256 certificate for hosts, DNS names or
+// IP addresses, signed by its own key. It is its own CA, so clients can
+// trust it by adding it to their pool, and may also serve as a client
+// certificate.
+func SelfSigned(hosts ...string) (certPEM, keyPEM []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gosqueak development"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(SelfSignedTTL),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// Write a self-signed certificate for hosts to certFile and keyFile, unless
+// certFile already exists.
+func EnsureSelfSigned(certFile, keyFile string, hosts ...string) error {
+	_, err := os.Stat(certFile)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	certPEM, keyPEM, err := SelfSigned(hosts...)
+	if err != nil {
+		return err
+	}
+
+	// the key first, a certificate without its key would be kept
+	if err := os.WriteFile(keyFile, keyPEM, KeyFileMode); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, certPEM, 0644)
+}
+
+// The hosts a server listening on addr is reached at, for its self-signed
+// certificate. Servers listening on every interface add the hostname.
+func Hosts(addr string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return hosts
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if name, err := os.Hostname(); err == nil {
+			host = name
+		}
+	}
+
+	for _, h := range hosts {
+		if h == host {
+			return hosts
+		}
+	}
+	return append(hosts, host)
+}
+
+// Load the PEM certificates in file into a pool
+func LoadPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%v: no PEM certificates", file)
+	}
+	return pool, nil
+}
+
+// TLS settings of a server
+type ServerOptions struct {
+	CertFile string
+	KeyFile  string
+	// generate a certificate for Hosts, written to CertFile and KeyFile if
+	// they don't exist yet, or else only kept in memory
+	SelfSigned bool
+	Hosts      []string
+	// CA of the client certificates to verify, those that are presented
+	// unless RequireClientCert is set
+	ClientCaFile      string
+	RequireClientCert bool
+}
+
+// Whether the options turn TLS on
+func (o ServerOptions) Enabled() bool {
+	return o.CertFile != "" || o.SelfSigned
+}
+
+// Check the options for settings that only make sense together. Errors
+// name the options by their usual flags.
+func (o ServerOptions) Validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+	if o.ClientCaFile != "" && !o.Enabled() {
+		return fmt.Errorf("tls-client-ca needs HTTPS, set tls-cert or tls-self-signed")
+	}
+	if o.RequireClientCert && o.ClientCaFile == "" {
+		return fmt.Errorf("tls-require-client-cert needs tls-client-ca")
+	}
+	return nil
+}
+
+// ServerConfig returns the tls.Config of a server, or nil when TLS is not
+// enabled.
+func ServerConfig(o ServerOptions) (*tls.Config, error) {
+	if !o.Enabled() {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	switch {
+	case o.SelfSigned && o.CertFile == "":
+		certPEM, keyPEM, err := SelfSigned(o.Hosts...)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+
+	default:
+		if o.SelfSigned {
+			if err := EnsureSelfSigned(o.CertFile, o.KeyFile, o.Hosts...); err != nil {
+				return nil, err
+			}
+		}
+
+		r, err := NewReloader(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetCertificate = r.GetCertificate
+	}
+
+	if o.ClientCaFile != "" {
+		pool, err := LoadPool(o.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if o.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return cfg, nil
+}
+
+// ClientConfig returns the tls.Config of a client trusting the CAs in
+// caFile, or the system roots when it is empty, and presenting the
+// certificate in certFile and keyFile, if set, for mutual TLS.
+func ClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := LoadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" {
+		r, err := NewReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = r.GetClientCertificate
+	}
+
+	return cfg, nil
+}
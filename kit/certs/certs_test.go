@@ -0,0 +1,173 @@
+package certs_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/certs"
+)
+
+// Serve 200 OK over TLS until the test ends, returning the URL
+func serveTLS(t *testing.T, cfg *tls.Config) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go srv.Serve(tls.NewListener(ln, cfg))
+	t.Cleanup(func() { srv.Close() })
+
+	return "https://" + ln.Addr().String()
+}
+
+func get(cfg *tls.Config, url string) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: time.Second * 5}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestMutualTls(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	clientCert, clientKey := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+
+	if err := certs.EnsureSelfSigned(clientCert, clientKey, "client"); err != nil {
+		t.Fatal(err)
+	}
+
+	serverCfg, err := certs.ServerConfig(certs.ServerOptions{
+		CertFile:          serverCert,
+		KeyFile:           serverKey,
+		SelfSigned:        true,
+		Hosts:             certs.Hosts("127.0.0.1:0"),
+		ClientCaFile:      clientCert,
+		RequireClientCert: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := serveTLS(t, serverCfg)
+
+	clientCfg, err := certs.ClientConfig(serverCert, clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(clientCfg, url); err != nil {
+		t.Fatalf("mutual TLS failed: %v", err)
+	}
+
+	// without a client certificate
+	anonymous, _ := certs.ClientConfig(serverCert, "", "")
+	if err := get(anonymous, url); err == nil {
+		t.Fatal("client without certificate accepted")
+	}
+
+	// without trusting the self-signed certificate
+	untrusting, _ := certs.ClientConfig("", clientCert, clientKey)
+	if err := get(untrusting, url); err == nil {
+		t.Fatal("self-signed certificate trusted")
+	}
+}
+
+func TestEnsureSelfSignedKeepsFiles(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	certs.EnsureSelfSigned(cert, key, "localhost")
+	first, _ := os.ReadFile(cert)
+
+	certs.EnsureSelfSigned(cert, key, "localhost")
+	second, _ := os.ReadFile(cert)
+
+	if !bytes.Equal(first, second) {
+		t.Fatal("existing certificate replaced")
+	}
+
+	if info, _ := os.Stat(key); info.Mode().Perm() != certs.KeyFileMode {
+		t.Fatalf("key file readable by others: %v", info.Mode())
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	write := func(host string) {
+		certPEM, keyPEM, err := certs.SelfSigned(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(cert, certPEM, 0644)
+		os.WriteFile(key, keyPEM, 0600)
+	}
+
+	write("old.example")
+	r, err := certs.NewReloader(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := r.Certificate()
+
+	// a rotation
+	write("new.example")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(r.Certificate().Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Certificate() == old || leaf.Subject.CommonName != "new.example" {
+		t.Fatal("rotated certificate not loaded")
+	}
+
+	// a broken pair keeps the current certificate
+	current := r.Certificate()
+	os.WriteFile(key, []byte("half written"), 0600)
+	if err := r.Reload(); err == nil {
+		t.Fatal("broken key loaded")
+	}
+	if r.Certificate() != current {
+		t.Fatal("current certificate dropped")
+	}
+}
+
+func TestHosts(t *testing.T) {
+	hosts := certs.Hosts("gosqueak.example:443")
+	if hosts[len(hosts)-1] != "gosqueak.example" {
+		t.Fatalf("listen host missing: %v", hosts)
+	}
+
+	if len(certs.Hosts("127.0.0.1:8081")) != 3 {
+		t.Fatalf("loopback host repeated: %v", certs.Hosts("127.0.0.1:8081"))
+	}
+}
+
+func TestServerOptionsValidate(t *testing.T) {
+	for _, o := range []certs.ServerOptions{
+		{CertFile: "tls.crt"},
+		{ClientCaFile: "ca.crt"},
+		{SelfSigned: true, RequireClientCert: true},
+	} {
+		if err := o.Validate(); err == nil {
+			t.Fatalf("%+v accepted", o)
+		}
+	}
+
+	if cfg, err := certs.ServerConfig(certs.ServerOptions{}); cfg != nil || err != nil {
+		t.Fatal("TLS enabled without options")
+	}
+}
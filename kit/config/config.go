@@ -0,0 +1,330 @@
+// Package config loads the configuration of the gosqueak binaries.
+//
+// A configuration is a struct holding its defaults, which Load overrides,
+// in increasing order of precedence, with
+//
+//  1. a YAML (.yaml, .yml) or TOML (.toml) file, named by the -config flag
+//     or by the <prefix>CONFIG environment variable,
+//  2. environment variables, named <prefix> followed by the env tag,
+//  3. command line flags, named by the flag tag.
+//
+// Fields are matched to file keys by their yaml and toml tags; fields with
+// only those tags, such as maps, are set from the file alone. The fields of
+// embedded structs are those of the configuration, so that binaries share
+// settings; they need the `yaml:",inline"` tag. Flags and
+// environment variables accept strings, bools, ints, durations and comma
+// separated string lists:
+//
+//	type Config struct {
+//		Addr string `yaml:"addr" toml:"addr" env:"ADDR" flag:"addr" usage:"listen address"`
+//	}
+//
+// The defaults are documented by -h. After loading, a configuration that
+// implements Validator is validated.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFlag names the config file, and so does the <prefix>CONFIG variable
+const ConfigFlag = "config"
+
+type Validator interface {
+	Validate() error
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// flag.Value of a config field. Values are held until the file and the
+// environment are loaded, so that flags take precedence over both.
+type field struct {
+	v       reflect.Value
+	pending *pending
+}
+
+type pending struct {
+	set   bool
+	value string
+}
+
+func (f field) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	if f.v.Kind() == reflect.Slice {
+		return strings.Join(f.v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+func (f field) Set(s string) error {
+	// parse into a scratch value to report bad flags at once
+	if err := setField(reflect.New(f.v.Type()).Elem(), s); err != nil {
+		return err
+	}
+	*f.pending = pending{true, s}
+	return nil
+}
+
+func (f field) IsBoolFlag() bool {
+	return f.v.Kind() == reflect.Bool
+}
+
+func setField(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		items := make([]string, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// Load the configuration into cfg, a pointer to a struct holding the
+// defaults. name names the flag set, envPrefix is prepended to env tags
+// and args are the command line arguments without the program name.
+func Load(cfg any, name, envPrefix string, args []string) error {
+	rv := reflect.ValueOf(cfg)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, not %T", cfg)
+	}
+	rv = rv.Elem()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String(ConfigFlag, "", "YAML or TOML config file ($"+envPrefix+"CONFIG)")
+
+	type envField struct {
+		name string
+		v    reflect.Value
+	}
+	var fromEnv []envField
+	var fromFlags []field
+
+	for _, sf := range fields(rv) {
+		if env := sf.Tag.Get("env"); env != "" {
+			fromEnv = append(fromEnv, envField{envPrefix + env, rv.FieldByIndex(sf.Index)})
+		}
+
+		if name := sf.Tag.Get("flag"); name != "" {
+			f := field{rv.FieldByIndex(sf.Index), new(pending)}
+			usage := sf.Tag.Get("usage")
+			if env := sf.Tag.Get("env"); env != "" {
+				usage += " ($" + envPrefix + env + ")"
+			}
+			fs.Var(f, name, usage)
+			fromFlags = append(fromFlags, f)
+		}
+	}
+
+	// the flag set prints the usage on -h and parse errors
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %v:\n", name)
+		fs.SetOutput(os.Stderr)
+		fs.PrintDefaults()
+		fs.SetOutput(io.Discard)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *configFile == "" {
+		*configFile = os.Getenv(envPrefix + "CONFIG")
+	}
+	if *configFile != "" {
+		if err := loadFile(cfg, *configFile); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range fromEnv {
+		s, ok := os.LookupEnv(f.name)
+		if !ok {
+			continue
+		}
+		if err := setField(f.v, s); err != nil {
+			return fmt.Errorf("$%v: %w", f.name, err)
+		}
+	}
+
+	for _, f := range fromFlags {
+		if !f.pending.set {
+			continue
+		}
+		if err := setField(f.v, f.pending.value); err != nil {
+			return err
+		}
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Decode the YAML or TOML file into cfg, rejecting unknown keys. Maps set
+// by the file replace their defaults rather than being merged with them.
+func loadFile(cfg any, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var keys map[string]any
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err = yaml.Unmarshal(b, &keys); err == nil {
+			clearMaps(cfg, "yaml", keys)
+
+			dec := yaml.NewDecoder(bytes.NewReader(b))
+			dec.KnownFields(true)
+			err = dec.Decode(cfg)
+			if errors.Is(err, io.EOF) { // empty file
+				err = nil
+			}
+		}
+	case ".toml":
+		if _, err = toml.Decode(string(b), &keys); err == nil {
+			clearMaps(cfg, "toml", keys)
+
+			var md toml.MetaData
+			md, err = toml.Decode(string(b), cfg)
+			if err == nil && len(md.Undecoded()) > 0 {
+				err = fmt.Errorf("unknown key %v", md.Undecoded()[0])
+			}
+		}
+	default:
+		return fmt.Errorf("%v: config files must be .yaml, .yml or .toml", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	return nil
+}
+
+// Set the map fields of cfg named by keys, per their tag, to nil
+func clearMaps(cfg any, tag string, keys map[string]any) {
+	rv := reflect.ValueOf(cfg).Elem()
+
+	for _, sf := range fields(rv) {
+		key, _, _ := strings.Cut(sf.Tag.Get(tag), ",")
+		if _, ok := keys[key]; ok && key != "" && sf.Type.Kind() == reflect.Map {
+			v := rv.FieldByIndex(sf.Index)
+			v.Set(reflect.Zero(v.Type()))
+		}
+	}
+}
+
+// The fields of the struct v, with those of embedded structs in place of
+// the embedded fields. Indexes are relative to v.
+func fields(v reflect.Value) []reflect.StructField {
+	var fs []reflect.StructField
+
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		if !sf.Anonymous || sf.Type.Kind() != reflect.Struct {
+			fs = append(fs, sf)
+			continue
+		}
+
+		for _, inner := range fields(v.Field(i)) {
+			inner.Index = append([]int{i}, inner.Index...)
+			fs = append(fs, inner)
+		}
+	}
+
+	return fs
+}
+
+// MustLoad loads the configuration from the process's arguments, exiting
+// after printing the usage for -h, and with status 2 on any error.
+func MustLoad(cfg any, envPrefix string) {
+	err := Load(cfg, filepath.Base(os.Args[0]), envPrefix, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+// Validation helpers
+
+// Check that addr is a host:port listen address
+func CheckAddr(name, addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%v: %w", name, err)
+	}
+	return nil
+}
+
+// Check that u is an absolute http or https URL
+func CheckUrl(name, u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("%v: %w", name, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%v: %q is not an absolute http(s) URL", name, u)
+	}
+	return nil
+}
+
+// Check that none of the values are empty
+func CheckNotEmpty(values map[string]string) error {
+	for name, v := range values {
+		if v == "" {
+			return fmt.Errorf("%v must not be empty", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package config_test
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/config"
+)
+
+const prefix = "TEST_"
+
+type policy struct {
+	TTL time.Duration `yaml:"ttl" toml:"ttl"`
+}
+
+type testConfig struct {
+	Addr    string            `yaml:"addr" toml:"addr" env:"ADDR" flag:"addr" usage:"listen address"`
+	Name    string            `yaml:"name" toml:"name" env:"NAME" flag:"name"`
+	Debug   bool              `yaml:"debug" toml:"debug" env:"DEBUG" flag:"debug"`
+	Workers int               `yaml:"workers" toml:"workers" env:"WORKERS" flag:"workers"`
+	Timeout time.Duration     `yaml:"timeout" toml:"timeout" env:"TIMEOUT" flag:"timeout"`
+	Users   []string          `yaml:"users" toml:"users" env:"USERS" flag:"users"`
+	Nested  map[string]policy `yaml:"nested" toml:"nested"`
+}
+
+func defaults() testConfig {
+	return testConfig{
+		Addr:    "127.0.0.1:80",
+		Name:    "default",
+		Workers: 1,
+		Timeout: time.Second,
+		Nested:  map[string]policy{"default": {time.Minute}},
+	}
+}
+
+func (c *testConfig) Validate() error {
+	if c.Workers < 1 {
+		return errors.New("workers must be positive")
+	}
+	return config.CheckAddr("addr", c.Addr)
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	cfg := defaults()
+	if err := config.Load(&cfg, "test", prefix, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(cfg, defaults()) {
+		t.Fatalf("defaults changed: %+v", cfg)
+	}
+}
+
+func TestYamlFile(t *testing.T) {
+	path := writeFile(t, "cfg.yaml", `
+addr: 0.0.0.0:8000
+debug: true
+timeout: 5s
+users: [alice, bob]
+nested:
+  other:
+    ttl: 1h
+`)
+
+	cfg := defaults()
+	if err := config.Load(&cfg, "test", prefix, []string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaults()
+	want.Addr = "0.0.0.0:8000"
+	want.Debug = true
+	want.Timeout = 5 * time.Second
+	want.Users = []string{"alice", "bob"}
+	// maps from the file replace the default
+	want.Nested = map[string]policy{"other": {time.Hour}}
+
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("got %+v, want %+v", cfg, want)
+	}
+}
+
+func TestTomlFile(t *testing.T) {
+	path := writeFile(t, "cfg.toml", `
+name = "toml"
+workers = 4
+timeout = "2m"
+
+[nested.other]
+ttl = "10s"
+`)
+
+	// the file may also be named by the environment
+	t.Setenv(prefix+"CONFIG", path)
+
+	cfg := defaults()
+	if err := config.Load(&cfg, "test", prefix, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaults()
+	want.Name = "toml"
+	want.Workers = 4
+	want.Timeout = 2 * time.Minute
+	want.Nested = map[string]policy{"other": {10 * time.Second}}
+
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("got %+v, want %+v", cfg, want)
+	}
+}
+
+type shared struct {
+	Level    string            `yaml:"level" toml:"level" env:"LEVEL" flag:"level"`
+	Policies map[string]policy `yaml:"policies" toml:"policies"`
+}
+
+type embeddingConfig struct {
+	shared `yaml:",inline"`
+	Addr   string `yaml:"addr" toml:"addr" env:"ADDR" flag:"addr"`
+}
+
+func TestEmbedded(t *testing.T) {
+	for _, path := range []string{
+		writeFile(t, "cfg.yaml", "level: file\npolicies:\n  other: {ttl: 10s}\n"),
+		writeFile(t, "cfg.toml", "level = \"file\"\n[policies.other]\nttl = \"10s\"\n"),
+	} {
+		t.Setenv(prefix+"ADDR", "0.0.0.0:2")
+
+		cfg := embeddingConfig{shared: shared{Policies: map[string]policy{"default": {time.Minute}}}}
+		err := config.Load(&cfg, "test", prefix, []string{"-config", path, "-level", "flag"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := embeddingConfig{
+			shared: shared{Level: "flag", Policies: map[string]policy{"other": {10 * time.Second}}},
+			Addr:   "0.0.0.0:2",
+		}
+		if !reflect.DeepEqual(cfg, want) {
+			t.Fatalf("%v: got %+v, want %+v", filepath.Base(path), cfg, want)
+		}
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	for _, path := range []string{
+		writeFile(t, "cfg.yaml", "adress: 0.0.0.0:8000\n"),
+		writeFile(t, "cfg.toml", "adress = \"0.0.0.0:8000\"\n"),
+		writeFile(t, "cfg.json", "{}"),
+	} {
+		cfg := defaults()
+		if err := config.Load(&cfg, "test", prefix, []string{"-config", path}); err == nil {
+			t.Fatalf("%v loaded", filepath.Base(path))
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "cfg.yaml", "addr: 0.0.0.0:1\nname: file\nworkers: 2\n")
+
+	t.Setenv(prefix+"NAME", "env")
+	t.Setenv(prefix+"WORKERS", "3")
+	t.Setenv(prefix+"USERS", "alice, bob,")
+
+	cfg := defaults()
+	err := config.Load(&cfg, "test", prefix, []string{"-config", path, "-workers", "4", "-debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// file over defaults, env over file, flags over env
+	if cfg.Addr != "0.0.0.0:1" || cfg.Name != "env" || cfg.Workers != 4 || !cfg.Debug {
+		t.Fatalf("wrong precedence: %+v", cfg)
+	}
+
+	if !reflect.DeepEqual(cfg.Users, []string{"alice", "bob"}) {
+		t.Fatalf("wrong list: %q", cfg.Users)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"-workers", "many"},
+		{"-workers", "0"},
+		{"-addr", "nowhere"},
+		{"-unknown"},
+	} {
+		cfg := defaults()
+		if err := config.Load(&cfg, "test", prefix, args); err == nil {
+			t.Fatalf("%v accepted", args)
+		}
+	}
+
+	t.Setenv(prefix+"TIMEOUT", "soon")
+	cfg := defaults()
+	if err := config.Load(&cfg, "test", prefix, nil); err == nil {
+		t.Fatal("invalid environment variable accepted")
+	}
+}
+
+func TestHelp(t *testing.T) {
+	cfg := defaults()
+	if err := config.Load(&cfg, "test", prefix, []string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("expected ErrHelp, got %v", err)
+	}
+}
+
+func TestCheckUrl(t *testing.T) {
+	if err := config.CheckUrl("url", "https://example.com/auth"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []string{"example.com", "ftp://example.com", "/path", "http://"} {
+		if err := config.CheckUrl("url", u); err == nil {
+			t.Fatalf("%v accepted", u)
+		}
+	}
+}
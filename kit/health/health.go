@@ -0,0 +1,149 @@
+// Package health provides the liveness and readiness endpoints of the
+// gosqueak servers, for orchestrators deciding whether to restart a server
+// or to send it traffic.
+//
+// /healthz answers as long as the server can serve requests. /readyz runs
+// the dependency checks of the server, such as a database ping, and answers
+// 503 Service Unavailable when one fails. Both respond with JSON:
+//
+//	{"status": "unavailable", "checks": {"db": {"status": "ok"},
+//	 "auth_keys": {"status": "fail", "error": "keys are stale"}}}
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how long the checks of a readiness request may run
+const CheckTimeout = time.Second * 2
+
+// Statuses of the responses and of single checks
+const (
+	StatusOk          = "ok"
+	StatusFail        = "fail"
+	StatusUnavailable = "unavailable"
+)
+
+// A Check returns an error when the dependency it checks is not usable
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker holds the readiness checks of a server
+type Checker struct {
+	mu     sync.Mutex
+	checks []namedCheck
+}
+
+// Join returns a Checker running the checks that the checkers hold now,
+// for the readiness of servers sharing a listener. Check names must be
+// unique across the checkers.
+func Join(checkers ...*Checker) *Checker {
+	joined := &Checker{}
+	for _, c := range checkers {
+		c.mu.Lock()
+		joined.checks = append(joined.checks, c.checks...)
+		c.mu.Unlock()
+	}
+	return joined
+}
+
+// Add a check reported under name
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name, check})
+}
+
+type result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type report struct {
+	Status string            `json:"status"`
+	Checks map[string]result `json:"checks,omitempty"`
+}
+
+// run every check concurrently, returning whether all passed
+func (c *Checker) run(ctx context.Context) (bool, map[string]result) {
+	c.mu.Lock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+
+	results := make([]result, len(checks))
+
+	var wg sync.WaitGroup
+	for i, nc := range checks {
+		wg.Add(1)
+		go func(i int, nc namedCheck) {
+			defer wg.Done()
+			results[i] = runCheck(ctx, nc.check)
+		}(i, nc)
+	}
+	wg.Wait()
+
+	ok := true
+	byName := make(map[string]result, len(checks))
+	for i, nc := range checks {
+		byName[nc.name] = results[i]
+		ok = ok && results[i].Status == StatusOk
+	}
+
+	return ok, byName
+}
+
+// run check, failing it when it outlives ctx
+func runCheck(ctx context.Context, check Check) result {
+	errs := make(chan error, 1)
+	go func() { errs <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return result{StatusFail, err.Error()}
+	}
+	return result{Status: StatusOk}
+}
+
+// The /readyz handler
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ok, results := c.run(r.Context())
+
+	rep := report{Status: StatusOk, Checks: results}
+	status := http.StatusOK
+	if !ok {
+		rep.Status = StatusUnavailable
+		status = http.StatusServiceUnavailable
+	}
+
+	writeReport(w, status, rep)
+}
+
+// The /healthz handler
+func Live(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, report{Status: StatusOk})
+}
+
+func writeReport(w http.ResponseWriter, status int, rep report) {
+	w.Header().Set("Content-Type", "application/json")
+	// a cached answer is no answer
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rep)
+}
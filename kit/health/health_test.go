@@ -0,0 +1,78 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/health"
+)
+
+type report struct {
+	Status string
+	Checks map[string]struct{ Status, Error string }
+}
+
+func get(t *testing.T, handler http.Handler) (int, report) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	var rep report
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("not JSON: %q", rec.Body.String())
+	}
+	return rec.Code, rep
+}
+
+func TestReady(t *testing.T) {
+	ready := &health.Checker{}
+	ready.Add("db", func(context.Context) error { return nil })
+
+	if status, rep := get(t, ready); status != http.StatusOK || rep.Status != health.StatusOk || rep.Checks["db"].Status != health.StatusOk {
+		t.Fatalf("expected ready, got %v %+v", status, rep)
+	}
+
+	ready.Add("keys", func(context.Context) error { return errors.New("stale") })
+
+	status, rep := get(t, ready)
+	if status != http.StatusServiceUnavailable || rep.Status != health.StatusUnavailable {
+		t.Fatalf("expected unavailable, got %v %+v", status, rep)
+	}
+	if c := rep.Checks["keys"]; c.Status != health.StatusFail || c.Error != "stale" {
+		t.Fatalf("failed check not reported: %+v", rep)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	ready := &health.Checker{}
+	ready.Add("hung", func(context.Context) error {
+		time.Sleep(health.CheckTimeout * 2)
+		return nil
+	})
+
+	start := time.Now()
+	if status, _ := get(t, ready); status != http.StatusServiceUnavailable {
+		t.Fatalf("hung check passed: %v", status)
+	}
+	if time.Since(start) > health.CheckTimeout+time.Second {
+		t.Fatal("hung check not abandoned")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	a, b := &health.Checker{}, &health.Checker{}
+	a.Add("a", func(context.Context) error { return nil })
+	b.Add("b", func(context.Context) error { return nil })
+
+	if _, rep := get(t, health.Join(a, b)); len(rep.Checks) != 2 {
+		t.Fatalf("checks not joined: %+v", rep)
+	}
+
+	if status, rep := get(t, http.HandlerFunc(health.Live)); status != http.StatusOK || rep.Status != health.StatusOk {
+		t.Fatalf("not live: %v %+v", status, rep)
+	}
+}
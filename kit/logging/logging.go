@@ -0,0 +1,184 @@
+// Package logging provides the structured logs of the gosqueak servers: a
+// slog.Logger configured by name, and the request log middleware, which
+// tags every request with an id that is returned in the X-Request-Id
+// header.
+//
+// Request logs hold the method, path, status, duration, response size and
+// authenticated subject of a request, and its trace id when it is traced.
+// Headers, query strings and bodies are never logged, so tokens and
+// passwords stay out of the logs.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/response"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// header holding the id of a request, kept from the client when it is
+// valid so that requests can be correlated across services
+const RequestIdHeader = "X-Request-Id"
+
+// longest request id kept from a client
+const MaxRequestIdLength = 128
+
+// Formats of NewLogger
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+// NewLogger returns a logger writing to w in format, FormatText or
+// FormatJson, at level, one of debug, info, warn or error.
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log-level: %v", err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJson:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("log-format: must be %v or %v, not %q", FormatText, FormatJson, format)
+	}
+}
+
+type ctxKey int
+
+const requestKey ctxKey = 0
+
+// the logged state of a request, shared by the middleware below the
+// request log through the request context
+type request struct {
+	id string
+
+	mu      sync.Mutex
+	subject string
+}
+
+// The id of the request with ctx, or "" outside of Requests
+func RequestId(ctx context.Context) string {
+	if req, ok := ctx.Value(requestKey).(*request); ok {
+		return req.id
+	}
+	return ""
+}
+
+// Record the authenticated subject of the request with ctx, for its log.
+// Called by the auth middleware once a token is verified.
+func SetSubject(ctx context.Context, subject string) {
+	if req, ok := ctx.Value(requestKey).(*request); ok {
+		req.mu.Lock()
+		req.subject = subject
+		req.mu.Unlock()
+	}
+}
+
+// Logger returns logger with the request id of ctx, for logs written while
+// handling a request.
+func Logger(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	if id := RequestId(ctx); id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
+
+// Requests logs every request to next on logger once it is handled.
+func Requests(logger *slog.Logger, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		req := &request{id: r.Header.Get(RequestIdHeader)}
+		if !validRequestId(req.id) {
+			req.id = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, req.id)
+
+		rec := response.NewRecorder(w)
+		next(rec, r.WithContext(context.WithValue(r.Context(), requestKey, req)))
+
+		req.mu.Lock()
+		subject := req.subject
+		req.mu.Unlock()
+
+		status := rec.Status()
+
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		// the path only, query strings may hold tokens
+		attrs := []slog.Attr{
+			slog.String("request_id", req.id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int64("bytes", rec.Bytes()),
+			slog.String("subject", subject),
+			slog.String("remote", r.RemoteAddr),
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+		}
+		logger.LogAttrs(r.Context(), level, "request", attrs...)
+	}
+}
+
+// Transport returns base, or http.DefaultTransport when base is nil,
+// passing the id of the request being handled on in the X-Request-Id
+// header of the requests it sends, so that the logs of the services they
+// reach share it. Use with tracing.Transport.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return transport{base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := RequestId(req.Context())
+	if id == "" || req.Header.Get(RequestIdHeader) != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set(RequestIdHeader, id)
+	return t.base.RoundTrip(req)
+}
+
+// ids from clients are logged, so only plain ones are kept
+func validRequestId(id string) bool {
+	if id == "" || len(id) > MaxRequestIdLength {
+		return false
+	}
+	return strings.IndexFunc(id, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c))
+	}) == -1
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,143 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rebeljah/gosqueak/kit/logging"
+)
+
+// Serve one request through Requests, returning the response and the
+// decoded request log
+func serve(t *testing.T, req *http.Request, next http.HandlerFunc) (*http.Response, map[string]any) {
+	var buf bytes.Buffer
+	logger, err := logging.NewLogger(&buf, logging.FormatJson, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	logging.Requests(logger, next)(rec, req)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log is not one JSON entry: %q", buf.String())
+	}
+	return rec.Result(), entry
+}
+
+func TestRequestLog(t *testing.T) {
+	req := httptest.NewRequest("POST", "/login?token=secret-query", strings.NewReader(`{"password":"secret-body"}`))
+	req.Header.Set("Authorization", "Bearer secret-header")
+
+	var id string
+	resp, entry := serve(t, req, func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		id = logging.RequestId(r.Context())
+		logging.SetSubject(r.Context(), "uid")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+
+	if id == "" || resp.Header.Get(logging.RequestIdHeader) != id || entry["request_id"] != id {
+		t.Fatalf("request id %q not returned and logged: %v", id, entry)
+	}
+
+	if entry["status"] != float64(http.StatusCreated) || entry["bytes"] != float64(5) ||
+		entry["subject"] != "uid" || entry["path"] != "/login" || entry["method"] != "POST" {
+		t.Fatalf("unexpected log: %v", entry)
+	}
+	if _, ok := entry["duration"]; !ok {
+		t.Fatalf("duration missing: %v", entry)
+	}
+
+	b, _ := json.Marshal(entry)
+	if bytes.Contains(b, []byte("secret")) {
+		t.Fatalf("secret logged: %s", b)
+	}
+}
+
+func TestRequestIdFromClient(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(logging.RequestIdHeader, "upstream-id.1")
+
+	resp, entry := serve(t, req, func(w http.ResponseWriter, r *http.Request) {})
+	if resp.Header.Get(logging.RequestIdHeader) != "upstream-id.1" || entry["request_id"] != "upstream-id.1" {
+		t.Fatalf("client request id not kept: %v", entry)
+	}
+	if entry["status"] != float64(http.StatusOK) {
+		t.Fatalf("implicit status not logged: %v", entry)
+	}
+
+	for _, bad := range []string{"with space", "line\nbreak", strings.Repeat("a", logging.MaxRequestIdLength+1)} {
+		req.Header.Set(logging.RequestIdHeader, bad)
+
+		resp, _ := serve(t, req, func(w http.ResponseWriter, r *http.Request) {})
+		if id := resp.Header.Get(logging.RequestIdHeader); id == bad || id == "" {
+			t.Fatalf("request id %q not replaced", bad)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	// the service called while handling the request
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(logging.RequestIdHeader)
+	}))
+	defer upstream.Close()
+
+	client := &http.Client{Transport: logging.Transport(nil)}
+
+	var id string
+	serve(t, httptest.NewRequest("GET", "/", nil), func(w http.ResponseWriter, r *http.Request) {
+		id = logging.RequestId(r.Context())
+
+		req, err := http.NewRequestWithContext(r.Context(), "GET", upstream.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	})
+
+	if id == "" || received != id {
+		t.Fatalf("request id %q not passed on, got %q", id, received)
+	}
+
+	// requests sent outside of a request have no id
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if received != "" {
+		t.Fatalf("request id %q sent outside of a request", received)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	if _, err := logging.NewLogger(io.Discard, "xml", "info"); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+	if _, err := logging.NewLogger(io.Discard, logging.FormatText, "loud"); err == nil {
+		t.Fatal("unknown level accepted")
+	}
+
+	var buf bytes.Buffer
+	logger, _ := logging.NewLogger(&buf, logging.FormatText, "warn")
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Fatalf("level not applied: %q", buf.String())
+	}
+}
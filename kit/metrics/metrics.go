@@ -0,0 +1,64 @@
+// Package metrics provides the Prometheus metrics shared by the gosqueak
+// servers, HTTP request and database query latencies, and the /metrics
+// handler exposing them with the metrics of the services.
+//
+// Metrics are registered with the default Prometheus registry, so the
+// servers of one process are exposed together.
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// prefix of the metric names of every gosqueak server
+const Namespace = "gosqueak"
+
+var (
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of database queries by query name.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"query"})
+)
+
+// The /metrics handler, in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Route measures the requests to next, the handler of pattern, a mux
+// pattern such as "GET /messages". Requests are labeled by the path of the
+// pattern rather than of the URL, which would make a series per user.
+func Route(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	route := pattern
+	if i := strings.IndexByte(pattern, ' '); i != -1 {
+		route = strings.TrimSpace(pattern[i:])
+	}
+
+	observer := httpDuration.MustCurryWith(prometheus.Labels{"route": route})
+	return promhttp.InstrumentHandlerDuration(observer, next).ServeHTTP
+}
+
+// Time a database query, observed when the returned func is called:
+//
+//	defer metrics.TimeQuery("GetMessages")()
+func TimeQuery(name string) func() {
+	start := time.Now()
+	return func() {
+		queryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,45 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rebeljah/gosqueak/kit/metrics"
+)
+
+// The exposition of the default registry
+func scrape(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape failed: %v", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestRoute(t *testing.T) {
+	handler := metrics.Route("GET /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	for _, id := range []string{"1", "2"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/items/"+id, nil))
+	}
+
+	want := `gosqueak_http_request_duration_seconds_count{code="418",method="get",route="/items/{id}"} 2`
+	if body := scrape(t); !strings.Contains(body, want) {
+		t.Fatalf("%v missing from:\n%v", want, body)
+	}
+}
+
+func TestTimeQuery(t *testing.T) {
+	metrics.TimeQuery("TestQuery")()
+
+	want := `gosqueak_db_query_duration_seconds_count{query="TestQuery"} 1`
+	if body := scrape(t); !strings.Contains(body, want) {
+		t.Fatalf("%v missing from:\n%v", want, body)
+	}
+}
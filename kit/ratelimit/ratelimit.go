@@ -0,0 +1,244 @@
+// Package ratelimit limits how often clients call the routes of the
+// gosqueak servers, with a token bucket per client and route. Clients are
+// told by their IP address, and once authenticated, by the subject of
+// their token, so that no one can flood a server from many addresses.
+// Routes acting on another user are also limited per target, so that the
+// prekeys of a user can't be drained by many subjects.
+//
+// Requests over the limit are answered 429 Too Many Requests with a
+// Retry-After header. Buckets are kept by a Store, in memory by default,
+// or in a backend shared by the servers of a deployment.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rebeljah/gosqueak/kit/metrics"
+)
+
+// key of the limits of the routes without their own in Routes
+const DefaultRoute = "*"
+
+// how often MemoryStore drops the buckets that have filled up again
+const SweepInterval = time.Minute
+
+var limited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Name:      "rate_limited_total",
+	Help:      "Requests refused for going over the rate limit, by route and key.",
+}, []string{"route", "key"})
+
+// A token bucket: Burst requests at once, then one more every Every
+type Limit struct {
+	// the limit is off when zero
+	Burst int           `yaml:"burst" toml:"burst"`
+	Every time.Duration `yaml:"every" toml:"every"`
+}
+
+func (l Limit) enabled() bool {
+	return l.Burst > 0
+}
+
+// Limits of a route, per client IP and per token subject
+type RouteLimits struct {
+	Ip      Limit `yaml:"ip" toml:"ip"`
+	Subject Limit `yaml:"subject" toml:"subject"`
+	// per target of the requests, such as the user whose prekeys are
+	// taken, whoever sends them
+	Target Limit `yaml:"target" toml:"target"`
+}
+
+// Limits of the routes, keyed by mux pattern such as "POST /login", with
+// DefaultRoute for the routes without their own
+type Routes map[string]RouteLimits
+
+// The limits of the route of pattern
+func (r Routes) Route(pattern string) RouteLimits {
+	if limits, ok := r[pattern]; ok {
+		return limits
+	}
+	return r[DefaultRoute]
+}
+
+// Check that every limit refills. Errors name the routes by pattern.
+func (r Routes) Validate() error {
+	for pattern, limits := range r {
+		for _, l := range []Limit{limits.Ip, limits.Subject, limits.Target} {
+			if l.Burst < 0 || l.enabled() && l.Every <= 0 {
+				return fmt.Errorf("rate_limits: %v: burst must not be negative, and every must be positive", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Store keeps the buckets of the clients
+type Store interface {
+	// Take a request from the bucket of key, which has limit. Returns
+	// whether the request is allowed, and otherwise how long until it is.
+	Take(ctx context.Context, key string, limit Limit) (ok bool, retryAfter time.Duration, err error)
+}
+
+// MemoryStore is the Store of a single server
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// when the bucket is full again, and so can be dropped
+	full time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), swept: time.Now()}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) >= SweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+
+	// refill for the time since the last request
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+float64(now.Sub(b.last))/float64(limit.Every))
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(limit.Every)), nil
+	}
+
+	b.tokens--
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) * float64(limit.Every)))
+	return true, 0, nil
+}
+
+// drop the buckets that are full again, which are the same as new ones
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+	s.swept = now
+}
+
+// Limiter applies the limits of the routes with the buckets in its store
+type Limiter struct {
+	store  Store
+	routes Routes
+}
+
+func NewLimiter(store Store, routes Routes) *Limiter {
+	return &Limiter{store: store, routes: routes}
+}
+
+type ctxKey int
+
+const routeKey ctxKey = 0
+
+// the limited route of a request, for Subject and Target
+type route struct {
+	limiter *Limiter
+	pattern string
+	limits  RouteLimits
+}
+
+// Route limits the requests to next, the handler of pattern, by client
+// IP. The IP is that of the connection, so behind a proxy all clients
+// share the bucket of the proxy.
+func (l *Limiter) Route(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	limits := l.routes.Route(pattern)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limits.Ip.enabled() {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+
+			if !l.take(w, r, pattern, "ip", ip, limits.Ip) {
+				return
+			}
+		}
+
+		if limits.Subject.enabled() || limits.Target.enabled() {
+			r = r.WithContext(context.WithValue(r.Context(), routeKey, route{l, pattern, limits}))
+		}
+		next(w, r)
+	}
+}
+
+// Subject takes a request of the authenticated subject from its bucket on
+// the route of r. Called by the auth middleware once a token is verified,
+// it responds 429 and returns false when the subject is over the limit.
+func Subject(w http.ResponseWriter, r *http.Request, subject string) bool {
+	rt, ok := r.Context().Value(routeKey).(route)
+	if !ok || !rt.limits.Subject.enabled() {
+		return true
+	}
+	return rt.limiter.take(w, r, rt.pattern, "subject", subject, rt.limits.Subject)
+}
+
+// Target takes a request on target, such as the user whose prekeys are
+// taken, from its bucket on the route of r. Called by the handler once the
+// target is known, it responds 429 and returns false when the target is
+// over the limit.
+func Target(w http.ResponseWriter, r *http.Request, target string) bool {
+	rt, ok := r.Context().Value(routeKey).(route)
+	if !ok || !rt.limits.Target.enabled() {
+		return true
+	}
+	return rt.limiter.take(w, r, rt.pattern, "target", target, rt.limits.Target)
+}
+
+// Take a request from the bucket of the client on the route, answering 429
+// when there is none. Requests are let through when the store fails, so
+// that an outage of a shared store doesn't take the servers down with it.
+func (l *Limiter) take(w http.ResponseWriter, r *http.Request, pattern, kind, client string, limit Limit) bool {
+	key := strings.Join([]string{kind, pattern, client}, "|")
+
+	ok, retryAfter, err := l.store.Take(r.Context(), key, limit)
+	if err != nil {
+		slog.Error("could not check rate limit", "route", pattern, "err", err)
+		return true
+	}
+	if ok {
+		return true
+	}
+
+	path := pattern
+	if i := strings.IndexByte(pattern, ' '); i != -1 {
+		path = strings.TrimSpace(pattern[i:])
+	}
+	limited.WithLabelValues(path, kind).Inc()
+
+	// whole seconds, rounded up so that the retry is allowed
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+	return false
+}
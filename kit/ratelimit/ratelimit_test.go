@@ -0,0 +1,164 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	limit := ratelimit.Limit{Burst: 2, Every: time.Millisecond * 50}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if ok, _, err := store.Take(ctx, "key", limit); !ok || err != nil {
+			t.Fatalf("request %d of the burst refused: %v", i, err)
+		}
+	}
+
+	ok, retryAfter, err := store.Take(ctx, "key", limit)
+	if ok || err != nil {
+		t.Fatalf("request over the burst allowed: %v", err)
+	}
+	if retryAfter <= 0 || retryAfter > limit.Every {
+		t.Fatalf("retry after %v, want at most %v", retryAfter, limit.Every)
+	}
+
+	// other keys have their own bucket
+	if ok, _, _ := store.Take(ctx, "other", limit); !ok {
+		t.Fatal("request with another key refused")
+	}
+
+	time.Sleep(retryAfter)
+	if ok, _, _ := store.Take(ctx, "key", limit); !ok {
+		t.Fatal("request refused after the bucket refilled")
+	}
+}
+
+// the status of a request to handler from remoteAddr
+func status(handler http.HandlerFunc, remoteAddr string) (int, http.Header) {
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code, w.Header()
+}
+
+func TestRoute(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Routes{
+		ratelimit.DefaultRoute: {Ip: ratelimit.Limit{Burst: 2, Every: time.Hour}},
+		"POST /login":          {Ip: ratelimit.Limit{Burst: 1, Every: time.Hour}},
+	})
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	login := limiter.Route("POST /login", ok)
+	if code, _ := status(login, "192.0.2.1:1000"); code != http.StatusOK {
+		t.Fatalf("first request got %d", code)
+	}
+
+	// the port is not part of the client
+	code, header := status(login, "192.0.2.1:2000")
+	if code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit got %d", code)
+	}
+	if header.Get("Retry-After") != "3600" {
+		t.Fatalf("Retry-After %q, want 3600", header.Get("Retry-After"))
+	}
+
+	if code, _ := status(login, "192.0.2.2:1000"); code != http.StatusOK {
+		t.Fatalf("request of another client got %d", code)
+	}
+
+	// other routes have the default limits, and their own buckets
+	register := limiter.Route("POST /register", ok)
+	for i := 0; i < 2; i++ {
+		if code, _ := status(register, "192.0.2.1:1000"); code != http.StatusOK {
+			t.Fatalf("request %d to the default route got %d", i, code)
+		}
+	}
+	if code, _ := status(register, "192.0.2.1:1000"); code != http.StatusTooManyRequests {
+		t.Fatalf("request over the default limit got %d", code)
+	}
+}
+
+func TestSubject(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Routes{
+		"GET /prekeys": {Subject: ratelimit.Limit{Burst: 1, Every: time.Hour}},
+	})
+
+	// the subject is checked by the handler, as the auth middleware does
+	var subject string
+	handler := limiter.Route("GET /prekeys", func(w http.ResponseWriter, r *http.Request) {
+		ratelimit.Subject(w, r, subject)
+	})
+
+	for _, c := range []struct {
+		subject string
+		code    int
+	}{
+		{"uid1", http.StatusOK},
+		{"uid1", http.StatusTooManyRequests},
+		{"uid2", http.StatusOK},
+	} {
+		subject = c.subject
+		if code, _ := status(handler, "192.0.2.1:1000"); code != c.code {
+			t.Fatalf("request of %v got %d, want %d", c.subject, code, c.code)
+		}
+	}
+
+	// routes without subject limits let every subject through
+	w := httptest.NewRecorder()
+	if !ratelimit.Subject(w, httptest.NewRequest(http.MethodGet, "/", nil), "uid1") {
+		t.Fatal("subject limited outside of a limited route")
+	}
+}
+
+func TestTarget(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Routes{
+		"GET /prekeys": {Target: ratelimit.Limit{Burst: 1, Every: time.Hour}},
+	})
+
+	var subject, target string
+	handler := limiter.Route("GET /prekeys", func(w http.ResponseWriter, r *http.Request) {
+		if ratelimit.Subject(w, r, subject) {
+			ratelimit.Target(w, r, target)
+		}
+	})
+
+	for _, c := range []struct {
+		subject, target string
+		code            int
+	}{
+		{"uid1", "uid3", http.StatusOK},
+		// the route has no subject limit, the target is limited whoever asks
+		{"uid2", "uid3", http.StatusTooManyRequests},
+		{"uid1", "uid4", http.StatusOK},
+	} {
+		subject, target = c.subject, c.target
+		if code, _ := status(handler, "192.0.2.1:1000"); code != c.code {
+			t.Fatalf("request of %v for %v got %d, want %d", c.subject, c.target, code, c.code)
+		}
+	}
+}
+
+func TestRoutesValidate(t *testing.T) {
+	for _, routes := range []ratelimit.Routes{
+		{"POST /login": {Ip: ratelimit.Limit{Burst: 1}}},
+		{"POST /login": {Subject: ratelimit.Limit{Burst: -1, Every: time.Second}}},
+		{"GET /prekeys": {Target: ratelimit.Limit{Burst: 1}}},
+	} {
+		if err := routes.Validate(); err == nil {
+			t.Fatalf("invalid limits accepted: %v", routes)
+		}
+	}
+
+	routes := ratelimit.Routes{"POST /login": {Ip: ratelimit.Limit{Burst: 5, Every: time.Minute}}}
+	if err := routes.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+// Package response records the responses of the gosqueak servers, for the
+// middleware that logs, traces or measures them.
+package response
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// Recorder records the status and size of the response written through
+// it, passing on the optional interfaces of the ResponseWriter it wraps
+type Recorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w}
+}
+
+// The status of the response, http.StatusOK when the handler wrote none
+func (rec *Recorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// The size of the response body
+func (rec *Recorder) Bytes() int64 {
+	return rec.bytes
+}
+
+func (rec *Recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *Recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *Recorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack for the relay socket, which is recorded as switching protocols.
+// Returns http.ErrNotSupported for HTTP/2 connections.
+func (rec *Recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	conn, rw, err := h.Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// For http.ResponseController
+func (rec *Recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,31 @@
+package response_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rebeljah/gosqueak/kit/response"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := response.NewRecorder(httptest.NewRecorder())
+	if rec.Status() != http.StatusOK {
+		t.Fatalf("implicit status not OK: %v", rec.Status())
+	}
+
+	rec.WriteHeader(http.StatusCreated)
+	rec.WriteHeader(http.StatusInternalServerError)
+	rec.Write([]byte("hello"))
+	rec.Write([]byte(" world"))
+
+	if rec.Status() != http.StatusCreated || rec.Bytes() != 11 {
+		t.Fatalf("expected 201 and 11 bytes, got %v and %v", rec.Status(), rec.Bytes())
+	}
+
+	// httptest.ResponseRecorder can't be hijacked, like HTTP/2 responses
+	if _, _, err := rec.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Fatalf("expected http.ErrNotSupported, got %v", err)
+	}
+}
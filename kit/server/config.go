@@ -0,0 +1,78 @@
+package server
+
+import (
+	"io"
+
+	"github.com/rebeljah/gosqueak/kit/certs"
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/kit/tracing"
+)
+
+// Config holds the settings shared by the gosqueak binaries, embedded in
+// their configurations, see config.Load. See DefaultConfig for the
+// defaults.
+type Config struct {
+	// HTTPS, with certificates reloaded when the files change. A
+	// self-signed certificate is written to TlsCert and TlsKey if they
+	// don't exist, or else kept in memory.
+	TlsCert       string `yaml:"tls_cert" toml:"tls_cert" env:"TLS_CERT" flag:"tls-cert" usage:"PEM certificate file, enables HTTPS"`
+	TlsKey        string `yaml:"tls_key" toml:"tls_key" env:"TLS_KEY" flag:"tls-key" usage:"PEM private key file of the certificate"`
+	TlsSelfSigned bool   `yaml:"tls_self_signed" toml:"tls_self_signed" env:"TLS_SELF_SIGNED" flag:"tls-self-signed" usage:"serve HTTPS with a self-signed certificate, for development"`
+	// mutual TLS with the clients presenting a certificate, such as other
+	// services
+	TlsClientCa          string `yaml:"tls_client_ca" toml:"tls_client_ca" env:"TLS_CLIENT_CA" flag:"tls-client-ca" usage:"CA file verifying client certificates"`
+	TlsRequireClientCert bool   `yaml:"tls_require_client_cert" toml:"tls_require_client_cert" env:"TLS_REQUIRE_CLIENT_CERT" flag:"tls-require-client-cert" usage:"reject clients without a certificate"`
+	// request and server logs, written to stderr
+	LogFormat string `yaml:"log_format" toml:"log_format" env:"LOG_FORMAT" flag:"log-format" usage:"log format, text or json"`
+	LogLevel  string `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL" flag:"log-level" usage:"lowest level logged: debug, info, warn or error"`
+	// spans of the requests, database queries and relay deliveries
+	TraceExporter string `yaml:"trace_exporter" toml:"trace_exporter" env:"TRACE_EXPORTER" flag:"trace-exporter" usage:"span exporter: none, otlp or stdout"`
+	TraceEndpoint string `yaml:"trace_endpoint" toml:"trace_endpoint" env:"TRACE_ENDPOINT" flag:"trace-endpoint" usage:"OTLP/HTTP traces URL, instead of OTEL_EXPORTER_OTLP_ENDPOINT or localhost"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		LogFormat:     logging.FormatText,
+		LogLevel:      "info",
+		TraceExporter: tracing.ExporterNone,
+	}
+}
+
+func (c *Config) Validate() error {
+	if _, err := logging.NewLogger(io.Discard, c.LogFormat, c.LogLevel); err != nil {
+		return err
+	}
+
+	if err := c.TraceOptions("").Validate(); err != nil {
+		return err
+	}
+
+	return c.TlsOptions().Validate()
+}
+
+// The TLS options of a server listening on addrs, whose hosts a
+// self-signed certificate is made for
+func (c *Config) TlsOptions(addrs ...string) certs.ServerOptions {
+	var hosts []string
+	for _, addr := range addrs {
+		hosts = append(hosts, certs.Hosts(addr)...)
+	}
+
+	return certs.ServerOptions{
+		CertFile:          c.TlsCert,
+		KeyFile:           c.TlsKey,
+		SelfSigned:        c.TlsSelfSigned,
+		Hosts:             hosts,
+		ClientCaFile:      c.TlsClientCa,
+		RequireClientCert: c.TlsRequireClientCert,
+	}
+}
+
+// The tracing options of service
+func (c *Config) TraceOptions(service string) tracing.Options {
+	return tracing.Options{
+		Service:  service,
+		Exporter: c.TraceExporter,
+		Endpoint: c.TraceEndpoint,
+	}
+}
@@ -0,0 +1,175 @@
+// Package server is the HTTP plumbing shared by the gosqueak servers: the
+// middleware every route goes through, serving over HTTP or HTTPS, and the
+// graceful shutdown on SIGINT or SIGTERM.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/kit/metrics"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/tracing"
+)
+
+// how long Run waits for requests to finish on shutdown
+const ShutdownTimeout = time.Second * 30
+
+// Server serves the routes of a service on its address
+type Server struct {
+	httpServer *http.Server
+	limiter    *ratelimit.Limiter
+	onShutdown []func(context.Context) error
+	http1Only  bool
+}
+
+// New returns a Server serving handler on addr
+func New(addr string, handler http.Handler) *Server {
+	return &Server{httpServer: &http.Server{Addr: addr, Handler: handler}}
+}
+
+// Handle registers handler for pattern on mux. Every route is traced,
+// logged, measured and rate limited, in that order, so that the spans and
+// logs cover the requests refused by the limiter.
+func (s *Server) Handle(mux *http.ServeMux, pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	h := s.rateLimit(pattern, handler)
+	h = metrics.Route(pattern, h)
+	h = logging.Requests(slog.Default(), h)
+	mux.HandleFunc(pattern, tracing.Route(pattern, h))
+}
+
+// Limit the requests to the routes with l. Must be called before the
+// server is started; without a limiter, requests are not limited.
+func (s *Server) UseRateLimits(l *ratelimit.Limiter) {
+	s.limiter = l
+}
+
+// Rate limit the requests to handler by client IP, see
+// ratelimit.Limiter.Route. Subjects are limited by the auth middleware of
+// the services, see ratelimit.Subject.
+func (s *Server) rateLimit(pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil {
+			handler(w, r)
+			return
+		}
+		s.limiter.Route(pattern, handler)(w, r)
+	}
+}
+
+// Serve HTTPS with cfg, which provides the certificates, instead of HTTP.
+// Must be called before the server is started.
+func (s *Server) UseTLS(cfg *tls.Config) {
+	s.httpServer.TLSConfig = cfg
+	s.offerHTTP1Only()
+}
+
+// Serve HTTP/1.1 only. Over TLS, clients otherwise negotiate HTTP/2, whose
+// connections can't be hijacked, such as for the relay socket. Must be
+// called before the server is started.
+func (s *Server) DisableHTTP2() {
+	s.http1Only = true
+	// without TLSNextProto set, the server configures HTTP/2 on start
+	s.httpServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	s.offerHTTP1Only()
+}
+
+// Offer only HTTP/1.1 in the TLS handshake, on a copy of the TLS config,
+// which servers offering HTTP/2 may share and add h2 to when they start
+func (s *Server) offerHTTP1Only() {
+	if !s.http1Only || s.httpServer.TLSConfig == nil {
+		return
+	}
+
+	cfg := s.httpServer.TLSConfig.Clone()
+	cfg.NextProtos = []string{"http/1.1"}
+	s.httpServer.TLSConfig = cfg
+}
+
+// Call f on Shutdown, once the requests being served are done. Functions
+// are called in the order they were added.
+func (s *Server) OnShutdown(f func(context.Context) error) {
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// Serve on the address of the server until it is shut down
+func (s *Server) ListenAndServe() error {
+	var err error
+	if s.httpServer.TLSConfig != nil {
+		err = s.httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = s.httpServer.ListenAndServe()
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits for the requests being
+// served, then calls the functions added with OnShutdown. Returns the
+// first error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+
+	for _, f := range s.onShutdown {
+		if fErr := f(ctx); err == nil {
+			err = fErr
+		}
+	}
+
+	return err
+}
+
+// Serve until SIGINT or SIGTERM, then shut down gracefully
+func (s *Server) Run() {
+	Run([]func() error{s.ListenAndServe}, []func(context.Context) error{s.Shutdown})
+}
+
+// Run the serve functions until one fails or SIGINT or SIGTERM is
+// received, then call the shutdown functions in order, within
+// ShutdownTimeout. Exits the process when serving or shutting down fails.
+func Run(serve []func() error, shutdown []func(context.Context) error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, len(serve))
+	for _, f := range serve {
+		go func() { errs <- f() }()
+	}
+
+	select {
+	case err := <-errs:
+		slog.Error("serving failed", "err", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	// a second signal kills the process
+	stop()
+	slog.Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	failed := false
+	for _, f := range shutdown {
+		if err := f(ctx); err != nil {
+			slog.Error("shutting down failed", "err", err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
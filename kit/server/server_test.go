@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/server"
+)
+
+func TestHandle(t *testing.T) {
+	mux := http.NewServeMux()
+	s := server.New("", mux)
+	s.Handle(mux, "GET /ping", func(w http.ResponseWriter, r *http.Request) {})
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+		return w.Code
+	}
+
+	// the limiter is looked up per request, so it can be set after Handle
+	for i := 0; i < 3; i++ {
+		if code := get(); code != http.StatusOK {
+			t.Fatalf("unlimited request refused: %v", code)
+		}
+	}
+
+	s.UseRateLimits(ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Routes{
+		"GET /ping": {Ip: ratelimit.Limit{Burst: 1, Every: time.Hour}},
+	}))
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("request of the burst refused: %v", code)
+	}
+	if code := get(); code != http.StatusTooManyRequests {
+		t.Fatalf("request over the burst allowed: %v", code)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := server.New("127.0.0.1:0", http.NewServeMux())
+
+	var calls []int
+	for i := 0; i < 2; i++ {
+		s.OnShutdown(func(context.Context) error {
+			calls = append(calls, i)
+			return nil
+		})
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.ListenAndServe() }()
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("closing the server is not an error: %v", err)
+	}
+
+	if len(calls) != 2 || calls[0] != 0 || calls[1] != 1 {
+		t.Fatalf("shutdown functions not called in order: %v", calls)
+	}
+}
@@ -0,0 +1,240 @@
+// Package tracing provides the OpenTelemetry traces of the gosqueak
+// servers: the exporter setup, server spans for the routes, client spans
+// for requests to other services, and spans for database queries.
+//
+// Trace context is propagated in the W3C traceparent and tracestate
+// headers, so a request to the message server that makes it ask the auth
+// server about a token is one trace. Spans are exported to an OTLP/HTTP
+// collector or written to stdout; with no exporter, incoming trace context
+// is still passed on to the services called.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rebeljah/gosqueak/kit/metrics"
+	"github.com/rebeljah/gosqueak/kit/response"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters of Setup
+const (
+	ExporterNone   = "none"
+	ExporterOtlp   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// instrumentation scope of the spans of every gosqueak server
+const ScopeName = "github.com/rebeljah/gosqueak"
+
+// Tracing settings of a server
+type Options struct {
+	// service.name of the spans
+	Service  string
+	Exporter string
+	// OTLP/HTTP traces URL, such as http://localhost:4318/v1/traces. When
+	// empty the OTEL_EXPORTER_OTLP_ENDPOINT environment variable, or else
+	// a collector on localhost, is used.
+	Endpoint string
+}
+
+// Check the options. Errors name the options by their usual flags.
+func (o Options) Validate() error {
+	switch o.Exporter {
+	case ExporterNone, ExporterOtlp, ExporterStdout:
+	default:
+		return fmt.Errorf(
+			"trace-exporter: must be %v, %v or %v, not %q",
+			ExporterNone, ExporterOtlp, ExporterStdout, o.Exporter,
+		)
+	}
+
+	if o.Endpoint != "" && o.Exporter != ExporterOtlp {
+		return fmt.Errorf("trace-endpoint needs the %v trace-exporter", ExporterOtlp)
+	}
+	return nil
+}
+
+// Setup installs the global tracer provider exporting the spans of the
+// process as configured by o, and the W3C trace context propagator. The
+// returned func flushes the spans not exported yet and stops the exporter.
+func Setup(ctx context.Context, o Options) (func(context.Context) error, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch o.Exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOtlp:
+		var opts []otlptracehttp.Option
+		if o.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(o.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL, semconv.ServiceName(o.Service),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// The tracer of the gosqueak spans, from the global tracer provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(ScopeName)
+}
+
+// Start a span named name, a child of the span of ctx if it has one
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// End span, marking it failed with err when err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject the trace context of ctx into carrier, such as the headers of a
+// request or the fields of a socket message
+func Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+}
+
+// Extract the trace context in carrier, returning ctx with it as the
+// remote parent of the spans started with it
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// Route traces the requests to next, the handler of pattern, a mux
+// pattern such as "GET /messages", in server spans named by the pattern.
+// The trace context of the request headers is the parent of the spans.
+//
+// The span of a request whose connection is hijacked lasts as long as the
+// handler, such as for the life of a relay socket.
+func Route(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	route := pattern
+	if i := strings.IndexByte(pattern, ' '); i != -1 {
+		route = strings.TrimSpace(pattern[i:])
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Start(ctx, pattern,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+			),
+		)
+		defer span.End()
+
+		rec := response.NewRecorder(w)
+		next(rec, r.WithContext(ctx))
+
+		status := rec.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// Transport returns base, or http.DefaultTransport when base is nil,
+// tracing the requests it sends in client spans and passing their trace
+// context on in the request headers.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return transport{base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := Start(req.Context(), req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.ServerAddress(req.URL.Hostname()),
+		),
+	)
+	defer span.End()
+
+	// a RoundTripper must not modify the request
+	req = req.Clone(ctx)
+	Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
+
+// Trace and time a database query in a child span of ctx, ended and
+// observed when the returned func is called:
+//
+//	ctx, done := tracing.Query(ctx, "GetMessages")
+//	defer done()
+func Query(ctx context.Context, name string) (context.Context, func()) {
+	timed := metrics.TimeQuery(name)
+	ctx, span := Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemSqlite, semconv.DBOperationName(name)),
+	)
+
+	return ctx, func() {
+		span.End()
+		timed()
+	}
+}
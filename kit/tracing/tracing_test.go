@@ -0,0 +1,133 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rebeljah/gosqueak/kit/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// a remote parent, as sent by a client
+const (
+	parentTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpan  = "00f067aa0ba902b7"
+	traceparent = "00-" + parentTrace + "-" + parentSpan + "-01"
+)
+
+var spans = tracetest.NewInMemoryExporter()
+
+func TestMain(m *testing.M) {
+	if _, err := tracing.Setup(context.Background(), tracing.Options{Exporter: tracing.ExporterNone}); err != nil {
+		panic(err)
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+
+	m.Run()
+}
+
+// the spans ended since the last call
+func ended() tracetest.SpanStubs {
+	s := spans.GetSpans()
+	spans.Reset()
+	return s
+}
+
+func TestRoute(t *testing.T) {
+	var queryParent trace.SpanContext
+	handler := tracing.Route("GET /messages", func(w http.ResponseWriter, r *http.Request) {
+		ctx, done := tracing.Query(r.Context(), "GetMessages")
+		queryParent = trace.SpanContextFromContext(ctx)
+		done()
+
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/messages?uid=someone", nil)
+	r.Header.Set("traceparent", traceparent)
+	handler(httptest.NewRecorder(), r)
+
+	s := ended()
+	if len(s) != 2 {
+		t.Fatalf("want a query and a server span, got %d spans", len(s))
+	}
+	query, server := s[0], s[1]
+
+	if server.Name != "GET /messages" || server.SpanKind != trace.SpanKindServer {
+		t.Fatalf("wrong server span: %q %v", server.Name, server.SpanKind)
+	}
+	if server.Parent.TraceID().String() != parentTrace || server.Parent.SpanID().String() != parentSpan {
+		t.Fatalf("server span not a child of the traceparent: %v", server.Parent)
+	}
+	if server.Status.Code != codes.Error {
+		t.Fatalf("500 response not an error: %v", server.Status)
+	}
+
+	if query.Name != "GetMessages" || query.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Fatalf("query span not a child of the server span: %q %v", query.Name, query.Parent)
+	}
+	if queryParent.SpanID() != query.SpanContext.SpanID() {
+		t.Fatal("query context does not hold the query span")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	headers := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	ctx, parent := tracing.Start(context.Background(), "parent")
+	client := &http.Client{Transport: tracing.Transport(nil)}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	parent.End()
+
+	if req.Header.Get("traceparent") != "" {
+		t.Fatal("request of the caller modified")
+	}
+
+	s := ended()
+	if len(s) != 2 {
+		t.Fatalf("want a client and a parent span, got %d spans", len(s))
+	}
+	clientSpan := s[0]
+
+	if clientSpan.SpanKind != trace.SpanKindClient || clientSpan.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Fatalf("client span not a child of the parent: %v %v", clientSpan.SpanKind, clientSpan.Parent)
+	}
+
+	want := "00-" + clientSpan.SpanContext.TraceID().String() + "-" + clientSpan.SpanContext.SpanID().String() + "-01"
+	if got := <-headers; got != want {
+		t.Fatalf("traceparent %q, want %q", got, want)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	for _, o := range []tracing.Options{
+		{Exporter: ""},
+		{Exporter: "jaeger"},
+		{Exporter: tracing.ExporterStdout, Endpoint: "http://localhost:4318/v1/traces"},
+	} {
+		if err := o.Validate(); err == nil {
+			t.Fatalf("invalid options accepted: %+v", o)
+		}
+	}
+
+	o := tracing.Options{Exporter: tracing.ExporterOtlp, Endpoint: "http://localhost:4318/v1/traces"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
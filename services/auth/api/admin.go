@@ -0,0 +1,232 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/services/auth/database"
+)
+
+const (
+	// page size of user listings and login histories
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+type errorAccountDisabled struct{ Username string }
+
+func (e errorAccountDisabled) Error() string {
+	return fmt.Sprintf("account disabled: %s", e.Username)
+}
+
+var ErrAccountDisabled errorAccountDisabled
+
+// Role auth middleware for handlers behind AuthRefreshToken. The roles are
+// looked up rather than read from the token, so that taking a role from a
+// user takes effect at once.
+func RequireRole(s *Server, role string, handler HandlerFunction) HandlerFunction {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := jwt.FromString(jwt.BearerToken(r))
+
+		roles, err := database.UserRoles(r.Context(), s.db, token.Body.Subject)
+		if err != nil {
+			errInternal(w)
+			return
+		}
+
+		for _, granted := range roles {
+			if granted == role {
+				handler(w, r)
+				return
+			}
+		}
+
+		http.Error(w, "missing role: "+role, http.StatusForbidden)
+	}
+}
+
+// GET ?username=<username>: respond with the roles of the user.
+//
+// PUT ?username=<username>&role=<role>: give the user the role.
+//
+// DELETE ?username=<username>&role=<role>: take the role from the user.
+//
+// Responds with {"username": <username>, "roles": [<role>, ...]}.
+func (s *Server) handleAdminRoles(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	role := r.URL.Query().Get("role")
+	uid := database.GetUidFor(username)
+
+	if username == "" || (r.Method != http.MethodGet && role == "") {
+		errBadRequest(w)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		err = database.GrantRole(r.Context(), s.db, uid, role)
+	case http.MethodDelete:
+		err = database.RevokeRole(r.Context(), s.db, uid, role)
+	}
+
+	if err != nil {
+		if errors.As(err, &database.ErrNoSuchUser) {
+			http.Error(w, "no such username: "+username, http.StatusNotFound)
+			return
+		}
+		errInternal(w)
+		return
+	}
+
+	roles, err := database.UserRoles(r.Context(), s.db, uid)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(struct {
+		Username string   `json:"username"`
+		Roles    []string `json:"roles"`
+	}{username, roles})
+	if err != nil {
+		errInternal(w)
+	}
+}
+
+// GET ?q=<query>&limit=<n>&offset=<n>: list the users whose username
+// contains the query or whose uid starts with it, ordered by username.
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	limit, ok := listLimit(r)
+	offset := 0
+	if o := r.URL.Query().Get("offset"); o != "" {
+		n, err := strconv.Atoi(o)
+		ok, offset = ok && err == nil && n >= 0, n
+	}
+
+	if !ok {
+		errBadRequest(w)
+		return
+	}
+
+	accounts, err := database.ListUsers(r.Context(), s.db, r.URL.Query().Get("q"), limit, offset)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	writeJson(w, accounts)
+}
+
+// POST ?username=<username>: disable the account, blocking /login and /jwt
+// and discarding its refresh token.
+func (s *Server) handleAdminDisable(w http.ResponseWriter, r *http.Request) {
+	s.adminUserAction(w, r, func(uid string) error {
+		return database.SetUserDisabled(r.Context(), s.db, uid, true)
+	})
+}
+
+// POST ?username=<username>: re-enable a disabled account.
+func (s *Server) handleAdminEnable(w http.ResponseWriter, r *http.Request) {
+	s.adminUserAction(w, r, func(uid string) error {
+		return database.SetUserDisabled(r.Context(), s.db, uid, false)
+	})
+}
+
+// POST ?username=<username>: discard the refresh token of the user, so that
+// no access tokens are minted for them until they log in again.
+func (s *Server) handleAdminLogout(w http.ResponseWriter, r *http.Request) {
+	s.adminUserAction(w, r, func(uid string) error {
+		return database.SetRefreshToken(r.Context(), s.db, "", uid)
+	})
+}
+
+// POST ?username=<username> {"password": <password>}: replace the password
+// of the user, logging them out.
+func (s *Server) handleAdminPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Password == "" {
+		errBadRequest(w)
+		return
+	}
+
+	s.adminUserAction(w, r, func(uid string) error {
+		return database.ResetPassword(r.Context(), s.db, uid, body.Password)
+	})
+}
+
+// GET ?username=<username>&limit=<n>: the most recent password login
+// attempts of the user, newest first.
+func (s *Server) handleAdminLogins(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	limit, ok := listLimit(r)
+
+	if username == "" || !ok {
+		errBadRequest(w)
+		return
+	}
+
+	logins, err := database.LoginHistory(r.Context(), s.db, database.GetUidFor(username), limit)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	writeJson(w, logins)
+}
+
+// POST ?username=<username>: run the action for the uid of the user,
+// responding with 404 if there is no such user.
+func (s *Server) adminUserAction(w http.ResponseWriter, r *http.Request, action func(uid string) error) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		errBadRequest(w)
+		return
+	}
+
+	uid := database.GetUidFor(username)
+
+	ok, err := database.UserExists(r.Context(), s.db, uid)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+	if !ok {
+		http.Error(w, "no such username: "+username, http.StatusNotFound)
+		return
+	}
+
+	if err := action(uid); err != nil {
+		errInternal(w)
+	}
+}
+
+// the limit query param, DefaultListLimit when absent
+func listLimit(r *http.Request) (int, bool) {
+	if r.URL.Query().Get("limit") == "" {
+		return DefaultListLimit, true
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	return limit, err == nil && limit > 0 && limit <= MaxListLimit
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		errInternal(w)
+	}
+}
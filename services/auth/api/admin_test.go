@@ -0,0 +1,168 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/services/auth/database"
+)
+
+func adminRequest(method, query, rft string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, "/admin/roles?"+query, nil)
+	request.Header.Set("Authorization", rft)
+	serv.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAdminRoles(t *testing.T) {
+	database.RegisterUser(context.Background(), db, "adminuser", "adminpassword")
+	database.RegisterUser(context.Background(), db, "moderated", "password")
+
+	adminUid := database.GetUidFor("adminuser")
+	rft := iss.MustStringifyJwt(iss.MintRefreshToken(adminUid, time.Minute))
+	database.SetRefreshToken(context.Background(), db, rft, adminUid)
+
+	if rec := adminRequest("PUT", "username=moderated&role=mod", rft); rec.Code != http.StatusForbidden {
+		t.Fatalf("non admin managed roles: %v", rec.Code)
+	}
+
+	database.GrantRole(context.Background(), db, adminUid, jwt.RoleAdmin)
+
+	rec := adminRequest("PUT", "username=moderated&role=mod", rft)
+	var body struct{ Roles []string }
+	json.Unmarshal(rec.Body.Bytes(), &body)
+
+	if rec.Code != http.StatusOK || len(body.Roles) != 1 || body.Roles[0] != "mod" {
+		t.Fatalf("role not granted: %v %v", rec.Code, body.Roles)
+	}
+
+	if rec := adminRequest("DELETE", "username=moderated&role=mod", rft); rec.Code != http.StatusOK {
+		t.Fatalf("role not revoked: %v", rec.Code)
+	}
+
+	if rec := adminRequest("PUT", "username=nobody&role=mod", rft); rec.Code != http.StatusNotFound {
+		t.Fatalf("role granted to unknown user: %v", rec.Code)
+	}
+}
+
+func TestAccessTokenCarriesRoles(t *testing.T) {
+	database.RegisterUser(context.Background(), db, "roleuser", "password")
+	uid := database.GetUidFor("roleuser")
+	database.GrantRole(context.Background(), db, uid, jwt.RoleAdmin)
+
+	rft := iss.MustStringifyJwt(iss.MintRefreshToken(uid, time.Minute))
+	database.SetRefreshToken(context.Background(), db, rft, uid)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/jwt?aud=service", nil)
+	request.Header.Set("Authorization", rft)
+	serv.ServeHTTP(recorder, request)
+
+	token, err := jwt.FromString(recorder.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !token.Body.HasRole(jwt.RoleAdmin) {
+		t.Fatalf("roles missing from token: %v", token.Body.Roles)
+	}
+
+	// no requested scopes grants all of the audience's scopes
+	if !token.Body.HasScope("read") || !token.Body.HasScope("write") {
+		t.Fatalf("default scopes not granted: %q", token.Body.Scope)
+	}
+}
+
+func TestAdminUserManagement(t *testing.T) {
+	database.RegisterUser(context.Background(), db, "boss", "bosspassword")
+	database.RegisterUser(context.Background(), db, "managed", "password")
+
+	bossUid := database.GetUidFor("boss")
+	database.GrantRole(context.Background(), db, bossUid, jwt.RoleAdmin)
+	boss := iss.MustStringifyJwt(iss.MintRefreshToken(bossUid, time.Minute))
+	database.SetRefreshToken(context.Background(), db, boss, bossUid)
+
+	admin := func(method, path string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("Authorization", boss)
+		serv.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	login := func(password string) int {
+		recorder := httptest.NewRecorder()
+		body := `{"username": "managed", "password": "` + password + `"}`
+		serv.ServeHTTP(recorder, httptest.NewRequest("POST", "/login", strings.NewReader(body)))
+		return recorder.Code
+	}
+
+	if code := login("password"); code != http.StatusOK {
+		t.Fatalf("login failed: %v", code)
+	}
+
+	var users []database.Account
+	json.Unmarshal(admin("GET", "/admin/users?q=manag", "").Body.Bytes(), &users)
+	if len(users) != 1 || users[0].Username != "managed" {
+		t.Fatalf("user not listed: %v", users)
+	}
+
+	// disabled users can't log in
+	if rec := admin("POST", "/admin/users/disable?username=managed", ""); rec.Code != http.StatusOK {
+		t.Fatalf("disable: %v", rec.Code)
+	}
+	if code := login("password"); code != http.StatusForbidden {
+		t.Fatalf("disabled user logged in: %v", code)
+	}
+
+	admin("POST", "/admin/users/enable?username=managed", "")
+	if code := login("password"); code != http.StatusOK {
+		t.Fatalf("enabled user can't log in: %v", code)
+	}
+
+	// force logout discards the refresh token
+	admin("POST", "/admin/users/logout?username=managed", "")
+	uid := database.GetUidFor("managed")
+	if rft, _ := database.UserHasRefreshToken(context.Background(), db, uid, ""); !rft {
+		t.Fatal("refresh token kept after forced logout")
+	}
+
+	admin("POST", "/admin/users/password?username=managed", `{"password": "reset"}`)
+	if code := login("reset"); code != http.StatusOK {
+		t.Fatalf("reset password rejected: %v", code)
+	}
+
+	var logins []database.Login
+	json.Unmarshal(admin("GET", "/admin/users/logins?username=managed", "").Body.Bytes(), &logins)
+	if len(logins) != 4 || !logins[0].Success || logins[2].Success {
+		t.Fatalf("bad login history: %v", logins)
+	}
+
+	if rec := admin("POST", "/admin/users/disable?username=nobody", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("disabled unknown user: %v", rec.Code)
+	}
+}
+
+func TestDisabledUserCantMakeJwt(t *testing.T) {
+	database.RegisterUser(context.Background(), db, "disabledjwt", "password")
+	uid := database.GetUidFor("disabledjwt")
+	rft := iss.MustStringifyJwt(iss.MintRefreshToken(uid, time.Minute))
+	database.SetRefreshToken(context.Background(), db, rft, uid)
+	database.SetUserDisabled(context.Background(), db, uid, true)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/jwt?aud=service", nil)
+	request.Header.Set("Authorization", rft)
+	serv.ServeHTTP(recorder, request)
+
+	if recorder.Code == http.StatusOK {
+		t.Fatal("disabled user minted a token")
+	}
+}
@@ -1,21 +1,39 @@
 package api
 
 import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/kit/health"
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/kit/metrics"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/server"
+	"github.com/rebeljah/gosqueak/kit/tracing"
 	"github.com/rebeljah/gosqueak/services/auth/database"
 )
 
 const (
 	RefreshTokenTTL = time.Hour * 24 * 7
 	JwtTTL          = time.Second * 5
+	JwksMaxAge      = time.Minute * 5
+)
+
+// RFC 7009 token type hints, also used as the token_type of introspection
+const (
+	TokenTypeRefresh = "refresh_token"
+	TokenTypeAccess  = "access_token"
 )
 
 type HandlerFunction func(http.ResponseWriter, *http.Request)
@@ -34,38 +52,131 @@ func errBadRequest(w http.ResponseWriter) {
 }
 
 type Server struct {
+	*server.Server
 	db          *sql.DB
-	addr        string
 	jwtIssuer   jwt.Issuer
 	jwtAudience jwt.Audience
+	audiences   Audiences
+	mux         *http.ServeMux
+	ready       *health.Checker
+	publicUrl   string
 }
 
-func NewServer(addr string, db *sql.DB, iss jwt.Issuer, aud jwt.Audience) *Server {
-	return &Server{db, addr, iss, aud}
+func NewServer(addr string, db *sql.DB, iss jwt.Issuer, aud jwt.Audience, audiences Audiences) *Server {
+	s := &Server{
+		db:          db,
+		jwtIssuer:   iss,
+		jwtAudience: aud,
+		audiences:   audiences,
+		mux:         http.NewServeMux(),
+	}
+	s.Server = server.New(addr, s.mux)
+	s.OnShutdown(func(context.Context) error { return db.Close() })
+	s.Mount(s.mux)
+
+	s.ready = &health.Checker{}
+	s.ready.Add("users_db", db.PingContext)
+	s.ready.Add("signing_key", func(context.Context) error { return iss.CheckKey() })
+
+	s.mux.Handle("GET /metrics", metrics.Handler())
+	s.mux.HandleFunc("GET /healthz", health.Live)
+	s.mux.Handle("GET /readyz", s.ready)
+	return s
 }
 
-func (s *Server) ConfigureRoutes() {
-	http.HandleFunc("/jwtkeypub", Log(s.handleGetJwtPublicKey))
-	http.HandleFunc("/register", Log(s.handleRegisterUser))
-	http.HandleFunc("/logout", Log(AuthRefreshToken(s, s.handleLogout)))
-	http.HandleFunc("/login", Log(s.handlePasswordLogin))
-	http.HandleFunc("/jwt", Log(AuthRefreshToken(s, s.HandleMakeJwt)))
+// Mount registers the routes of the server on mux. The routes of the auth
+// and message servers don't overlap, so both can be mounted on one mux.
+//
+// The /metrics, /healthz and /readyz endpoints are not routes of the
+// server, so that a mux shared with the message server has only one each.
+func (s *Server) Mount(mux *http.ServeMux) {
+	admin := func(handler HandlerFunction) HandlerFunction {
+		return AuthRefreshToken(s, RequireRole(s, jwt.RoleAdmin, handler))
+	}
+
+	s.Handle(mux, "GET /jwtkeypub", s.handleGetJwtPublicKey)
+	s.Handle(mux, "GET /.well-known/jwks.json", s.handleGetJwks)
+	s.Handle(mux, "POST /register", s.handleRegisterUser)
+	s.Handle(mux, "GET /logout", AuthRefreshToken(s, s.handleLogout))
+	s.Handle(mux, "POST /logout", AuthRefreshToken(s, s.handleLogout))
+	s.Handle(mux, "POST /login", s.handlePasswordLogin)
+	s.Handle(mux, "GET /jwt", AuthRefreshToken(s, s.HandleMakeJwt))
+	s.Handle(mux, "POST /introspect", AuthServiceToken(s, s.handleIntrospect))
+	s.Handle(mux, "POST /revoke", AuthClient(s, s.handleRevoke))
+	s.Handle(mux, "GET /revoked", AuthServiceToken(s, s.handleRevoked))
+	s.Handle(mux, "POST /token", s.handleToken)
+	s.Handle(mux, "GET /.well-known/openid-configuration", s.handleDiscovery)
+	s.Handle(mux, "GET /.well-known/oauth-authorization-server", s.handleDiscovery)
+	s.Handle(mux, "GET /admin/roles", admin(s.handleAdminRoles))
+	s.Handle(mux, "PUT /admin/roles", admin(s.handleAdminRoles))
+	s.Handle(mux, "DELETE /admin/roles", admin(s.handleAdminRoles))
+	s.Handle(mux, "GET /admin/users", admin(s.handleAdminUsers))
+	s.Handle(mux, "POST /admin/users/disable", admin(s.handleAdminDisable))
+	s.Handle(mux, "POST /admin/users/enable", admin(s.handleAdminEnable))
+	s.Handle(mux, "POST /admin/users/logout", admin(s.handleAdminLogout))
+	s.Handle(mux, "POST /admin/users/password", admin(s.handleAdminPassword))
+	s.Handle(mux, "GET /admin/users/logins", admin(s.handleAdminLogins))
 }
 
-func (s *Server) Run() {
-	s.ConfigureRoutes()
-	// start serving
-	log.Fatal(http.ListenAndServe(s.addr, nil))
+// The readiness checks served on /readyz
+func (s *Server) Ready() *health.Checker {
+	return s.ready
 }
 
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Publish the discovery metadata with endpoints under url, the URL clients
+// reach the server at, which must also be the issuer name as discovery
+// requires. Must be called before the server is started.
+func (s *Server) UsePublicUrl(url string) {
+	s.publicUrl = url
+}
+
+// Responds with the PKCS#1 DER encoded issuer key, only available when the
+// issuer signs with an RSA key.
 func (s *Server) handleGetJwtPublicKey(w http.ResponseWriter, r *http.Request) {
-	_, err := w.Write(x509.MarshalPKCS1PublicKey(s.jwtIssuer.PublicKey()))
+	pub, ok := s.jwtIssuer.PublicKey().(*rsa.PublicKey)
+	if !ok {
+		http.Error(w, "issuer key is not an RSA key", http.StatusNotFound)
+		return
+	}
+
+	_, err := w.Write(x509.MarshalPKCS1PublicKey(pub))
 	if err != nil {
 		errInternal(w)
 		return
 	}
 }
 
+// Responds with the JWK set of the issuer's active and retiring public keys.
+// The set is cacheable for JwksMaxAge and revalidated with its ETag.
+func (s *Server) handleGetJwks(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(s.jwtIssuer.KeySet())
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(JwksMaxAge.Seconds())))
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	_, err = w.Write(body)
+	if err != nil {
+		errInternal(w)
+	}
+}
+
 func (s *Server) handleRegisterUser(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Username string `json:"username"`
@@ -78,7 +189,7 @@ func (s *Server) handleRegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = database.RegisterUser(s.db, body.Username, body.Password)
+	err = database.RegisterUser(r.Context(), s.db, body.Username, body.Password)
 	if err != nil {
 		if errors.As(err, &database.ErrUserExists) {
 			http.Error(w, err.Error(), http.StatusConflict)
@@ -101,12 +212,16 @@ func (s *Server) handlePasswordLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ok, err := database.VerifyPassword(s.db, body.Username, body.Password)
+	ok, err := s.verifyLogin(r.Context(), body.Username, body.Password, r.RemoteAddr)
 	if err != nil {
 		if errors.As(err, &database.ErrNoSuchUser) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
+		if errors.As(err, &ErrAccountDisabled) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		errInternal(w)
 		return
 	}
@@ -116,14 +231,15 @@ func (s *Server) handlePasswordLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	uid := database.GetUidFor(body.Username)
+	logging.SetSubject(r.Context(), uid)
+
 	// Set a new refresh token
-	rfToken := s.jwtIssuer.MintToken(
-		database.GetUidFor(body.Username),
-		s.jwtIssuer.Name,
-		RefreshTokenTTL,
-	)
-	rft := s.jwtIssuer.StringifyJwt(rfToken)
-	database.SetRefreshToken(s.db, rft, rfToken.Body.Subject)
+	rft, err := s.newRefreshToken(r.Context(), uid)
+	if err != nil {
+		errInternal(w)
+		return
+	}
 
 	// write refresh token back as response
 	_, err = w.Write([]byte(rft))
@@ -133,8 +249,56 @@ func (s *Server) handlePasswordLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Verify the password of the user and record the attempt in the login
+// history. Disabled users get ErrAccountDisabled, even with the right
+// password.
+func (s *Server) verifyLogin(ctx context.Context, username, password, remoteAddr string) (bool, error) {
+	ok, err := database.VerifyPassword(ctx, s.db, username, password)
+	if err != nil {
+		if errors.As(err, &database.ErrNoSuchUser) {
+			logins.WithLabelValues(LoginFailure).Inc()
+		}
+		return false, err
+	}
+
+	uid := database.GetUidFor(username)
+
+	disabled, err := database.UserIsDisabled(ctx, s.db, uid)
+	if err != nil {
+		return false, err
+	}
+
+	err = database.RecordLogin(ctx, s.db, uid, ok && !disabled, remoteAddr)
+	if err != nil {
+		return false, err
+	}
+
+	if ok && disabled {
+		logins.WithLabelValues(LoginFailure).Inc()
+		return false, errorAccountDisabled{username}
+	}
+
+	if ok {
+		logins.WithLabelValues(LoginSuccess).Inc()
+	} else {
+		logins.WithLabelValues(LoginFailure).Inc()
+	}
+
+	return ok, nil
+}
+
+// Mint a refresh token for the user, replacing their previous one
+func (s *Server) newRefreshToken(ctx context.Context, uid string) (string, error) {
+	rft, err := s.jwtIssuer.StringifyJwt(s.jwtIssuer.MintRefreshToken(uid, RefreshTokenTTL))
+	if err != nil {
+		return "", err
+	}
+	tokensMinted.WithLabelValues(MintedRefresh).Inc()
+	return rft, database.SetRefreshToken(ctx, s.db, rft, uid)
+}
+
 func (s *Server) HandleMakeJwt(w http.ResponseWriter, r *http.Request) {
-	rfToken, _ := jwt.FromString(r.Header.Get("Authorization"))
+	rfToken, _ := jwt.FromString(jwt.BearerToken(r))
 
 	// requested audience
 	aud := r.URL.Query().Get("aud")
@@ -143,14 +307,212 @@ func (s *Server) HandleMakeJwt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	j := s.jwtIssuer.MintToken(rfToken.Body.Subject, aud, JwtTTL)
+	roles, err := database.UserRoles(r.Context(), s.db, rfToken.Body.Subject)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	// requested scopes, space separated
+	scopes := strings.Fields(r.URL.Query().Get("scope"))
+
+	j, err := s.mintAccessToken(rfToken.Body.Subject, aud, scopes, roles)
+	if err != nil {
+		if errors.As(err, &ErrUnknownAudience) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+		return
+	}
+
+	signed, err := s.jwtIssuer.StringifyJwt(j)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	w.Write([]byte(signed))
+}
+
+// Mint an access token for aud following the audience policy, carrying the
+// roles of the subject. The issuer's own name is reserved for refresh tokens.
+func (s *Server) mintAccessToken(sub, aud string, scopes, roles []string) (jwt.Jwt, error) {
+	policy, err := s.audiences.Policy(aud, s.jwtIssuer.Name)
+	if err != nil {
+		return jwt.Jwt{}, err
+	}
+
+	scopes, err = policy.GrantScopes(aud, scopes)
+	if err != nil {
+		return jwt.Jwt{}, err
+	}
+
+	j := s.jwtIssuer.MintToken(sub, aud, policy.Lifetime())
+	tokensMinted.WithLabelValues(MintedAccess).Inc()
+	j.Body.Scope = strings.Join(scopes, " ")
+	j.Body.Roles = roles
+	return j, nil
+}
+
+// RFC 7662 introspection response
+type introspection struct {
+	Active     bool             `json:"active"`
+	TokenType  string           `json:"token_type,omitempty"`
+	Subject    string           `json:"sub,omitempty"`
+	Audience   jwt.ClaimStrings `json:"aud,omitempty"`
+	Issuer     string           `json:"iss,omitempty"`
+	Expiration int64            `json:"exp,omitempty"`
+	JwtId      string           `json:"jti,omitempty"`
+}
+
+// POST form token=<jwt>: respond with whether the token is active, and its
+// claims if it is. Inactive tokens get {"active": false} and nothing else.
+func (s *Server) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	tokenString := r.PostFormValue("token")
+	if tokenString == "" {
+		errBadRequest(w)
+		return
+	}
+
+	token, active, err := s.tokenIsActive(r.Context(), tokenString)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	body := introspection{Active: active}
+	if active {
+		body = introspection{
+			Active:     true,
+			TokenType:  s.tokenType(token),
+			Subject:    token.Body.Subject,
+			Audience:   token.Body.Audience,
+			Issuer:     token.Body.Issuer,
+			Expiration: token.ExpiresAt().Unix(),
+			JwtId:      token.Body.JwtId,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		errInternal(w)
+	}
+}
+
+// POST form token=<jwt>: RFC 7009 revocation. The token id is denied until
+// the token expires. Clients may only revoke the tokens issued to them;
+// unknown and invalid tokens are answered with 200 like revoked ones.
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	tokenString := r.PostFormValue("token")
+	if tokenString == "" {
+		errBadRequest(w)
+		return
+	}
+
+	token, err := jwt.FromString(tokenString)
+	if err != nil || !s.issuedHere(token) {
+		return
+	}
+
+	if token.Body.Subject != ClientSubject(authenticatedClient(r.Context())) {
+		errOAuth(w, http.StatusBadRequest, "unauthorized_client", "the token was not issued to the client")
+		return
+	}
+
+	err = database.RevokeToken(r.Context(), s.db, token.Body.JwtId, token.ExpiresAt())
+	if err != nil {
+		errInternal(w)
+	}
+}
+
+// GET ?jti=<jti>: the deny-list, consulted by audiences before high risk
+// operations. Responds with {"jti": <jti>, "revoked": <bool>}, and the
+// "exp" of the token when it is revoked, after which it is dropped.
+func (s *Server) handleRevoked(w http.ResponseWriter, r *http.Request) {
+	jti := r.URL.Query().Get("jti")
+	if jti == "" {
+		errBadRequest(w)
+		return
+	}
+
+	exp, revoked, err := database.TokenRevokedUntil(r.Context(), s.db, jti)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 
-	w.Write([]byte(s.jwtIssuer.StringifyJwt(j)))
+	body := struct {
+		JwtId      string          `json:"jti"`
+		Revoked    bool            `json:"revoked"`
+		Expiration jwt.NumericDate `json:"exp,omitempty"`
+	}{JwtId: jti, Revoked: revoked}
+	if revoked {
+		body.Expiration = jwt.NumericDate(exp.Unix())
+	}
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		errInternal(w)
+	}
+}
+
+// true IFF the token was signed by this server's issuer
+func (s *Server) issuedHere(token jwt.Jwt) bool {
+	return token.Body.Issuer == s.jwtIssuer.Name &&
+		jwt.SignatureIsValid(s.jwtIssuer.KeySet(), token)
+}
+
+// The type of the token named by its typ header, "" when it is neither
+// an access nor a refresh token
+func (s *Server) tokenType(token jwt.Jwt) string {
+	switch {
+	case token.Header.TypeIs(jwt.TypRefresh) && token.Body.Audience.Contains(s.jwtIssuer.Name):
+		return TokenTypeRefresh
+	case token.Header.TypeIs(jwt.TypAccess) && !token.Body.Audience.Contains(s.jwtIssuer.Name):
+		return TokenTypeAccess
+	// service tokens for the issuer's own endpoints
+	case token.Header.TypeIs(jwt.TypAccess) && strings.HasPrefix(token.Body.Subject, ClientSubjectPrefix):
+		return TokenTypeAccess
+	}
+	return ""
+}
+
+// A token is active when it was issued here, has not expired, is not on the
+// deny-list and, for refresh tokens, is still held by its user.
+func (s *Server) tokenIsActive(ctx context.Context, tokenString string) (jwt.Jwt, bool, error) {
+	token, err := jwt.FromString(tokenString)
+	if err != nil || !s.issuedHere(token) || token.Expired() || s.tokenType(token) == "" {
+		return token, false, nil
+	}
+
+	revoked, err := database.TokenIsRevoked(ctx, s.db, token.Body.JwtId)
+	if err != nil || revoked {
+		return token, false, err
+	}
+
+	if s.tokenType(token) == TokenTypeRefresh {
+		disabled, err := database.UserIsDisabled(ctx, s.db, token.Body.Subject)
+		if err != nil || disabled {
+			return token, false, err
+		}
+
+		ok, err := database.UserHasRefreshToken(ctx, s.db, token.Body.Subject, tokenString)
+		return token, ok, err
+	}
+
+	return token, true, nil
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 	// idempotent token delete
-	err := database.DiscardRefreshToken(s.db, r.Header.Get("Authorization"))
+	err := database.DiscardRefreshToken(r.Context(), s.db, jwt.BearerToken(r))
 	if err != nil {
 		errInternal(w)
 	}
@@ -161,7 +523,11 @@ func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 // the token exists in the database (not revoked) and belongs to the user.
 func AuthRefreshToken(s *Server, handler HandlerFunction) HandlerFunction {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
+		ctx, span := tracing.Start(r.Context(), "AuthRefreshToken")
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		tokenString := jwt.BearerToken(r)
 		token, err := jwt.FromString(tokenString)
 		if err != nil {
 			errStatusUnauthorized(w)
@@ -176,13 +542,23 @@ func AuthRefreshToken(s *Server, handler HandlerFunction) HandlerFunction {
 
 		// delete rft from DB and return 401 if the refresh token expired
 		if token.Expired() {
-			database.DiscardRefreshToken(s.db, tokenString)
+			database.DiscardRefreshToken(r.Context(), s.db, tokenString)
 			errStatusUnauthorized(w)
 			return
 		}
 
 		// make sure that token hasn't been revoked
-		ok, err := database.UserHasRefreshToken(s.db, token.Body.Subject, tokenString)
+		revoked, err := database.TokenIsRevoked(r.Context(), s.db, token.Body.JwtId)
+		if err != nil {
+			errInternal(w)
+			return
+		}
+		if revoked {
+			errStatusUnauthorized(w)
+			return
+		}
+
+		ok, err := database.UserHasRefreshToken(r.Context(), s.db, token.Body.Subject, tokenString)
 		if err != nil {
 			errInternal(w)
 			return
@@ -192,14 +568,21 @@ func AuthRefreshToken(s *Server, handler HandlerFunction) HandlerFunction {
 			return
 		}
 
-		// Token verified, run next handler
-		handler(w, r)
-	}
-}
+		disabled, err := database.UserIsDisabled(r.Context(), s.db, token.Body.Subject)
+		if err != nil {
+			errInternal(w)
+			return
+		}
+		if disabled {
+			http.Error(w, "account disabled", http.StatusForbidden)
+			return
+		}
 
-func Log(handler HandlerFunction) HandlerFunction {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[%v] - %v\n", r.Method, r.URL.String())
+		// Token verified, run next handler
+		logging.SetSubject(r.Context(), token.Body.Subject)
+		if !ratelimit.Subject(w, r, token.Body.Subject) {
+			return
+		}
 		handler(w, r)
 	}
 }
@@ -1,18 +1,26 @@
 package api_test
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"database/sql"
+	"encoding/json"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/rs256"
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
 	"github.com/rebeljah/gosqueak/services/auth/api"
 	"github.com/rebeljah/gosqueak/services/auth/database"
 )
@@ -27,7 +35,7 @@ func TestHandleGetJwtPublicKey(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	request := httptest.NewRequest("GET", "/jwtkeypub", nil)
 
-	http.DefaultServeMux.ServeHTTP(recorder, request)
+	serv.ServeHTTP(recorder, request)
 
 	_, err := x509.ParsePKCS1PublicKey(recorder.Body.Bytes())
 	if err != nil {
@@ -35,14 +43,50 @@ func TestHandleGetJwtPublicKey(t *testing.T) {
 	}
 }
 
+func TestHandleGetJwks(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+
+	serv.ServeHTTP(recorder, request)
+
+	var keys jwt.Jwks
+	err := json.Unmarshal(recorder.Body.Bytes(), &keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := keys.Verifier(iss.KeyId()); !ok {
+		t.Fatal("issuer key missing from jwks")
+	}
+}
+
+func TestHandleGetJwksNotModified(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	serv.ServeHTTP(recorder, request)
+
+	etag := recorder.Result().Header.Get("ETag")
+	if etag == "" || recorder.Result().Header.Get("Cache-Control") == "" {
+		t.Fatal("jwks response is missing cache headers")
+	}
+
+	recorder = httptest.NewRecorder()
+	request.Header.Set("If-None-Match", etag)
+	serv.ServeHTTP(recorder, request)
+
+	if recorder.Result().StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304, got %v", recorder.Result().StatusCode)
+	}
+}
+
 func TestHandleRegisterUser(t *testing.T) {
 	rec := httptest.NewRecorder()
 	body := `{"username": "testusername", "password": "testpassword"}`
 	req := httptest.NewRequest("POST", "/register", strings.NewReader(body))
 
-	http.DefaultServeMux.ServeHTTP(rec, req)
+	serv.ServeHTTP(rec, req)
 
-	ok, err := database.UserExists(db, database.GetUidFor("testusername"))
+	ok, err := database.UserExists(context.Background(), db, database.GetUidFor("testusername"))
 	if err != nil {
 		t.Error(err)
 	}
@@ -57,7 +101,7 @@ func TestHandlePasswordLogin(t *testing.T) {
 	body := `{"username": "testusername", "password": "testpassword"}`
 	request := httptest.NewRequest("POST", "/login", strings.NewReader(body))
 
-	http.DefaultServeMux.ServeHTTP(recorder, request)
+	serv.ServeHTTP(recorder, request)
 
 	refreshToken, err := jwt.FromString(recorder.Body.String())
 	if err != nil {
@@ -69,18 +113,43 @@ func TestHandlePasswordLogin(t *testing.T) {
 	}
 }
 
+func TestLoginLog(t *testing.T) {
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer func() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	}()
+
+	recorder := httptest.NewRecorder()
+	body := `{"username": "testusername", "password": "testpassword"}`
+	request := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+
+	serv.ServeHTTP(recorder, request)
+
+	id := recorder.Result().Header.Get(logging.RequestIdHeader)
+	if id == "" || !strings.Contains(buf.String(), id) {
+		t.Fatalf("request id missing: %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), database.GetUidFor("testusername")) {
+		t.Fatalf("subject missing: %q", buf.String())
+	}
+	if strings.Contains(buf.String(), "testpassword") {
+		t.Fatalf("password logged: %q", buf.String())
+	}
+}
+
 func TestHandleMakeJwt(t *testing.T) {
 	uid := database.GetUidFor("testusername")
-	refreshToken := iss.MintToken(uid, "TEST", time.Second)
-	rftString := iss.StringifyJwt(refreshToken)
+	refreshToken := iss.MintRefreshToken(uid, time.Second)
+	rftString := iss.MustStringifyJwt(refreshToken)
 
-	database.SetRefreshToken(db, rftString, uid)
+	database.SetRefreshToken(context.Background(), db, rftString, uid)
 
 	recorder := httptest.NewRecorder()
 	request := httptest.NewRequest("GET", "/jwt?aud=service", nil)
-	request.Header.Set("Authorization", rftString)
+	request.Header.Set("Authorization", "Bearer "+rftString)
 
-	http.DefaultServeMux.ServeHTTP(recorder, request)
+	serv.ServeHTTP(recorder, request)
 
 	if recorder.Result().StatusCode != 200 {
 		t.FailNow()
@@ -92,25 +161,258 @@ func TestHandleMakeJwt(t *testing.T) {
 	}
 }
 
+func TestHandleMakeJwtAudiencePolicy(t *testing.T) {
+	uid := database.GetUidFor("testusername")
+	rftString := iss.MustStringifyJwt(iss.MintRefreshToken(uid, time.Minute))
+	database.SetRefreshToken(context.Background(), db, rftString, uid)
+
+	cases := []struct {
+		query  string
+		status int
+	}{
+		{"aud=service&scope=read+write", http.StatusOK},
+		{"aud=service&scope=admin", http.StatusForbidden},
+		{"aud=disabled", http.StatusForbidden},
+		{"aud=unknown", http.StatusBadRequest},
+		// reserved for refresh tokens
+		{"aud=TEST", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/jwt?"+c.query, nil)
+		request.Header.Set("Authorization", rftString)
+		serv.ServeHTTP(recorder, request)
+
+		if recorder.Result().StatusCode != c.status {
+			t.Fatalf("%v: expected %v, got %v", c.query, c.status, recorder.Result().StatusCode)
+		}
+
+		if c.status != http.StatusOK {
+			continue
+		}
+
+		token, err := jwt.FromString(recorder.Body.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !token.Body.HasScope("read") || !token.Body.HasScope("write") {
+			t.Fatalf("requested scopes not granted: %q", token.Body.Scope)
+		}
+
+		if ttl := time.Until(token.ExpiresAt()); ttl < 50*time.Second || ttl > time.Minute {
+			t.Fatalf("audience TTL not applied: %v", ttl)
+		}
+	}
+}
+
+func TestAccessTokenCantMakeJwt(t *testing.T) {
+	uid := database.GetUidFor("testusername")
+	// an access token for the issuer itself, as minted before token types
+	accessString := iss.MustStringifyJwt(iss.MintToken(uid, "TEST", time.Minute))
+	database.SetRefreshToken(context.Background(), db, accessString, uid)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/jwt?aud=service", nil)
+	request.Header.Set("Authorization", accessString)
+	serv.ServeHTTP(recorder, request)
+
+	if recorder.Result().StatusCode != http.StatusUnauthorized {
+		t.Fatalf("access token used as refresh token: %v", recorder.Result().StatusCode)
+	}
+
+	if introspect(t, accessString).Active {
+		t.Fatal("access token for the issuer is active")
+	}
+}
+
 func TestHandleLogout(t *testing.T) {
-	refreshToken := iss.MintToken("testuid", "TEST", time.Second)
+	refreshToken := iss.MintRefreshToken("testuid", time.Second)
 
 	recorder := httptest.NewRecorder()
 	request := httptest.NewRequest("GET", "/logout", nil)
-	request.Header.Set("Authorization", iss.StringifyJwt(refreshToken))
+	request.Header.Set("Authorization", iss.MustStringifyJwt(refreshToken))
 
-	http.DefaultServeMux.ServeHTTP(recorder, request)
+	serv.ServeHTTP(recorder, request)
 
 	request = httptest.NewRequest("GET", "/jwt?aud=321", nil)
-	request.Header.Set("Authorization", iss.StringifyJwt(refreshToken))
+	request.Header.Set("Authorization", iss.MustStringifyJwt(refreshToken))
 
-	http.DefaultServeMux.ServeHTTP(recorder, request)
+	serv.ServeHTTP(recorder, request)
 
 	if recorder.Result().StatusCode != http.StatusUnauthorized {
 		t.Fail()
 	}
 }
 
+func TestIntrospectAndRevoke(t *testing.T) {
+	uid := database.GetUidFor("testusername")
+	rftString := iss.MustStringifyJwt(iss.MintRefreshToken(uid, time.Minute))
+	database.SetRefreshToken(context.Background(), db, rftString, uid)
+
+	accessString := iss.MustStringifyJwt(iss.MintToken(uid, "service", time.Minute))
+
+	database.RegisterClient(context.Background(), db, "revoker", "s3cret")
+
+	// only authenticated clients may revoke
+	for _, secret := range []string{"", "wrong"} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/revoke", strings.NewReader("token="+rftString))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if secret != "" {
+			request.SetBasicAuth("revoker", secret)
+		}
+		serv.ServeHTTP(recorder, request)
+
+		if recorder.Result().StatusCode != http.StatusUnauthorized {
+			t.Fatalf("unauthenticated revoke status %v", recorder.Result().StatusCode)
+		}
+	}
+
+	revoke := func(token string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/revoke", strings.NewReader("token="+token))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth("revoker", "s3cret")
+		serv.ServeHTTP(recorder, request)
+		return recorder.Result().StatusCode
+	}
+
+	// tokens of users and other clients are not the client's to revoke
+	for _, token := range []string{rftString, accessString, serviceToken()} {
+		if status := revoke(token); status != http.StatusBadRequest {
+			t.Fatalf("revoked a token of another subject: %v", status)
+		}
+		if !introspect(t, token).Active {
+			t.Fatal("token of another subject was revoked")
+		}
+	}
+
+	own := iss.MintToken(api.ClientSubject("revoker"), "service", time.Minute)
+	ownString := iss.MustStringifyJwt(own)
+	if !introspect(t, ownString).Active {
+		t.Fatal("token should be active")
+	}
+
+	if status := revoke(ownString); status != http.StatusOK {
+		t.Fatalf("revoke status %v", status)
+	}
+
+	if introspect(t, ownString).Active {
+		t.Fatal("revoked token is still active")
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/revoked?jti="+own.Body.JwtId, nil)
+	request.Header.Set("Authorization", serviceToken())
+	serv.ServeHTTP(recorder, request)
+
+	var body struct {
+		Revoked    bool
+		Expiration int64 `json:"exp"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	if !body.Revoked || body.Expiration != int64(own.Body.Expiration) {
+		t.Fatalf("jti missing from deny-list: %+v", body)
+	}
+}
+
+func TestIntrospectForeignToken(t *testing.T) {
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other := jwt.NewIssuer(rs256.NewSigner(otherKey), iss.Name)
+
+	body := introspect(t, other.MustStringifyJwt(other.MintToken("uid", "service", time.Minute)))
+	if body.Active || body.Subject != "" {
+		t.Fatalf("token signed by another key is active: %v", body)
+	}
+}
+
+func introspect(t *testing.T, token string) (body struct {
+	Active  bool   `json:"active"`
+	Subject string `json:"sub"`
+}) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/introspect", strings.NewReader("token="+token))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", serviceToken())
+	serv.ServeHTTP(recorder, request)
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/token", nil)
+	serv.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "POST" {
+		t.Fatalf("expected 405 allowing POST, got %v %q", recorder.Code, recorder.Header().Get("Allow"))
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	// a second server in the same process must not clash with the first
+	other := api.NewServer("", db, iss, aud, api.Audiences{})
+
+	mux := http.NewServeMux()
+	other.Mount(mux)
+
+	for _, handler := range []http.Handler{other, mux} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %v", recorder.Code)
+		}
+	}
+}
+
+// a token for the auth server's own endpoints
+func serviceToken() string {
+	return iss.MustStringifyJwt(iss.MintToken(api.ClientSubject("test"), iss.Name, time.Minute))
+}
+
+func TestRateLimit(t *testing.T) {
+	serv.UseRateLimits(ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Routes{
+		"POST /login": {Ip: ratelimit.Limit{Burst: 1, Every: time.Minute}},
+		"GET /jwt":    {Subject: ratelimit.Limit{Burst: 1, Every: time.Minute}},
+	}))
+	defer serv.UseRateLimits(nil)
+
+	uid := database.GetUidFor("testusername")
+	rftString := iss.MustStringifyJwt(iss.MintRefreshToken(uid, time.Minute))
+	database.SetRefreshToken(context.Background(), db, rftString, uid)
+
+	login := func() *http.Request {
+		body := `{"username": "testusername", "password": "wrongpassword"}`
+		return httptest.NewRequest("POST", "/login", strings.NewReader(body))
+	}
+	makeJwt := func() *http.Request {
+		request := httptest.NewRequest("GET", "/jwt?aud=service", nil)
+		request.Header.Set("Authorization", "Bearer "+rftString)
+		return request
+	}
+
+	for _, newRequest := range []func() *http.Request{login, makeJwt} {
+		recorder := httptest.NewRecorder()
+		serv.ServeHTTP(recorder, newRequest())
+		if recorder.Code == http.StatusTooManyRequests {
+			t.Fatal("first request limited")
+		}
+
+		recorder = httptest.NewRecorder()
+		serv.ServeHTTP(recorder, newRequest())
+		if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "60" {
+			t.Fatalf("request over the limit got %d, Retry-After %q", recorder.Code, recorder.Header().Get("Retry-After"))
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	setup()
 	m.Run()
@@ -120,16 +422,71 @@ func TestMain(m *testing.M) {
 func setup() {
 	db = database.Load("users_test.sqlite")
 	privKey, _ = rsa.GenerateKey(rand.Reader, 2048)
-	iss = jwt.NewIssuer(privKey, "TEST")
-	aud = jwt.NewAudience(&privKey.PublicKey, "TEST")
+	iss = jwt.NewIssuer(rs256.NewSigner(privKey), "TEST")
+	aud = jwt.NewAudience(rs256.NewVerifier(&privKey.PublicKey), "TEST")
+	aud.TokenType = jwt.TypRefresh
 
 	serv = api.NewServer(
-		"", db, iss, aud,
+		"", db, iss, aud, api.Audiences{
+			"service":  {TTL: time.Minute, Scopes: []string{"read", "write"}},
+			"disabled": {Disabled: true},
+		},
 	)
-	serv.ConfigureRoutes()
 }
 
 func tearDown() {
 	db.Close()
 	os.Remove("users_test.sqlite")
 }
+
+// The value of the sample of the /metrics exposition, 0 when missing
+func metric(t *testing.T, sample string) float64 {
+	recorder := httptest.NewRecorder()
+	serv.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, sample+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestLoginMetrics(t *testing.T) {
+	success := `gosqueak_auth_logins_total{result="success"}`
+	failure := `gosqueak_auth_logins_total{result="failure"}`
+	refresh := `gosqueak_auth_tokens_minted_total{type="refresh"}`
+	before := []float64{metric(t, success), metric(t, failure), metric(t, refresh)}
+
+	for _, password := range []string{"testpassword", "wrongpassword"} {
+		body := `{"username": "testusername", "password": "` + password + `"}`
+		serv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", strings.NewReader(body)))
+	}
+
+	after := []float64{metric(t, success), metric(t, failure), metric(t, refresh)}
+	for i := range before {
+		if after[i] != before[i]+1 {
+			t.Fatalf("login counters went from %v to %v", before, after)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	serv.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	var body struct {
+		Status string
+		Checks map[string]struct{ Status string }
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+
+	if recorder.Result().StatusCode != http.StatusOK ||
+		body.Checks["users_db"].Status != "ok" || body.Checks["signing_key"].Status != "ok" {
+		t.Fatalf("not ready: %v", recorder.Body)
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// Token policy of an audience that access tokens can be minted for
+type AudiencePolicy struct {
+	// lifetime of access tokens, JwtTTL when zero
+	TTL time.Duration `yaml:"ttl" toml:"ttl"`
+	// the scopes that may be requested for the audience
+	Scopes []string `yaml:"scopes" toml:"scopes"`
+	// disabled audiences are known, but no tokens are minted for them
+	Disabled bool `yaml:"disabled" toml:"disabled"`
+}
+
+// Registry of the audiences known to the auth server, keyed by name
+type Audiences map[string]AudiencePolicy
+
+type errorUnknownAudience struct{ name string }
+
+func (e errorUnknownAudience) Error() string {
+	return fmt.Sprintf("unknown audience: %v", e.name)
+}
+
+type errorAudienceDisabled struct{ name string }
+
+func (e errorAudienceDisabled) Error() string {
+	return fmt.Sprintf("audience disabled: %v", e.name)
+}
+
+type errorScopeNotAllowed struct{ aud, scope string }
+
+func (e errorScopeNotAllowed) Error() string {
+	return fmt.Sprintf("scope %v not allowed for audience %v", e.scope, e.aud)
+}
+
+var ErrUnknownAudience errorUnknownAudience
+var ErrAudienceDisabled errorAudienceDisabled
+var ErrScopeNotAllowed errorScopeNotAllowed
+
+// Look up the policy of the audience; unknown audiences and the reserved
+// names are rejected with ErrUnknownAudience, disabled audiences with
+// ErrAudienceDisabled.
+func (a Audiences) Policy(name string, reserved ...string) (AudiencePolicy, error) {
+	for _, r := range reserved {
+		if name == r {
+			return AudiencePolicy{}, errorUnknownAudience{name}
+		}
+	}
+
+	policy, ok := a[name]
+	if !ok {
+		return AudiencePolicy{}, errorUnknownAudience{name}
+	}
+
+	if policy.Disabled {
+		return AudiencePolicy{}, errorAudienceDisabled{name}
+	}
+
+	return policy, nil
+}
+
+// Token lifetime of the audience
+func (p AudiencePolicy) Lifetime() time.Duration {
+	if p.TTL <= 0 {
+		return JwtTTL
+	}
+	return p.TTL
+}
+
+// The scopes to grant for the requested ones: every requested scope must
+// be allowed for the audience, and requesting none grants all of them.
+func (p AudiencePolicy) GrantScopes(aud string, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return append([]string{}, p.Scopes...), nil
+	}
+
+	for _, scope := range requested {
+		if !p.allows(scope) {
+			return nil, errorScopeNotAllowed{aud, scope}
+		}
+	}
+	return requested, nil
+}
+
+func (p AudiencePolicy) allows(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
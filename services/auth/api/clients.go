@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/oauth"
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/tracing"
+	"github.com/rebeljah/gosqueak/services/auth/database"
+)
+
+const (
+	// subjects of tokens minted for clients, which never collide with uids
+	ClientSubjectPrefix = "client:"
+	// lifetime of service tokens for the auth server's own endpoints
+	ServiceTokenTTL = time.Minute * 5
+)
+
+// The token subject of the client
+func ClientSubject(clientId string) string {
+	return ClientSubjectPrefix + clientId
+}
+
+type ctxKey int
+
+const clientIdKey ctxKey = iota
+
+// The id of the client authenticated by AuthClient
+func authenticatedClient(ctx context.Context) string {
+	clientId, _ := ctx.Value(clientIdKey).(string)
+	return clientId
+}
+
+// Authenticate the client of a token request, by HTTP Basic, the client_id
+// and client_secret params, or a client_assertion signed with the client's
+// registered key. Returns the client id and whether HTTP Basic was used.
+func (s *Server) authenticateClient(r *http.Request) (clientId string, basic, ok bool, err error) {
+	if r.PostForm.Get("client_assertion_type") == oauth.ClientAssertionType {
+		clientId, ok, err = s.verifyClientAssertion(r.Context(), r.PostForm.Get("client_assertion"))
+		return clientId, false, ok, err
+	}
+
+	clientId, secret, basic := r.BasicAuth()
+	if !basic {
+		clientId, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	ok, err = database.VerifyClientSecret(r.Context(), s.db, clientId, secret)
+	if errors.As(err, &database.ErrNoSuchClient) {
+		err = nil
+	}
+	return clientId, basic, ok, err
+}
+
+// An assertion is valid when it is signed by the registered key of the
+// client named by its iss and sub claims, is meant for this issuer, has
+// not expired and was not used before.
+func (s *Server) verifyClientAssertion(ctx context.Context, assertion string) (string, bool, error) {
+	token, err := jwt.FromString(assertion)
+	if err != nil || token.Body.Issuer != token.Body.Subject || token.Expired() {
+		return "", false, nil
+	}
+	clientId := token.Body.Subject
+
+	encoded, err := database.ClientPublicJwk(ctx, s.db, clientId)
+	if errors.As(err, &database.ErrNoSuchClient) || encoded == "" {
+		return clientId, false, nil
+	}
+	if err != nil {
+		return clientId, false, err
+	}
+
+	var key jwt.Jwk
+	if err := json.Unmarshal([]byte(encoded), &key); err != nil {
+		return clientId, false, err
+	}
+
+	aud := jwt.NewKeySetAudience(jwt.Jwks{Keys: []jwt.Jwk{key}}, s.jwtIssuer.Name)
+	aud.TokenType = jwt.TypClientAssertion
+	if !aud.JwtIsValid(token) || token.Body.JwtId == "" {
+		return clientId, false, nil
+	}
+
+	// each assertion is good for one request
+	ok, err := database.UseAssertion(ctx, s.db, clientId, token.Body.JwtId, token.ExpiresAt())
+	return clientId, ok, err
+}
+
+// Client auth middleware for /revoke, which RFC 7009 only serves to
+// clients authenticated as they are at /token.
+func AuthClient(s *Server, handler HandlerFunction) HandlerFunction {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), "AuthClient")
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		if err := r.ParseForm(); err != nil {
+			errOAuth(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+			return
+		}
+
+		clientId, basic, ok, err := s.authenticateClient(r)
+		if err != nil {
+			errInternal(w)
+			return
+		}
+
+		if !ok {
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="revoke"`)
+			}
+			errOAuth(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+			return
+		}
+
+		logging.SetSubject(r.Context(), ClientSubject(clientId))
+		if !ratelimit.Subject(w, r, ClientSubject(clientId)) {
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), clientIdKey, clientId)))
+	}
+}
+
+// Service token auth middleware for the auth server's own endpoints; the
+// token must be an access token minted here for a client, with the issuer
+// as its audience.
+func AuthServiceToken(s *Server, handler HandlerFunction) HandlerFunction {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), "AuthServiceToken")
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		token, err := jwt.FromString(jwt.BearerToken(r))
+		if err != nil {
+			errStatusUnauthorized(w)
+			return
+		}
+
+		if !s.issuedHere(token) ||
+			!token.Header.TypeIs(jwt.TypAccess) ||
+			!token.Body.Audience.Contains(s.jwtIssuer.Name) ||
+			!strings.HasPrefix(token.Body.Subject, ClientSubjectPrefix) ||
+			token.Expired() {
+			errStatusUnauthorized(w)
+			return
+		}
+
+		revoked, err := database.TokenIsRevoked(r.Context(), s.db, token.Body.JwtId)
+		if err != nil {
+			errInternal(w)
+			return
+		}
+		if revoked {
+			errStatusUnauthorized(w)
+			return
+		}
+
+		logging.SetSubject(r.Context(), token.Body.Subject)
+		if !ratelimit.Subject(w, r, token.Body.Subject) {
+			return
+		}
+		handler(w, r)
+	}
+}
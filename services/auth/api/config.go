@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/keyring"
+	"github.com/rebeljah/gosqueak/kit/config"
+	"github.com/rebeljah/gosqueak/services/auth/database"
+)
+
+// IssuerConfig holds the settings of the token issuer, embedded in the
+// configurations of the binaries running the auth server, see config.Load.
+// See DefaultIssuerConfig for the defaults.
+type IssuerConfig struct {
+	// name of the issuer, the audience of refresh and service tokens
+	Issuer string `yaml:"issuer" toml:"issuer" env:"ISSUER" flag:"issuer" usage:"issuer name of the tokens"`
+	// URL clients reach the auth server at, which must then be the issuer,
+	// for the discovery metadata on /.well-known/openid-configuration and
+	// /.well-known/oauth-authorization-server, not served without it
+	PublicUrl string `yaml:"public_url" toml:"public_url" env:"PUBLIC_URL" flag:"public-url" usage:"URL of the auth server published in its metadata"`
+	KeyDir    string `yaml:"key_dir" toml:"key_dir" env:"KEY_DIR" flag:"key-dir" usage:"keyring directory made by gosqueak-keys"`
+	KeyFile   string `yaml:"key_file" toml:"key_file" env:"KEY_FILE" flag:"key-file" usage:"RSA signing key, used when there is no keyring"`
+	// usernames given the admin role on startup, so that there is someone
+	// to manage roles through /admin/roles
+	AdminUsers []string `yaml:"admin_users" toml:"admin_users" env:"ADMIN_USERS" flag:"admin-users" usage:"comma separated usernames granted the admin role"`
+	// the audiences that access tokens can be minted for, only set by the
+	// config file
+	Audiences Audiences `yaml:"audiences" toml:"audiences"`
+}
+
+func DefaultIssuerConfig() IssuerConfig {
+	return IssuerConfig{
+		Issuer:  "AUTHSERV",
+		KeyDir:  "keys",
+		KeyFile: "jwtrsa.private",
+		Audiences: Audiences{
+			"MESSAGE_API": {TTL: JwtTTL, Scopes: []string{"prekeys", "messages", "relay"}},
+		},
+	}
+}
+
+func (c *IssuerConfig) Validate() error {
+	if err := config.CheckNotEmpty(map[string]string{"issuer": c.Issuer}); err != nil {
+		return err
+	}
+
+	if c.PublicUrl != "" {
+		if err := config.CheckUrl("public-url", c.PublicUrl); err != nil {
+			return err
+		}
+		// discovery publishes the URL as the issuer, which must be the iss
+		// of the tokens
+		if c.Issuer != c.PublicUrl {
+			return fmt.Errorf("issuer must be the public-url %q when it is set", c.PublicUrl)
+		}
+	}
+
+	if c.KeyDir == "" && c.KeyFile == "" {
+		return fmt.Errorf("one of key-dir or key-file must be set")
+	}
+
+	for name, policy := range c.Audiences {
+		if name == "" {
+			return fmt.Errorf("audiences: empty audience name")
+		}
+		// the issuer is the audience of refresh and service tokens only
+		if name == c.Issuer {
+			return fmt.Errorf("audiences: %v is the issuer name", name)
+		}
+		if policy.TTL < 0 {
+			return fmt.Errorf("audiences: %v: negative ttl", name)
+		}
+	}
+
+	return nil
+}
+
+// Load the keys made by gosqueak-keys, or a single RSA key, decrypting
+// them with passphrase. Returns the issuer signing with them and the
+// audience of its refresh tokens.
+func (c *IssuerConfig) LoadIssuer(passphrase []byte) (jwt.Issuer, jwt.Audience, error) {
+	active, others, err := keyring.LoadSigners(c.KeyDir, c.KeyFile, passphrase)
+	if err != nil {
+		return jwt.Issuer{}, jwt.Audience{}, err
+	}
+
+	iss := jwt.NewIssuer(active, c.Issuer, others...)
+	aud := jwt.NewKeySetAudience(iss.KeySet(), c.Issuer)
+	// the auth server is the audience of its own refresh tokens
+	aud.TokenType = jwt.TypRefresh
+
+	return iss, aud, nil
+}
+
+// Give the admin role to the users, so that there is someone to manage
+// roles through /admin/roles
+func GrantAdmins(ctx context.Context, db *sql.DB, usernames []string) error {
+	for _, username := range usernames {
+		err := database.GrantRole(ctx, db, database.GetUidFor(username), jwt.RoleAdmin)
+		if err != nil {
+			return fmt.Errorf("granting admin to %v: %w", username, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rebeljah/gosqueak/kit/metrics"
+)
+
+// result labels of the logins counter
+const (
+	LoginSuccess = "success"
+	// wrong passwords, unknown users and disabled accounts
+	LoginFailure = "failure"
+)
+
+// type labels of the minted tokens counter
+const (
+	MintedAccess  = "access"
+	MintedRefresh = "refresh"
+	MintedService = "service"
+)
+
+var (
+	logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "auth_logins_total",
+		Help:      "Password logins by result.",
+	}, []string{"result"})
+
+	tokensMinted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "auth_tokens_minted_total",
+		Help:      "Tokens minted by type.",
+	}, []string{"type"})
+)
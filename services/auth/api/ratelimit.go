@@ -0,0 +1,22 @@
+package api
+
+import (
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+)
+
+// DefaultRateLimits are the limits of the routes of the auth server.
+// Logins and registrations are limited per address against password
+// guessing, and token refreshes per user.
+func DefaultRateLimits() ratelimit.Routes {
+	perIp := ratelimit.Limit{Burst: 100, Every: time.Millisecond * 100}
+
+	return ratelimit.Routes{
+		ratelimit.DefaultRoute: {Ip: perIp},
+		"POST /register":       {Ip: ratelimit.Limit{Burst: 5, Every: time.Minute}},
+		"POST /login":          {Ip: ratelimit.Limit{Burst: 10, Every: time.Second * 6}},
+		"POST /token":          {Ip: ratelimit.Limit{Burst: 20, Every: time.Second}},
+		"GET /jwt":             {Ip: perIp, Subject: ratelimit.Limit{Burst: 10, Every: time.Second}},
+	}
+}
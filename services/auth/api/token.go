@@ -0,0 +1,293 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/services/auth/database"
+)
+
+// OAuth2 grant types accepted by /token
+const (
+	GrantPassword          = "password"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// RFC 6749 section 5.1 successful token response
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// RFC 6749 section 5.2 error response
+func errOAuth(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}{code, description})
+}
+
+// POST form grant_type=<grant>: the OAuth2 token endpoint.
+//
+//	password:           username, password, audience, scope
+//	refresh_token:      refresh_token, audience, scope
+//	client_credentials: audience, scope, with the client authenticated by
+//	                    HTTP Basic, the client_id and client_secret params
+//	                    or an RFC 7523 client_assertion
+//
+// The access token is minted for audience following its policy. Only the
+// password grant returns a refresh token, which replaces the user's previous
+// one like /login does.
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		errOAuth(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case GrantPassword:
+		s.passwordGrant(w, r)
+	case GrantRefreshToken:
+		s.refreshTokenGrant(w, r)
+	case GrantClientCredentials:
+		s.clientCredentialsGrant(w, r)
+	case "":
+		errOAuth(w, http.StatusBadRequest, "invalid_request", "missing grant_type")
+	default:
+		errOAuth(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+func (s *Server) passwordGrant(w http.ResponseWriter, r *http.Request) {
+	username := r.PostForm.Get("username")
+
+	ok, err := s.verifyLogin(r.Context(), username, r.PostForm.Get("password"), r.RemoteAddr)
+	if errors.As(err, &ErrAccountDisabled) {
+		errOAuth(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil && !errors.As(err, &database.ErrNoSuchUser) {
+		errInternal(w)
+		return
+	}
+
+	// unknown users and wrong passwords are not told apart
+	if !ok {
+		errOAuth(w, http.StatusBadRequest, "invalid_grant", "invalid username or password")
+		return
+	}
+
+	uid := database.GetUidFor(username)
+
+	access, ok := s.grantUserAccessToken(w, r, uid)
+	if !ok {
+		return
+	}
+
+	rft, err := s.newRefreshToken(r.Context(), uid)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	s.writeTokenResponse(w, access, rft)
+}
+
+func (s *Server) refreshTokenGrant(w http.ResponseWriter, r *http.Request) {
+	token, active, err := s.tokenIsActive(r.Context(), r.PostForm.Get("refresh_token"))
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	if !active || s.tokenType(token) != TokenTypeRefresh {
+		errOAuth(w, http.StatusBadRequest, "invalid_grant", "invalid refresh token")
+		return
+	}
+
+	access, ok := s.grantUserAccessToken(w, r, token.Body.Subject)
+	if !ok {
+		return
+	}
+
+	s.writeTokenResponse(w, access, "")
+}
+
+// Clients get tokens in their own subject namespace, and are the only ones
+// that may ask for a service token with the issuer itself as the audience.
+func (s *Server) clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	clientId, basic, ok, err := s.authenticateClient(r)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	if !ok {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		errOAuth(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	sub := ClientSubject(clientId)
+	logging.SetSubject(r.Context(), sub)
+
+	if r.PostForm.Get("audience") == s.jwtIssuer.Name {
+		if r.PostForm.Get("scope") != "" {
+			errOAuth(w, http.StatusBadRequest, "invalid_scope", "service tokens have no scopes")
+			return
+		}
+		tokensMinted.WithLabelValues(MintedService).Inc()
+		s.writeTokenResponse(w, s.jwtIssuer.MintToken(sub, s.jwtIssuer.Name, ServiceTokenTTL), "")
+		return
+	}
+
+	// clients have no roles
+	access, ok := s.grantAccessToken(w, r, sub, nil)
+	if !ok {
+		return
+	}
+
+	s.writeTokenResponse(w, access, "")
+}
+
+// grantAccessToken for a user, carrying the user's roles
+func (s *Server) grantUserAccessToken(w http.ResponseWriter, r *http.Request, uid string) (jwt.Jwt, bool) {
+	logging.SetSubject(r.Context(), uid)
+
+	roles, err := database.UserRoles(r.Context(), s.db, uid)
+	if err != nil {
+		errInternal(w)
+		return jwt.Jwt{}, false
+	}
+
+	return s.grantAccessToken(w, r, uid, roles)
+}
+
+// Mint the access token requested by the audience and scope params, writing
+// the OAuth2 error and returning false when the audience policy refuses it.
+func (s *Server) grantAccessToken(w http.ResponseWriter, r *http.Request, sub string, roles []string) (jwt.Jwt, bool) {
+	aud := r.PostForm.Get("audience")
+	if aud == "" {
+		errOAuth(w, http.StatusBadRequest, "invalid_request", "missing audience")
+		return jwt.Jwt{}, false
+	}
+
+	token, err := s.mintAccessToken(sub, aud, strings.Fields(r.PostForm.Get("scope")), roles)
+	if err != nil {
+		if errors.As(err, &ErrScopeNotAllowed) {
+			errOAuth(w, http.StatusBadRequest, "invalid_scope", err.Error())
+		} else {
+			// RFC 8707 error for an audience tokens can't be minted for
+			errOAuth(w, http.StatusBadRequest, "invalid_target", err.Error())
+		}
+		return jwt.Jwt{}, false
+	}
+
+	return token, true
+}
+
+func (s *Server) writeTokenResponse(w http.ResponseWriter, access jwt.Jwt, refreshToken string) {
+	signed, err := s.jwtIssuer.StringifyJwt(access)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	body := tokenResponse{
+		AccessToken:  signed,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(access.ExpiresAt()).Round(time.Second).Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        access.Body.Scope,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	err = json.NewEncoder(w).Encode(body)
+	if err != nil {
+		errInternal(w)
+	}
+}
+
+// Responds with the RFC 8414 / OpenID Connect discovery metadata. The
+// issuer is the iss of the minted tokens, which is the public URL of the
+// server that endpoint URLs are built from, so the metadata is not served
+// without one.
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	if s.publicUrl == "" {
+		http.NotFound(w, r)
+		return
+	}
+	base := strings.TrimSuffix(s.publicUrl, "/")
+
+	scopes := []string{}
+	seen := make(map[string]bool)
+	for _, policy := range s.audiences {
+		for _, scope := range policy.Scopes {
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	sort.Strings(scopes)
+
+	body, err := json.Marshal(struct {
+		Issuer                string   `json:"issuer"`
+		JwksUri               string   `json:"jwks_uri"`
+		TokenEndpoint         string   `json:"token_endpoint"`
+		IntrospectionEndpoint string   `json:"introspection_endpoint"`
+		RevocationEndpoint    string   `json:"revocation_endpoint"`
+		GrantTypes            []string `json:"grant_types_supported"`
+		ResponseTypes         []string `json:"response_types_supported"`
+		AuthMethods           []string `json:"token_endpoint_auth_methods_supported"`
+		Scopes                []string `json:"scopes_supported"`
+		SubjectTypes          []string `json:"subject_types_supported"`
+		SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+	}{
+		Issuer:                s.jwtIssuer.Name,
+		JwksUri:               base + "/.well-known/jwks.json",
+		TokenEndpoint:         base + "/token",
+		IntrospectionEndpoint: base + "/introspect",
+		RevocationEndpoint:    base + "/revoke",
+		GrantTypes:            []string{GrantPassword, GrantRefreshToken, GrantClientCredentials},
+		// there is no authorization endpoint, so only the response type
+		// issuing nothing; the list may not be empty
+		ResponseTypes: []string{"none"},
+		AuthMethods:   []string{"client_secret_basic", "client_secret_post", "private_key_jwt"},
+		Scopes:        scopes,
+		SubjectTypes:  []string{"public"},
+		SigningAlgs:   []string{s.jwtIssuer.Algorithm()},
+	})
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(JwksMaxAge.Seconds())))
+
+	_, err = w.Write(body)
+	if err != nil {
+		errInternal(w)
+	}
+}
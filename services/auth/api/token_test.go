@@ -0,0 +1,242 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/jwt/eddsa"
+	"github.com/rebeljah/gosqueak/jwt/oauth"
+	"github.com/rebeljah/gosqueak/services/auth/api"
+	"github.com/rebeljah/gosqueak/services/auth/database"
+)
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+func postToken(form url.Values, setup ...func(*http.Request)) (int, tokenResponse) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, f := range setup {
+		f(request)
+	}
+	serv.ServeHTTP(recorder, request)
+
+	var body tokenResponse
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return recorder.Result().StatusCode, body
+}
+
+func TestTokenPasswordAndRefreshGrants(t *testing.T) {
+	database.RegisterUser(context.Background(), db, "oauthuser", "oauthpassword")
+
+	status, body := postToken(url.Values{
+		"grant_type": {"password"},
+		"username":   {"oauthuser"},
+		"password":   {"oauthpassword"},
+		"audience":   {"service"},
+		"scope":      {"read"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("password grant: %v %v", status, body.Error)
+	}
+
+	if body.TokenType != "Bearer" || body.Scope != "read" || body.ExpiresIn <= 0 || body.RefreshToken == "" {
+		t.Fatalf("bad token response: %+v", body)
+	}
+
+	access, err := jwt.FromString(body.AccessToken)
+	if err != nil || access.Body.Subject != database.GetUidFor("oauthuser") {
+		t.Fatalf("bad access token: %v", err)
+	}
+
+	status, refreshed := postToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {body.RefreshToken},
+		"audience":      {"service"},
+	})
+	if status != http.StatusOK || refreshed.AccessToken == "" || refreshed.RefreshToken != "" {
+		t.Fatalf("refresh grant: %v %+v", status, refreshed)
+	}
+
+	// an access token is not a refresh token
+	status, refreshed = postToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {body.AccessToken},
+		"audience":      {"service"},
+	})
+	if status != http.StatusBadRequest || refreshed.Error != "invalid_grant" {
+		t.Fatalf("access token accepted as refresh token: %v %+v", status, refreshed)
+	}
+}
+
+func TestTokenErrors(t *testing.T) {
+	cases := []struct {
+		form  url.Values
+		error string
+	}{
+		{url.Values{}, "invalid_request"},
+		{url.Values{"grant_type": {"implicit"}}, "unsupported_grant_type"},
+		{url.Values{"grant_type": {"password"}, "username": {"nobody"}, "audience": {"service"}}, "invalid_grant"},
+		{url.Values{"grant_type": {"password"}, "username": {"testusername"}, "password": {"testpassword"}, "audience": {"TEST"}}, "invalid_target"},
+		{url.Values{"grant_type": {"password"}, "username": {"testusername"}, "password": {"testpassword"}, "audience": {"service"}, "scope": {"admin"}}, "invalid_scope"},
+	}
+
+	for _, c := range cases {
+		if status, body := postToken(c.form); status != http.StatusBadRequest || body.Error != c.error {
+			t.Errorf("%v: expected %v, got %v %v", c.form, c.error, status, body.Error)
+		}
+	}
+}
+
+func TestTokenClientCredentialsGrant(t *testing.T) {
+	database.RegisterClient(context.Background(), db, "worker", "s3cret")
+	form := url.Values{"grant_type": {"client_credentials"}, "audience": {"service"}}
+
+	status, body := postToken(form, func(r *http.Request) { r.SetBasicAuth("worker", "s3cret") })
+	if status != http.StatusOK || body.RefreshToken != "" {
+		t.Fatalf("client credentials grant: %v %+v", status, body)
+	}
+
+	access, _ := jwt.FromString(body.AccessToken)
+	if access.Body.Subject != api.ClientSubject("worker") {
+		t.Fatalf("bad subject %v", access.Body.Subject)
+	}
+
+	status, body = postToken(form, func(r *http.Request) { r.SetBasicAuth("worker", "wrong") })
+	if status != http.StatusUnauthorized || body.Error != "invalid_client" {
+		t.Fatalf("wrong secret accepted: %v %+v", status, body)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	paths := []string{"/.well-known/openid-configuration", "/.well-known/oauth-authorization-server"}
+
+	// not served by default, there is no URL to publish
+	for _, path := range paths {
+		recorder := httptest.NewRecorder()
+		serv.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Fatalf("%v served without a public URL: %v", path, recorder.Code)
+		}
+	}
+
+	// the issuer name is the public URL
+	urlIss := jwt.NewIssuer(eddsa.NewSigner(eddsa.MustGeneratePrivateKey()), "https://auth.example")
+	discoverable := api.NewServer("", db, urlIss, aud, api.Audiences{
+		"service": {TTL: time.Minute, Scopes: []string{"read", "write"}},
+	})
+	discoverable.UsePublicUrl(urlIss.Name)
+
+	for _, path := range paths {
+		// the URLs don't depend on the host the request was made to
+		recorder := httptest.NewRecorder()
+		discoverable.ServeHTTP(recorder, httptest.NewRequest("GET", "http://attacker.example"+path, nil))
+
+		var body struct {
+			Issuer        string   `json:"issuer"`
+			JwksUri       string   `json:"jwks_uri"`
+			TokenEndpoint string   `json:"token_endpoint"`
+			ResponseTypes []string `json:"response_types_supported"`
+			SigningAlgs   []string `json:"id_token_signing_alg_values_supported"`
+			Scopes        []string `json:"scopes_supported"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		if body.Issuer != "https://auth.example" ||
+			body.JwksUri != "https://auth.example/.well-known/jwks.json" ||
+			body.TokenEndpoint != "https://auth.example/token" ||
+			len(body.ResponseTypes) == 0 ||
+			len(body.SigningAlgs) != 1 || body.SigningAlgs[0] != jwt.AlgEdDSA {
+			t.Fatalf("bad discovery document: %+v", body)
+		}
+
+		if len(body.Scopes) != 2 || body.Scopes[0] != "read" {
+			t.Fatalf("bad scopes: %v", body.Scopes)
+		}
+	}
+}
+
+func TestTokenKeyClient(t *testing.T) {
+	signer, _ := jwt.NewSigner(jwt.AlgEdDSA, eddsa.MustGeneratePrivateKey())
+	key, _ := jwt.NewJwk(jwt.AlgEdDSA, signer.Public())
+	encoded, _ := json.Marshal(key)
+	database.RegisterKeyClient(context.Background(), db, "keyworker", string(encoded))
+
+	srv := httptest.NewServer(serv)
+	defer srv.Close()
+
+	// service token for the auth server's own endpoints
+	tokens := oauth.NewTokenSource(
+		srv.URL+"/token", iss.Name, oauth.PrivateKeyJwt("keyworker", signer, iss.Name), nil,
+	)
+
+	resp, err := tokens.Client().Get(srv.URL + "/revoked?jti=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("service token rejected: %v", resp.StatusCode)
+	}
+
+	resp, _ = http.Get(srv.URL + "/revoked?jti=1")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("deny-list served without a service token: %v", resp.StatusCode)
+	}
+
+	// assertions can't be replayed
+	client := jwt.NewIssuer(signer, "keyworker")
+	assertion := client.MintToken("keyworker", iss.Name, time.Minute)
+	assertion.Header.Type = jwt.TypClientAssertion
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"audience":              {"service"},
+		"client_assertion_type": {oauth.ClientAssertionType},
+		"client_assertion":      {client.MustStringifyJwt(assertion)},
+	}
+
+	if status, body := postToken(form); status != http.StatusOK {
+		t.Fatalf("assertion rejected: %v %v", status, body.Error)
+	}
+
+	if status, _ := postToken(form); status != http.StatusUnauthorized {
+		t.Fatalf("replayed assertion accepted: %v", status)
+	}
+
+	// an assertion sharing the jti of a token doesn't deny the token
+	victim := iss.MustStringifyJwt(iss.MintToken("victim", "service", time.Minute))
+	victimToken, _ := jwt.FromString(victim)
+
+	assertion = client.MintToken("keyworker", iss.Name, time.Minute)
+	assertion.Header.Type = jwt.TypClientAssertion
+	assertion.Body.JwtId = victimToken.Body.JwtId
+	form.Set("client_assertion", client.MustStringifyJwt(assertion))
+
+	if status, body := postToken(form); status != http.StatusOK {
+		t.Fatalf("assertion rejected: %v %v", status, body.Error)
+	}
+
+	if !introspect(t, victim).Active {
+		t.Fatal("assertion revoked the token with its jti")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/rebeljah/gosqueak/kit/config"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/server"
+	"github.com/rebeljah/gosqueak/services/auth/api"
+)
+
+// prefix of the environment variables configuring the auth server
+const EnvPrefix = "GOSQUEAK_AUTH_"
+
+// name of the auth server in its spans
+const ServiceName = "gosqueak-auth"
+
+// Configuration of the auth server, see DefaultConfig for the defaults.
+// Secrets such as key passphrases are only read from the environment.
+type Config struct {
+	Addr string `yaml:"addr" toml:"addr" env:"ADDR" flag:"addr" usage:"listen address"`
+	Db   string `yaml:"db" toml:"db" env:"DB" flag:"db" usage:"users database file"`
+	// the token issuer, shared with the gosqueak binary
+	api.IssuerConfig `yaml:",inline"`
+	// TLS, logs and traces, shared with the other binaries
+	server.Config `yaml:",inline"`
+	// token buckets per client IP and per token subject, keyed by route
+	// pattern, with "*" for the other routes; only set by the config file
+	RateLimits ratelimit.Routes `yaml:"rate_limits" toml:"rate_limits"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:         "127.0.0.1:8081",
+		Db:           "users.sqlite",
+		IssuerConfig: api.DefaultIssuerConfig(),
+		Config:       server.DefaultConfig(),
+		RateLimits:   api.DefaultRateLimits(),
+	}
+}
+
+func (c *Config) Validate() error {
+	if err := config.CheckAddr("addr", c.Addr); err != nil {
+		return err
+	}
+
+	if err := config.CheckNotEmpty(map[string]string{"db": c.Db}); err != nil {
+		return err
+	}
+
+	if err := c.IssuerConfig.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+
+	return c.RateLimits.Validate()
+}
@@ -0,0 +1,249 @@
+// Command gosqueak-admin manages the user accounts of the auth server. It
+// works on the database directly, like the /admin endpoints do.
+//
+// Usage:
+//
+//	gosqueak-admin users          [-db users.sqlite] [-q QUERY] [-limit 50] [-offset 0]
+//	gosqueak-admin disable        [-db users.sqlite] -user USERNAME
+//	gosqueak-admin enable         [-db users.sqlite] -user USERNAME
+//	gosqueak-admin logout         [-db users.sqlite] -user USERNAME
+//	gosqueak-admin reset-password [-db users.sqlite] -user USERNAME
+//	gosqueak-admin logins         [-db users.sqlite] -user USERNAME [-limit 50]
+//	gosqueak-admin roles          [-db users.sqlite] -user USERNAME
+//	gosqueak-admin grant          [-db users.sqlite] -user USERNAME -role ROLE
+//	gosqueak-admin revoke         [-db users.sqlite] -user USERNAME -role ROLE
+//
+// reset-password reads the new password from the first line of stdin, or
+// generates one and prints it when stdin is empty.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rebeljah/gosqueak/services/auth/database"
+)
+
+const (
+	DefaultDb    = "users.sqlite"
+	DefaultLimit = 50
+	// bytes of randomness in generated passwords
+	PasswordLength = 18
+)
+
+var commands = map[string]func(args []string) error{
+	"users":          users,
+	"disable":        disable,
+	"enable":         enable,
+	"logout":         logout,
+	"reset-password": resetPassword,
+	"logins":         logins,
+	"roles":          roles,
+	"grant":          grant,
+	"revoke":         revoke,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: gosqueak-admin users|disable|enable|logout|reset-password|logins|roles|grant|revoke [flags]")
+		os.Exit(2)
+	}
+
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "gosqueak-admin:", err)
+		os.Exit(1)
+	}
+}
+
+// flags shared by the commands acting on one user
+type userFlags struct {
+	fs     *flag.FlagSet
+	dbPath *string
+	user   *string
+}
+
+func newUserFlags(name string) userFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return userFlags{
+		fs,
+		fs.String("db", DefaultDb, "auth server database"),
+		fs.String("user", "", "username"),
+	}
+}
+
+// parse the flags and open the database, failing if the user does not exist
+func (f userFlags) open(args []string) (*sql.DB, string, error) {
+	f.fs.Parse(args)
+
+	if *f.user == "" {
+		return nil, "", fmt.Errorf("-user is required")
+	}
+
+	db := database.Load(*f.dbPath)
+	uid := database.GetUidFor(*f.user)
+
+	ok, err := database.UserExists(context.Background(), db, uid)
+	if err == nil && !ok {
+		err = fmt.Errorf("no such username: %s", *f.user)
+	}
+	if err != nil {
+		db.Close()
+		return nil, "", err
+	}
+
+	return db, uid, nil
+}
+
+func users(args []string) error {
+	fs := flag.NewFlagSet("users", flag.ExitOnError)
+	dbPath := fs.String("db", DefaultDb, "auth server database")
+	query := fs.String("q", "", "username substring or uid prefix")
+	limit := fs.Int("limit", DefaultLimit, "users to list")
+	offset := fs.Int("offset", 0, "users to skip")
+	fs.Parse(args)
+
+	db := database.Load(*dbPath)
+	defer db.Close()
+
+	accounts, err := database.ListUsers(context.Background(), db, *query, *limit, *offset)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range accounts {
+		state := "enabled"
+		if a.Disabled {
+			state = "disabled"
+		}
+		fmt.Printf("%v\t%v\t%v\t%v\n", a.Uid, a.Username, state, a.Created.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func disable(args []string) error {
+	db, uid, err := newUserFlags("disable").open(args)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return database.SetUserDisabled(context.Background(), db, uid, true)
+}
+
+func enable(args []string) error {
+	db, uid, err := newUserFlags("enable").open(args)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return database.SetUserDisabled(context.Background(), db, uid, false)
+}
+
+func logout(args []string) error {
+	db, uid, err := newUserFlags("logout").open(args)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return database.SetRefreshToken(context.Background(), db, "", uid)
+}
+
+func resetPassword(args []string) error {
+	db, uid, err := newUserFlags("reset-password").open(args)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+
+	if password == "" {
+		b := make([]byte, PasswordLength)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+		fmt.Println(password)
+	}
+
+	return database.ResetPassword(context.Background(), db, uid, password)
+}
+
+func logins(args []string) error {
+	f := newUserFlags("logins")
+	limit := f.fs.Int("limit", DefaultLimit, "login attempts to show")
+
+	db, uid, err := f.open(args)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	history, err := database.LoginHistory(context.Background(), db, uid, *limit)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range history {
+		outcome := "failed"
+		if l.Success {
+			outcome = "ok"
+		}
+		fmt.Printf("%v\t%v\t%v\n", l.Time.Format(time.RFC3339), outcome, l.RemoteAddr)
+	}
+
+	return nil
+}
+
+func roles(args []string) error {
+	db, uid, err := newUserFlags("roles").open(args)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := database.UserRoles(context.Background(), db, uid)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(r)
+}
+
+func grant(args []string) error {
+	return changeRole("grant", args, database.GrantRole)
+}
+
+func revoke(args []string) error {
+	return changeRole("revoke", args, database.RevokeRole)
+}
+
+func changeRole(name string, args []string, change func(context.Context, *sql.DB, string, string) error) error {
+	f := newUserFlags(name)
+	role := f.fs.String("role", "", "role, such as admin")
+
+	db, uid, err := f.open(args)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *role == "" {
+		return fmt.Errorf("-role is required")
+	}
+
+	return change(context.Background(), db, uid, *role)
+}
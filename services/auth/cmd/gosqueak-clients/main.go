@@ -0,0 +1,158 @@
+// Command gosqueak-clients registers the service clients of the auth
+// server, which get tokens of their own with the client_credentials grant.
+//
+// Usage:
+//
+//	gosqueak-clients add-secret [-db users.sqlite] -id ID
+//	gosqueak-clients add-key    [-db users.sqlite] -id ID -jwk key.json
+//	gosqueak-clients remove     [-db users.sqlite] -id ID
+//	gosqueak-clients list       [-db users.sqlite]
+//
+// add-secret generates the client's secret and prints it, only its hash is
+// stored. add-key registers the public JWK printed by gosqueak-keys
+// generate; the client then authenticates with assertions signed by the
+// private key.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/services/auth/database"
+)
+
+const (
+	DefaultDb = "users.sqlite"
+	// bytes of randomness in generated secrets
+	SecretLength = 32
+)
+
+var commands = map[string]func(args []string) error{
+	"add-secret": addSecret,
+	"add-key":    addKey,
+	"remove":     remove,
+	"list":       list,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: gosqueak-clients add-secret|add-key|remove|list [flags]")
+		os.Exit(2)
+	}
+
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "gosqueak-clients:", err)
+		os.Exit(1)
+	}
+}
+
+func addSecret(args []string) error {
+	fs := flag.NewFlagSet("add-secret", flag.ExitOnError)
+	dbPath := fs.String("db", DefaultDb, "auth server database")
+	id := fs.String("id", "", "client id")
+	fs.Parse(args)
+
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	b := make([]byte, SecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	db := database.Load(*dbPath)
+	defer db.Close()
+
+	if err := database.RegisterClient(context.Background(), db, *id, secret); err != nil {
+		return err
+	}
+
+	fmt.Println(secret)
+	return nil
+}
+
+func addKey(args []string) error {
+	fs := flag.NewFlagSet("add-key", flag.ExitOnError)
+	dbPath := fs.String("db", DefaultDb, "auth server database")
+	id := fs.String("id", "", "client id")
+	jwkFile := fs.String("jwk", "", "file holding the client's public JWK")
+	fs.Parse(args)
+
+	if *id == "" || *jwkFile == "" {
+		return fmt.Errorf("-id and -jwk are required")
+	}
+
+	b, err := os.ReadFile(*jwkFile)
+	if err != nil {
+		return err
+	}
+
+	// make sure the key can verify assertions before storing it
+	var key jwt.Jwk
+	if err := json.Unmarshal(b, &key); err != nil {
+		return err
+	}
+	if _, err := key.Verifier(); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	db := database.Load(*dbPath)
+	defer db.Close()
+
+	return database.RegisterKeyClient(context.Background(), db, *id, string(b))
+}
+
+func remove(args []string) error {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	dbPath := fs.String("db", DefaultDb, "auth server database")
+	id := fs.String("id", "", "client id")
+	fs.Parse(args)
+
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	db := database.Load(*dbPath)
+	defer db.Close()
+
+	return database.RemoveClient(context.Background(), db, *id)
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dbPath := fs.String("db", DefaultDb, "auth server database")
+	fs.Parse(args)
+
+	db := database.Load(*dbPath)
+	defer db.Close()
+
+	clients, err := database.ListClients(context.Background(), db)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range clients {
+		auth := "secret"
+		if c.PublicJwk != "" {
+			var key jwt.Jwk
+			json.Unmarshal([]byte(c.PublicJwk), &key)
+			auth = fmt.Sprintf("key %v %v", key.Alg, key.KeyId)
+		}
+		fmt.Printf("%v\t%v\n", c.ClientId, auth)
+	}
+
+	return nil
+}
@@ -1,29 +1,62 @@
 package main
 
 import (
-	"github.com/rebeljah/gosqueak/jwt"
-	"github.com/rebeljah/gosqueak/jwt/rs256"
+	"context"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/rebeljah/gosqueak/kit/certs"
+	"github.com/rebeljah/gosqueak/kit/config"
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/tracing"
 	"github.com/rebeljah/gosqueak/services/auth/api"
 	"github.com/rebeljah/gosqueak/services/auth/database"
 )
 
-const (
-	Addr       = "127.0.0.1:8081"
-	JwtActorId = "AUTHSERV"
-)
+// secrets are not part of the Config, so they stay out of config files
+const JwtKeyPassphraseEnv = "GOSQUEAK_JWT_KEY_PASSPHRASE"
 
 func main() {
-	db := database.Load("users.sqlite")
-
-	iss := jwt.NewIssuer(
-		rs256.ParsePrivate(rs256.LoadKey("jwtrsa.private")),
-		JwtActorId,
-	)
-	aud := jwt.NewAudience(
-		iss.PublicKey(), 
-		JwtActorId,
-	)
-
-	serv := api.NewServer(Addr, db, iss, aud)
+	cfg := DefaultConfig()
+	config.MustLoad(&cfg, EnvPrefix)
+
+	// before anything logs, the standard logger writes to it too
+	logger, err := logging.NewLogger(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	stopTracing, err := tracing.Setup(context.Background(), cfg.TraceOptions(ServiceName))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// flushes the spans of the shutdown
+	defer stopTracing(context.Background())
+
+	db := database.Load(cfg.Db)
+	if err := api.GrantAdmins(context.Background(), db, cfg.AdminUsers); err != nil {
+		log.Fatal(err)
+	}
+
+	iss, aud, err := cfg.LoadIssuer([]byte(os.Getenv(JwtKeyPassphraseEnv)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serv := api.NewServer(cfg.Addr, db, iss, aud, cfg.Audiences)
+	serv.UseRateLimits(ratelimit.NewLimiter(ratelimit.NewMemoryStore(), cfg.RateLimits))
+	serv.UsePublicUrl(cfg.PublicUrl)
+
+	tlsCfg, err := certs.ServerConfig(cfg.TlsOptions(cfg.Addr))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsCfg != nil {
+		serv.UseTLS(tlsCfg)
+	}
+
 	serv.Run()
 }
@@ -1,14 +1,17 @@
 package database
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/rebeljah/gosqueak/kit/tracing"
 	"golang.org/x/crypto/pbkdf2"
 )
 
@@ -34,6 +37,22 @@ func NewUser(username, password string, salt []byte) User {
 	}
 }
 
+// models "accounts" table in DB, the admin facing details of a user
+type Account struct {
+	Uid string `json:"uid"`
+	// empty for users registered before usernames were kept
+	Username string    `json:"username"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+}
+
+// models "logins" table in DB, one row per password login attempt
+type Login struct {
+	Time       time.Time `json:"time"`
+	Success    bool      `json:"success"`
+	RemoteAddr string    `json:"remoteAddr"`
+}
+
 // errors
 type errorUserExists struct{ Username string }
 
@@ -47,8 +66,22 @@ func (e errorNoSuchUser) Error() string {
 	return fmt.Sprintf("no such username: %s", e.Username)
 }
 
+type errorClientExists struct{ ClientId string }
+
+func (e errorClientExists) Error() string {
+	return fmt.Sprintf("client: %s already exists", e.ClientId)
+}
+
+type errorNoSuchClient struct{ ClientId string }
+
+func (e errorNoSuchClient) Error() string {
+	return fmt.Sprintf("no such client: %s", e.ClientId)
+}
+
 var ErrUserExists errorUserExists
 var ErrNoSuchUser errorNoSuchUser
+var ErrClientExists errorClientExists
+var ErrNoSuchClient errorNoSuchClient
 
 //
 
@@ -59,9 +92,12 @@ func GetUidFor(username string) string {
 	)
 }
 
-func UserExists(db *sql.DB, uid string) (bool, error) {
+func UserExists(ctx context.Context, db *sql.DB, uid string) (bool, error) {
+	ctx, done := tracing.Query(ctx, "UserExists")
+	defer done()
+
 	stmt := "SELECT uid FROM users WHERE uid=?"
-	row := db.QueryRow(stmt, uid)
+	row := db.QueryRowContext(ctx, stmt, uid)
 
 	if err := row.Scan(new(string)); err != nil {
 		if err == sql.ErrNoRows {
@@ -72,9 +108,9 @@ func UserExists(db *sql.DB, uid string) (bool, error) {
 	return true, nil // user exists
 }
 
-func RegisterUser(db *sql.DB, username, password string) error {
+func RegisterUser(ctx context.Context, db *sql.DB, username, password string) error {
 	// err if user exists already
-	ok, err := UserExists(db, GetUidFor(username))
+	ok, err := UserExists(ctx, db, GetUidFor(username))
 	if ok {
 		return errorUserExists{username}
 	}
@@ -92,25 +128,182 @@ func RegisterUser(db *sql.DB, username, password string) error {
 	// persisted data
 	u := NewUser(username, password, salt)
 
+	// timed after hashing the password
+	ctx, done := tracing.Query(ctx, "RegisterUser")
+	defer done()
+
 	stmt := "INSERT INTO users (uid, hashedPw, hashSalt, refreshToken) VALUES(?, ?, ?, ?)"
 
-	if _, err := db.Exec(stmt, u.Uid, u.HashedPw, u.HashSalt, u.RefreshToken); err != nil {
+	if _, err := db.ExecContext(ctx, stmt, u.Uid, u.HashedPw, u.HashSalt, u.RefreshToken); err != nil {
+		return err
+	}
+
+	stmt = "INSERT OR IGNORE INTO accounts (uid, username, disabled, created) VALUES(?, ?, 0, ?)"
+	_, err = db.ExecContext(ctx, stmt, u.Uid, username, time.Now().Unix())
+	return err
+}
+
+// Users matching the query, a substring of the username or a uid prefix,
+// ordered by username. An empty query matches every user.
+func ListUsers(ctx context.Context, db *sql.DB, query string, limit, offset int) ([]Account, error) {
+	ctx, done := tracing.Query(ctx, "ListUsers")
+	defer done()
+
+	accounts := make([]Account, 0)
+
+	stmt := `
+		SELECT users.uid, IFNULL(accounts.username, ''), IFNULL(accounts.disabled, 0), IFNULL(accounts.created, 0)
+		FROM users LEFT JOIN accounts ON users.uid = accounts.uid
+		WHERE instr(IFNULL(accounts.username, ''), ?) > 0 OR substr(users.uid, 1, length(?)) = ?
+		ORDER BY accounts.username, users.uid
+		LIMIT ? OFFSET ?`
+	rows, err := db.QueryContext(ctx, stmt, query, query, query, limit, offset)
+	if err != nil {
+		return accounts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Account
+		var created int64
+		if err := rows.Scan(&a.Uid, &a.Username, &a.Disabled, &created); err != nil {
+			return accounts, err
+		}
+		a.Created = time.Unix(created, 0)
+		accounts = append(accounts, a)
+	}
+
+	return accounts, rows.Err()
+}
+
+// Disable or re-enable the user. Disabled users can't log in or use their
+// refresh token, which is discarded.
+func SetUserDisabled(ctx context.Context, db *sql.DB, uid string, disabled bool) error {
+	ctx, done := tracing.Query(ctx, "SetUserDisabled")
+	defer done()
+
+	ok, err := UserExists(ctx, db, uid)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errorNoSuchUser{uid}
+	}
+
+	// users registered before accounts were kept get a row without a name
+	stmt := `
+		INSERT INTO accounts (uid, username, disabled, created) VALUES(?, NULL, ?, 0)
+		ON CONFLICT(uid) DO UPDATE SET disabled=excluded.disabled`
+	if _, err := db.ExecContext(ctx, stmt, uid, disabled); err != nil {
 		return err
 	}
 
+	if disabled {
+		return SetRefreshToken(ctx, db, "", uid)
+	}
 	return nil
 }
 
+// Return true, nil if the user exists and is disabled
+func UserIsDisabled(ctx context.Context, db *sql.DB, uid string) (bool, error) {
+	ctx, done := tracing.Query(ctx, "UserIsDisabled")
+	defer done()
+
+	var disabled bool
+
+	stmt := "SELECT disabled FROM accounts WHERE uid=?"
+	err := db.QueryRowContext(ctx, stmt, uid).Scan(&disabled)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return disabled, nil
+}
+
+// Replace the password of the user, logging them out
+func ResetPassword(ctx context.Context, db *sql.DB, uid, password string) error {
+	salt := make([]byte, 16, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	hashed := getPwHash(password, salt)
+	ctx, done := tracing.Query(ctx, "ResetPassword")
+	defer done()
+
+	stmt := "UPDATE users SET hashedPw=?, hashSalt=?, refreshToken='' WHERE uid=?"
+	res, err := db.ExecContext(ctx, stmt, hashed, base64.StdEncoding.EncodeToString(salt), uid)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return errorNoSuchUser{uid}
+	}
+
+	return nil
+}
+
+// Record a password login attempt of the user
+func RecordLogin(ctx context.Context, db *sql.DB, uid string, success bool, remoteAddr string) error {
+	ctx, done := tracing.Query(ctx, "RecordLogin")
+	defer done()
+
+	stmt := "INSERT INTO logins (uid, time, success, remoteAddr) VALUES(?, ?, ?, ?)"
+	_, err := db.ExecContext(ctx, stmt, uid, time.Now().UnixNano(), success, remoteAddr)
+	return err
+}
+
+// The most recent login attempts of the user, newest first
+func LoginHistory(ctx context.Context, db *sql.DB, uid string, limit int) ([]Login, error) {
+	ctx, done := tracing.Query(ctx, "LoginHistory")
+	defer done()
+
+	logins := make([]Login, 0)
+
+	stmt := "SELECT time, success, remoteAddr FROM logins WHERE uid=? ORDER BY time DESC LIMIT ?"
+	rows, err := db.QueryContext(ctx, stmt, uid, limit)
+	if err != nil {
+		return logins, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l Login
+		var t int64
+		if err := rows.Scan(&t, &l.Success, &l.RemoteAddr); err != nil {
+			return logins, err
+		}
+		l.Time = time.Unix(0, t)
+		logins = append(logins, l)
+	}
+
+	return logins, rows.Err()
+}
+
 // Returns true, nil when the users exists, and the given password hashes to
 // the stored password hash.
-func VerifyPassword(db *sql.DB, username, password string) (bool, error) {
+func VerifyPassword(ctx context.Context, db *sql.DB, username, password string) (bool, error) {
 	var u User
 
+	// the query only, not the hashing
+	ctx, queried := tracing.Query(ctx, "VerifyPassword")
 	stmt := "SELECT hashedPw, hashSalt FROM users WHERE uid=?"
-	row := db.QueryRow(stmt, GetUidFor(username))
+	err := db.QueryRowContext(ctx, stmt, GetUidFor(username)).Scan(&u.HashedPw, &u.HashSalt)
+	queried()
 
 	// return err if the user exists or if row couldn't be read
-	if err := row.Scan(&u.HashedPw, &u.HashSalt); err != nil {
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, errorNoSuchUser{username}
 		}
@@ -134,26 +327,35 @@ func VerifyPassword(db *sql.DB, username, password string) (bool, error) {
 }
 
 // Set the users refresh token, overwriting the users previous token it it exists.
-func SetRefreshToken(db *sql.DB, rft string, uid string) error {
+func SetRefreshToken(ctx context.Context, db *sql.DB, rft string, uid string) error {
+	ctx, done := tracing.Query(ctx, "SetRefreshToken")
+	defer done()
+
 	stmt := "UPDATE users SET refreshToken=? WHERE uid=?"
-	_, err := db.Exec(stmt, rft, uid)
+	_, err := db.ExecContext(ctx, stmt, rft, uid)
 	return err
 }
 
 // Remove the given token from all users.
 // May be called multiple times for same token.
-func DiscardRefreshToken(db *sql.DB, rft string) error {
+func DiscardRefreshToken(ctx context.Context, db *sql.DB, rft string) error {
+	ctx, done := tracing.Query(ctx, "DiscardRefreshToken")
+	defer done()
+
 	stmt := "UPDATE users SET refreshToken='' WHERE refreshToken=?"
-	_, err := db.Exec(stmt, rft)
+	_, err := db.ExecContext(ctx, stmt, rft)
 	return err
 }
 
 // Return true, nil if user exists and has the token in db
-func UserHasRefreshToken(db *sql.DB, uid, rfToken string) (bool, error) {
+func UserHasRefreshToken(ctx context.Context, db *sql.DB, uid, rfToken string) (bool, error) {
+	ctx, done := tracing.Query(ctx, "UserHasRefreshToken")
+	defer done()
+
 	var token string
 
 	stmt := "SELECT refreshToken FROM users WHERE uid=?"
-	err := db.QueryRow(stmt, uid).Scan(&token)
+	err := db.QueryRowContext(ctx, stmt, uid).Scan(&token)
 
 	if err != nil {
 		if err == sql.ErrNoRows { // expected error indicates user not exists
@@ -166,6 +368,281 @@ func UserHasRefreshToken(db *sql.DB, uid, rfToken string) (bool, error) {
 	return token == rfToken, nil
 }
 
+// models "clients" table in DB, a client has either a secret or a key
+type Client struct {
+	ClientId     string
+	HashedSecret string
+	HashSalt     string
+	// JSON encoded JWK of the client's public key
+	PublicJwk string
+}
+
+// Give the user a role. Granting a role the user has is a no-op.
+func GrantRole(ctx context.Context, db *sql.DB, uid, role string) error {
+	ctx, done := tracing.Query(ctx, "GrantRole")
+	defer done()
+
+	ok, err := UserExists(ctx, db, uid)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errorNoSuchUser{uid}
+	}
+
+	stmt := "INSERT OR IGNORE INTO userRoles (uid, role) VALUES(?, ?)"
+	_, err = db.ExecContext(ctx, stmt, uid, role)
+	return err
+}
+
+// Take a role from the user. May be called multiple times for same role.
+func RevokeRole(ctx context.Context, db *sql.DB, uid, role string) error {
+	ctx, done := tracing.Query(ctx, "RevokeRole")
+	defer done()
+
+	stmt := "DELETE FROM userRoles WHERE uid=? AND role=?"
+	_, err := db.ExecContext(ctx, stmt, uid, role)
+	return err
+}
+
+// The roles of the user, ordered by name
+func UserRoles(ctx context.Context, db *sql.DB, uid string) ([]string, error) {
+	ctx, done := tracing.Query(ctx, "UserRoles")
+	defer done()
+
+	roles := make([]string, 0)
+
+	stmt := "SELECT role FROM userRoles WHERE uid=? ORDER BY role"
+	rows, err := db.QueryContext(ctx, stmt, uid)
+	if err != nil {
+		return roles, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return roles, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// Register an OAuth2 client authenticating with a secret. Only a salted hash
+// of the secret is stored.
+func RegisterClient(ctx context.Context, db *sql.DB, clientId, secret string) error {
+	salt := make([]byte, 16, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	return insertClient(ctx, db, Client{
+		clientId, getPwHash(secret, salt), base64.StdEncoding.EncodeToString(salt), "",
+	})
+}
+
+// Register an OAuth2 client authenticating with assertions signed by the
+// private half of the JSON encoded public JWK.
+func RegisterKeyClient(ctx context.Context, db *sql.DB, clientId, publicJwk string) error {
+	return insertClient(ctx, db, Client{clientId, "", "", publicJwk})
+}
+
+func insertClient(ctx context.Context, db *sql.DB, c Client) error {
+	ctx, done := tracing.Query(ctx, "RegisterClient")
+	defer done()
+
+	stmt := "INSERT OR IGNORE INTO clients (clientId, hashedSecret, hashSalt, publicJwk) VALUES(?, ?, ?, ?)"
+	res, err := db.ExecContext(ctx, stmt, c.ClientId, c.HashedSecret, c.HashSalt, c.PublicJwk)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return errorClientExists{c.ClientId}
+	}
+
+	return nil
+}
+
+// Returns true, nil when the client exists, and the given secret hashes to
+// the stored secret hash.
+func VerifyClientSecret(ctx context.Context, db *sql.DB, clientId, secret string) (bool, error) {
+	var hashed, encodedSalt string
+
+	// the query only, not the hashing
+	ctx, queried := tracing.Query(ctx, "VerifyClientSecret")
+	stmt := "SELECT hashedSecret, hashSalt FROM clients WHERE clientId=?"
+	err := db.QueryRowContext(ctx, stmt, clientId).Scan(&hashed, &encodedSalt)
+	queried()
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, errorNoSuchClient{clientId}
+		}
+		return false, err
+	}
+
+	// key clients have no secret
+	if hashed == "" {
+		return false, nil
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return false, err
+	}
+
+	ok := subtle.ConstantTimeCompare([]byte(getPwHash(secret, salt)), []byte(hashed)) == 1
+	return ok, nil
+}
+
+// The JSON encoded public JWK of the client, "" for clients with a secret
+func ClientPublicJwk(ctx context.Context, db *sql.DB, clientId string) (string, error) {
+	ctx, done := tracing.Query(ctx, "ClientPublicJwk")
+	defer done()
+
+	var jwk string
+
+	stmt := "SELECT publicJwk FROM clients WHERE clientId=?"
+	err := db.QueryRowContext(ctx, stmt, clientId).Scan(&jwk)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", errorNoSuchClient{clientId}
+		}
+		return "", err
+	}
+
+	return jwk, nil
+}
+
+// All registered clients, ordered by id
+func ListClients(ctx context.Context, db *sql.DB) ([]Client, error) {
+	ctx, done := tracing.Query(ctx, "ListClients")
+	defer done()
+
+	rows, err := db.QueryContext(ctx, "SELECT clientId, hashedSecret, hashSalt, publicJwk FROM clients ORDER BY clientId")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := make([]Client, 0)
+	for rows.Next() {
+		var c Client
+		if err := rows.Scan(&c.ClientId, &c.HashedSecret, &c.HashSalt, &c.PublicJwk); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+
+	return clients, rows.Err()
+}
+
+// Remove the client, returning ErrNoSuchClient if it was not registered
+func RemoveClient(ctx context.Context, db *sql.DB, clientId string) error {
+	ctx, done := tracing.Query(ctx, "RemoveClient")
+	defer done()
+
+	res, err := db.ExecContext(ctx, "DELETE FROM clients WHERE clientId=?", clientId)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return errorNoSuchClient{clientId}
+	}
+
+	return nil
+}
+
+// Record the use of a client assertion until it expires. Returns true, nil
+// the first time the client uses jti, so that each assertion is good for
+// one request. Expired entries are purged on each call since those
+// assertions are rejected anyway.
+func UseAssertion(ctx context.Context, db *sql.DB, clientId, jti string, exp time.Time) (bool, error) {
+	ctx, done := tracing.Query(ctx, "UseAssertion")
+	defer done()
+
+	stmt := "DELETE FROM usedAssertions WHERE expiration<?"
+	if _, err := db.ExecContext(ctx, stmt, time.Now().Unix()); err != nil {
+		return false, err
+	}
+
+	stmt = "INSERT OR IGNORE INTO usedAssertions (clientId, jti, expiration) VALUES(?, ?, ?)"
+	result, err := db.ExecContext(ctx, stmt, clientId, jti, exp.Unix())
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := result.RowsAffected()
+	return inserted == 1, err
+}
+
+// Add a token id to the deny-list until the token expires. Expired entries
+// are purged on each call since those tokens are rejected anyway.
+func RevokeToken(ctx context.Context, db *sql.DB, jti string, exp time.Time) error {
+	ctx, done := tracing.Query(ctx, "RevokeToken")
+	defer done()
+
+	stmt := "DELETE FROM revokedTokens WHERE expiration<?"
+	if _, err := db.ExecContext(ctx, stmt, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	stmt = "INSERT OR IGNORE INTO revokedTokens (jti, expiration) VALUES(?, ?)"
+	_, err := db.ExecContext(ctx, stmt, jti, exp.Unix())
+	return err
+}
+
+// Return true, nil if the token id is on the deny-list
+func TokenIsRevoked(ctx context.Context, db *sql.DB, jti string) (bool, error) {
+	_, revoked, err := TokenRevokedUntil(ctx, db, jti)
+	return revoked, err
+}
+
+// Return the expiration of the token and true, nil if the token id is on
+// the deny-list
+func TokenRevokedUntil(ctx context.Context, db *sql.DB, jti string) (time.Time, bool, error) {
+	ctx, done := tracing.Query(ctx, "TokenRevokedUntil")
+	defer done()
+
+	var exp int64
+	stmt := "SELECT expiration FROM revokedTokens WHERE jti=?"
+	err := db.QueryRowContext(ctx, stmt, jti).Scan(&exp)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+
+	return time.Unix(exp, 0), true, nil
+}
+
+// DenyList is the jwt.DenyList of the tokens revoked in DB, for audiences
+// running in the same process as the auth server
+type DenyList struct {
+	DB *sql.DB
+}
+
+func (d DenyList) Revoked(ctx context.Context, jti string) (bool, error) {
+	return TokenIsRevoked(ctx, d.DB, jti)
+}
+
 // Load the database if it exists, or create a new one at the given path.
 func Load(fp string) *sql.DB {
 	d, err := sql.Open("sqlite3", fp)
@@ -180,6 +657,40 @@ func Load(fp string) *sql.DB {
 			hashSalt TEXT NOT NULL,
 			refreshToken TEXT NOT NULL
 		);
+		CREATE TABLE IF NOT EXISTS accounts (
+			uid TEXT PRIMARY KEY,
+			username TEXT UNIQUE,
+			disabled INTEGER NOT NULL,
+			created INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS logins (
+			uid TEXT NOT NULL,
+			time INTEGER NOT NULL,
+			success INTEGER NOT NULL,
+			remoteAddr TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS indexLoginsUid ON logins(uid, time);
+		CREATE TABLE IF NOT EXISTS userRoles (
+			uid TEXT NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (uid, role)
+		);
+		CREATE TABLE IF NOT EXISTS clients (
+			clientId TEXT PRIMARY KEY,
+			hashedSecret TEXT NOT NULL,
+			hashSalt TEXT NOT NULL,
+			publicJwk TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS revokedTokens (
+			jti TEXT PRIMARY KEY,
+			expiration INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS usedAssertions (
+			clientId TEXT NOT NULL,
+			jti TEXT NOT NULL,
+			expiration INTEGER NOT NULL,
+			PRIMARY KEY (clientId, jti)
+		);
 	`)
 
 	if err != nil {
@@ -1,16 +1,21 @@
 package database_test
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/rebeljah/gosqueak/jwt"
 	"github.com/rebeljah/gosqueak/services/auth/database"
 )
 
 var db *sql.DB
+var ctx = context.Background()
 
 func TestUserExists(t *testing.T) {
 	username := fmt.Sprintf("%X", rand.Uint32())
@@ -18,7 +23,7 @@ func TestUserExists(t *testing.T) {
 	user := addUserToDb(db, username, password)
 
 	// test logic
-	ok, err := database.UserExists(db, user.Uid)
+	ok, err := database.UserExists(ctx, db, user.Uid)
 	if err != nil {
 		t.Error(err)
 	}
@@ -34,7 +39,7 @@ func TestRegisterUser(t *testing.T) {
 	user := database.NewUser(username, password, []byte(username+password))
 
 	err := database.RegisterUser(
-		db, username, password,
+		ctx, db, username, password,
 	)
 
 	if err != nil {
@@ -56,7 +61,7 @@ func TestVerifyPassword(t *testing.T) {
 	password := fmt.Sprintf("%X", rand.Uint32())
 	addUserToDb(db, username, password)
 
-	ok, err := database.VerifyPassword(db, username, password)
+	ok, err := database.VerifyPassword(ctx, db, username, password)
 	if err != nil {
 		t.Error(err)
 	}
@@ -69,7 +74,7 @@ func TestVerifyPassword(t *testing.T) {
 func TestVerifyPasswordFails(t *testing.T) {
 	addUserToDb(db, "user", "pass")
 
-	ok, err := database.VerifyPassword(db, "user", "wrongpass")
+	ok, err := database.VerifyPassword(ctx, db, "user", "wrongpass")
 	if err != nil {
 		t.Error(err)
 	}
@@ -86,7 +91,7 @@ func TestUserHasRefreshToken(t *testing.T) {
 	`
 	db.Exec(stmt)
 
-	ok, err := database.UserHasRefreshToken(db, "123", "token")
+	ok, err := database.UserHasRefreshToken(ctx, db, "123", "token")
 	if err != nil {
 		t.Error(err)
 	}
@@ -96,6 +101,192 @@ func TestUserHasRefreshToken(t *testing.T) {
 	}
 }
 
+func TestUseAssertion(t *testing.T) {
+	jti := fmt.Sprintf("%X", rand.Uint32())
+	exp := time.Now().Add(time.Minute)
+
+	for i, want := range []bool{true, false} {
+		ok, err := database.UseAssertion(ctx, db, "client", jti, exp)
+		if err != nil || ok != want {
+			t.Fatalf("use %v: got %v, %v", i, ok, err)
+		}
+	}
+
+	// ids are per client, and are not token ids
+	ok, err := database.UseAssertion(ctx, db, "other", jti, exp)
+	if err != nil || !ok {
+		t.Fatalf("id of another client: got %v, %v", ok, err)
+	}
+
+	if revoked, err := database.TokenIsRevoked(ctx, db, jti); err != nil || revoked {
+		t.Fatal("assertion id on the deny-list")
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	jti := fmt.Sprintf("%X", rand.Uint32())
+
+	exp := time.Now().Add(time.Minute).Truncate(time.Second)
+	err := database.RevokeToken(ctx, db, jti, exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	until, ok, err := database.TokenRevokedUntil(ctx, db, jti)
+	if err != nil || !ok || !until.Equal(exp) {
+		t.Fatalf("got %v, %v, %v", until, ok, err)
+	}
+
+	ok, err = database.TokenIsRevoked(ctx, db, jti)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ok {
+		t.FailNow()
+	}
+
+	ok, err = database.TokenIsRevoked(ctx, db, "not"+jti)
+	if err != nil || ok {
+		t.FailNow()
+	}
+
+	// the same answers for in-process audiences
+	var deny jwt.DenyList = database.DenyList{DB: db}
+	if ok, err = deny.Revoked(ctx, jti); err != nil || !ok {
+		t.Fatal("revoked token not denied")
+	}
+}
+
+func TestRoles(t *testing.T) {
+	username := fmt.Sprintf("%X", rand.Uint32())
+	addUserToDb(db, username, "password")
+	uid := database.GetUidFor(username)
+
+	database.GrantRole(ctx, db, uid, "b")
+	database.GrantRole(ctx, db, uid, "a")
+	database.GrantRole(ctx, db, uid, "a")
+
+	roles, err := database.UserRoles(ctx, db, uid)
+	if err != nil || len(roles) != 2 || roles[0] != "a" {
+		t.Fatalf("bad roles %v: %v", roles, err)
+	}
+
+	database.RevokeRole(ctx, db, uid, "a")
+	roles, _ = database.UserRoles(ctx, db, uid)
+	if len(roles) != 1 || roles[0] != "b" {
+		t.Fatalf("role not revoked: %v", roles)
+	}
+
+	if err := database.GrantRole(ctx, db, "nobody", "a"); !errors.As(err, &database.ErrNoSuchUser) {
+		t.Fatalf("expected ErrNoSuchUser, got %v", err)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	username := fmt.Sprintf("account%X", rand.Uint32())
+	if err := database.RegisterUser(ctx, db, username, "password"); err != nil {
+		t.Fatal(err)
+	}
+	uid := database.GetUidFor(username)
+
+	accounts, err := database.ListUsers(ctx, db, username[2:], 10, 0)
+	if err != nil || len(accounts) != 1 || accounts[0].Uid != uid || accounts[0].Username != username {
+		t.Fatalf("user not found: %v %v", accounts, err)
+	}
+
+	database.SetRefreshToken(ctx, db, "token", uid)
+	if err := database.SetUserDisabled(ctx, db, uid, true); err != nil {
+		t.Fatal(err)
+	}
+
+	disabled, _ := database.UserIsDisabled(ctx, db, uid)
+	ok, _ := database.UserHasRefreshToken(ctx, db, uid, "token")
+	if !disabled || ok {
+		t.Fatal("disabled user kept refresh token")
+	}
+
+	database.SetUserDisabled(ctx, db, uid, false)
+	if disabled, _ := database.UserIsDisabled(ctx, db, uid); disabled {
+		t.Fatal("user not enabled")
+	}
+
+	if err := database.ResetPassword(ctx, db, uid, "newpassword"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := database.VerifyPassword(ctx, db, username, "newpassword"); !ok {
+		t.Fatal("password not reset")
+	}
+}
+
+func TestLoginHistory(t *testing.T) {
+	database.RecordLogin(ctx, db, "historyuid", false, "1.2.3.4:1")
+	database.RecordLogin(ctx, db, "historyuid", true, "1.2.3.4:2")
+
+	logins, err := database.LoginHistory(ctx, db, "historyuid", 10)
+	if err != nil || len(logins) != 2 {
+		t.Fatalf("bad history %v: %v", logins, err)
+	}
+
+	if !logins[0].Success || logins[0].RemoteAddr != "1.2.3.4:2" {
+		t.Fatalf("history not newest first: %v", logins)
+	}
+}
+
+func TestRegisterClient(t *testing.T) {
+	err := database.RegisterClient(ctx, db, "client", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = database.RegisterClient(ctx, db, "client", "secret")
+	if !errors.As(err, &database.ErrClientExists) {
+		t.Fatalf("expected ErrClientExists, got %v", err)
+	}
+
+	ok, err := database.VerifyClientSecret(ctx, db, "client", "secret")
+	if err != nil || !ok {
+		t.Fatal("secret not verified", err)
+	}
+
+	ok, err = database.VerifyClientSecret(ctx, db, "client", "wrong")
+	if err != nil || ok {
+		t.Fatal("wrong secret verified", err)
+	}
+}
+
+func TestRegisterKeyClient(t *testing.T) {
+	err := database.RegisterKeyClient(ctx, db, "keyclient", `{"kty":"OKP"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwk, err := database.ClientPublicJwk(ctx, db, "keyclient")
+	if err != nil || jwk != `{"kty":"OKP"}` {
+		t.Fatalf("bad jwk %q: %v", jwk, err)
+	}
+
+	// a key client can't authenticate with an empty secret
+	ok, err := database.VerifyClientSecret(ctx, db, "keyclient", "")
+	if err != nil || ok {
+		t.Fatal("key client verified without key", err)
+	}
+
+	clients, err := database.ListClients(ctx, db)
+	if err != nil || len(clients) == 0 {
+		t.Fatal("no clients listed", err)
+	}
+
+	if err := database.RemoveClient(ctx, db, "keyclient"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = database.ClientPublicJwk(ctx, db, "keyclient")
+	if !errors.As(err, &database.ErrNoSuchClient) {
+		t.Fatalf("expected ErrNoSuchClient, got %v", err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	setup()
 	code := m.Run()
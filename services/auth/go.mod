@@ -1,9 +1,11 @@
 module github.com/rebeljah/gosqueak/services/auth
 
-go 1.18
+go 1.22
 
 require (
 	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/prometheus/client_golang v1.22.0
 	github.com/rebeljah/gosqueak/jwt v0.0.0-20221127072339-9b02ece67523
+	github.com/rebeljah/gosqueak/kit v0.0.0-00010101000000-000000000000
 	golang.org/x/crypto v0.3.0
 )
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/rebeljah/gosqueak/services/message/database"
+)
+
+// DELETE ?uid=<uid>: delete every prekey of the user, for when the keys of
+// an account are compromised or abused.
+func (s *Server) handleAdminPreKeys(w http.ResponseWriter, r *http.Request) {
+	s.handleAdminDelete(w, r, func(ctx context.Context, db *sql.DB, uid string) (int64, error) {
+		n, err := database.DeletePreKeys(ctx, db, uid)
+		preKeys.Sub(float64(n))
+		return n, err
+	})
+}
+
+// DELETE ?uid=<uid>: delete every stored message for the user.
+func (s *Server) handleAdminMessages(w http.ResponseWriter, r *http.Request) {
+	s.handleAdminDelete(w, r, database.DeleteMessages)
+}
+
+// Responds with {"uid": <uid>, "deleted": <count>}
+func (s *Server) handleAdminDelete(
+	w http.ResponseWriter, r *http.Request, del func(context.Context, *sql.DB, string) (int64, error),
+) {
+	uid := r.URL.Query().Get("uid")
+	if uid == "" {
+		errBadRequest(w)
+		return
+	}
+
+	n, err := del(r.Context(), s.db, uid)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(struct {
+		Uid     string `json:"uid"`
+		Deleted int64  `json:"deleted"`
+	}{uid, n})
+	if err != nil {
+		errInternal(w)
+	}
+}
@@ -1,17 +1,34 @@
 package api
 
 import (
+	"bufio"
 	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 
 	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/kit/health"
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/kit/metrics"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/server"
+	"github.com/rebeljah/gosqueak/kit/tracing"
 	"github.com/rebeljah/gosqueak/services/message/chat"
 	"github.com/rebeljah/gosqueak/services/message/database"
 )
 
+// scopes required by the routes, see RequireScope
+const (
+	ScopePreKeys  = "prekeys"
+	ScopeMessages = "messages"
+	ScopeRelay    = "relay"
+)
+
 type HandlerFunction func(http.ResponseWriter, *http.Request)
 
 // http errors
@@ -28,174 +45,320 @@ func errBadRequest(w http.ResponseWriter) {
 }
 
 type Server struct {
+	*server.Server
 	db          *sql.DB
-	addr        string
 	jwtAudience jwt.Audience
-	msgRelay    chat.Relay
+	jwtDenyList jwt.DenyList
+	msgRelay    *chat.Relay
+	mux         *http.ServeMux
+	ready       *health.Checker
 }
 
-func NewServer(addr string, db *sql.DB, aud jwt.Audience, msgRelay chat.Relay) *Server {
-	return &Server{db, addr, aud, msgRelay}
+func NewServer(addr string, db *sql.DB, aud jwt.Audience, deny jwt.DenyList, msgRelay *chat.Relay) *Server {
+	s := &Server{
+		db:          db,
+		jwtAudience: aud,
+		jwtDenyList: deny,
+		msgRelay:    msgRelay,
+		mux:         http.NewServeMux(),
+	}
+	s.Server = server.New(addr, s.mux)
+	// the relay socket hijacks the connection of GET /ws
+	s.DisableHTTP2()
+	// once the requests are served, relay users are disconnected, the
+	// messages they sent are delivered or stored, and the database is
+	// closed; hijacked relay connections are not tracked by the http.Server
+	s.OnShutdown(func(ctx context.Context) error { return msgRelay.Shutdown(ctx, chat.CloseShutdown) })
+	s.OnShutdown(func(context.Context) error { return db.Close() })
+	s.Mount(s.mux)
+
+	s.ready = &health.Checker{}
+	s.ready.Add("messages_db", db.PingContext)
+	s.ready.Add("relay", func(context.Context) error {
+		if !msgRelay.Running() {
+			return fmt.Errorf("relay is not running")
+		}
+		return nil
+	})
+
+	s.mux.Handle("GET /metrics", metrics.Handler())
+	s.mux.HandleFunc("GET /healthz", health.Live)
+	s.mux.Handle("GET /readyz", s.ready)
+
+	n, err := database.CountPreKeys(context.Background(), db)
+	if err != nil {
+		slog.Error("could not count prekeys", "err", err)
+	}
+	preKeys.Set(float64(n))
+
+	return s
 }
 
-func (s *Server) ConfigureRoutes() {
-	http.HandleFunc("/prekeys", Log(JwtMiddleware(s, s.handlePreKey)))
-	http.HandleFunc("/messages", Log(JwtMiddleware(s, s.handleMessage)))
-	http.HandleFunc("/ws", Log(JwtMiddleware(s, s.upgradeConnection)))
+// Mount registers the routes of the server on mux. The routes of the auth
+// and message servers don't overlap, so both can be mounted on one mux.
+//
+// The /metrics, /healthz and /readyz endpoints are not routes of the
+// server, so that a mux shared with the auth server has only one each.
+func (s *Server) Mount(mux *http.ServeMux) {
+
+	// prekeys are one-time use and identify users, so revoked tokens must
+	// not be able to touch them before they expire
+	s.Handle(mux, "GET /prekeys", JwtMiddleware(s, RequireScope(ScopePreKeys, NotRevokedMiddleware(s, s.handleGetPreKey))))
+	s.Handle(mux, "POST /prekeys", JwtMiddleware(s, RequireScope(ScopePreKeys, NotRevokedMiddleware(s, s.handlePostPreKeys))))
+	s.Handle(mux, "GET /messages", JwtMiddleware(s, RequireScope(ScopeMessages, s.handleGetMessages)))
+	s.Handle(mux, "POST /messages", JwtMiddleware(s, RequireScope(ScopeMessages, s.handlePostMessages)))
+	s.Handle(mux, "GET /ws", JwtMiddleware(s, RequireScope(ScopeRelay, s.upgradeConnection)))
+
+	// moderation
+	s.Handle(mux, "DELETE /admin/prekeys", JwtMiddleware(s, RequireRole(jwt.RoleAdmin, NotRevokedMiddleware(s, s.handleAdminPreKeys))))
+	s.Handle(mux, "DELETE /admin/messages", JwtMiddleware(s, RequireRole(jwt.RoleAdmin, NotRevokedMiddleware(s, s.handleAdminMessages))))
 }
 
-func (s *Server) Run() {
-	s.ConfigureRoutes()
-	// start serving
-	log.Fatal(http.ListenAndServe(s.addr, nil))
+// The readiness checks served on /readyz, to which the dependencies of the
+// server that it doesn't own, such as the key set of the auth server, are
+// added
+func (s *Server) Ready() *health.Checker {
+	return s.ready
 }
 
-// GET: look for the uid in query parameters and respond with
-// one of the requested users stored public keys.
-//
-// POST: read uid and keys from request body, then store the keys in the DB.
-func (s *Server) handlePreKey(w http.ResponseWriter, r *http.Request) {
-	jToken := r.Context().Value("jwt").(jwt.Jwt)
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
 
-	switch r.Method {
-	case http.MethodGet:
-		uid := r.URL.Query().Get("fromUid")
+// GET ?fromUid=<uid>: respond with one of the stored public keys of the
+// user, which is then deleted.
+func (s *Server) handleGetPreKey(w http.ResponseWriter, r *http.Request) {
+	uid := r.URL.Query().Get("fromUid")
 
-		if uid == "" {
-			errBadRequest(w)
-			return
-		}
+	if uid == "" {
+		errBadRequest(w)
+		return
+	}
 
-		preKey, err := database.GetPreKey(s.db, uid)
+	// the subjects taking the prekeys of a user share a limit
+	if !ratelimit.Target(w, r, uid) {
+		return
+	}
 
-		if err != nil {
-			errInternal(w)
-			return
-		}
+	preKey, err := database.GetPreKey(r.Context(), s.db, uid)
 
-		body, err := json.Marshal(preKey)
+	if err != nil {
+		errInternal(w)
+		return
+	}
+	preKeys.Dec()
 
-		if err != nil {
-			errInternal(w)
-			return
-		}
+	body, err := json.Marshal(preKey)
 
-		_, err = w.Write(body)
+	if err != nil {
+		errInternal(w)
+		return
+	}
 
-		if err != nil {
-			errInternal(w)
-		}
+	_, err = w.Write(body)
 
-	case http.MethodPost:
-		var body []database.PreKey
+	if err != nil {
+		errInternal(w)
+	}
+}
 
-		decoder := json.NewDecoder(r.Body)
-		err := decoder.Decode(&body)
+// POST: read uid and keys from request body, then store the keys in the DB.
+func (s *Server) handlePostPreKeys(w http.ResponseWriter, r *http.Request) {
+	jToken := r.Context().Value("jwt").(jwt.Jwt)
 
-		if err != nil {
-			errBadRequest(w)
-			return
-		}
+	var body []database.PreKey
 
-		// client must send at least one prekey
-		if len(body) < 1 {
-			errBadRequest(w)
-			return
-		}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
 
-		// prevent adding keys for other users
-		if body[0].FromUid != jToken.Body.Subject {
-			errStatusUnauthorized(w)
-			return
-		}
+	if err != nil {
+		errBadRequest(w)
+		return
+	}
 
-		err = database.PostPreKeys(s.db, body)
+	// client must send at least one prekey
+	if len(body) < 1 {
+		errBadRequest(w)
+		return
+	}
 
-		if err != nil {
-			errInternal(w)
-		}
+	// prevent adding keys for other users
+	if body[0].FromUid != jToken.Body.Subject {
+		errStatusUnauthorized(w)
 		return
+	}
+
+	err = database.PostPreKeys(r.Context(), s.db, body)
 
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	if err != nil {
+		errInternal(w)
+		return
 	}
+	preKeys.Add(float64(len(body)))
 }
 
-func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
+// GET: respond with the messages stored for the subject of the token
+func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	jToken := r.Context().Value("jwt").(jwt.Jwt)
 
-	switch r.Method {
-	case http.MethodGet:
-		// user posseses JWT, so should be allowed to get messages for jwt sub
-		body, err := database.GetMessages(s.db, jToken.Body.Subject)
-
-		if err != nil {
-			errInternal(w)
-			return
-		}
-		err = json.NewEncoder(w).Encode(body)
+	// user posseses JWT, so should be allowed to get messages for jwt sub
+	body, err := database.GetMessages(r.Context(), s.db, jToken.Body.Subject)
 
-		if err != nil {
-			errInternal(w)
-		}
+	if err != nil {
+		errInternal(w)
+		return
+	}
+	err = json.NewEncoder(w).Encode(body)
 
-	case http.MethodPost:
-		var body []database.Message
+	if err != nil {
+		errInternal(w)
+	}
+}
 
-		decoder := json.NewDecoder(r.Body)
-		err := decoder.Decode(&body)
+// POST: store the messages of the body for their recipients
+func (s *Server) handlePostMessages(w http.ResponseWriter, r *http.Request) {
+	var body []database.Message
 
-		if err != nil {
-			errBadRequest(w)
-			return
-		}
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&body)
 
-		if len(body) < 1 {
-			errBadRequest(w)
-			return
-		}
+	if err != nil {
+		errBadRequest(w)
+		return
+	}
 
-		err = database.PostMessages(s.db, body...)
+	if len(body) < 1 {
+		errBadRequest(w)
+		return
+	}
 
-		if err != nil {
-			errInternal(w)
-		}
+	err = database.PostMessages(r.Context(), s.db, body...)
 
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	if err != nil {
+		errInternal(w)
+		return
 	}
+	chat.CountStored(len(body))
 }
 
 func (s *Server) upgradeConnection(w http.ResponseWriter, r *http.Request) {
 	jToken := r.Context().Value("jwt").(jwt.Jwt)
 
-	conn, _, err := w.(http.Hijacker).Hijack()
+	// HTTP/2 connections can't be hijacked, the server only serves
+	// HTTP/1.1, see server.Server.DisableHTTP2
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "the relay needs HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	conn, rw, err := h.Hijack()
+	if errors.Is(err, http.ErrNotSupported) {
+		http.Error(w, "the relay needs HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
 	if err != nil {
 		errInternal(w)
 		return
 	}
 
+	// the client may have sent messages along with the request
+	if rw.Reader.Buffered() > 0 {
+		conn = bufferedConn{conn, rw.Reader}
+	}
+
 	s.msgRelay.AddUserConnection(jToken.Body.Subject, conn)
 }
 
+// A hijacked connection whose reads start with the bytes the server read
+// past the request
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 func JwtMiddleware(s *Server, handler HandlerFunction) HandlerFunction {
 	return func(w http.ResponseWriter, r *http.Request) {
-		j, err := jwt.FromString(r.Header.Get("Authorization"))
+		ctx, span := tracing.Start(r.Context(), "JwtMiddleware")
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		j, err := jwt.FromString(jwt.BearerToken(r))
 
 		if err != nil || !s.jwtAudience.JwtIsValid(j) || j.Expired() {
 			errStatusUnauthorized(w)
 			return
 		}
 
+		logging.SetSubject(r.Context(), j.Body.Subject)
+		if !ratelimit.Subject(w, r, j.Body.Subject) {
+			return
+		}
+
 		// Add JWT as context to the request.
 		r = r.WithContext(context.WithValue(r.Context(), "jwt", j))
 		handler(w, r)
 	}
 }
 
-func Log(handler HandlerFunction) HandlerFunction {
+// Rejects tokens that were not granted the scope, with the RFC 6750
+// insufficient_scope error. Must run after JwtMiddleware.
+func RequireScope(scope string, handler HandlerFunction) HandlerFunction {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[%v] - %v\n", r.Method, r.URL.String())
+		j := r.Context().Value("jwt").(jwt.Jwt)
+
+		if !j.Body.HasScope(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%v"`, scope))
+			http.Error(w, "missing scope: "+scope, http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Rejects tokens whose subject does not have the role. Must run after
+// JwtMiddleware.
+func RequireRole(role string, handler HandlerFunction) HandlerFunction {
+	return func(w http.ResponseWriter, r *http.Request) {
+		j := r.Context().Value("jwt").(jwt.Jwt)
+
+		if !j.Body.HasRole(role) {
+			http.Error(w, "missing role: "+role, http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Rejects tokens that were revoked before their expiry. Only for high risk
+// handlers, as each request costs a round trip to the auth server. Must run
+// after JwtMiddleware.
+func NotRevokedMiddleware(s *Server, handler HandlerFunction) HandlerFunction {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), "NotRevokedMiddleware")
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		j := r.Context().Value("jwt").(jwt.Jwt)
+
+		revoked, err := s.jwtDenyList.Revoked(r.Context(), j.Body.JwtId)
+		if err != nil {
+			// fail closed, the token can't be trusted without the check
+			http.Error(w, "could not check token revocation", http.StatusServiceUnavailable)
+			return
+		}
+
+		if revoked {
+			errStatusUnauthorized(w)
+			return
+		}
+
 		handler(w, r)
 	}
 }
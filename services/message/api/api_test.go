@@ -2,24 +2,34 @@ package api_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/rebeljah/gosqueak/jwt"
 	"github.com/rebeljah/gosqueak/jwt/rs256"
+	"github.com/rebeljah/gosqueak/kit/certs"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
 	"github.com/rebeljah/gosqueak/services/message/api"
 	"github.com/rebeljah/gosqueak/services/message/chat"
 	"github.com/rebeljah/gosqueak/services/message/database"
 )
 
 const (
-	ApiAddr         = "127.0.0.1:8082"
-	JwtActorName    = "MESSAGE_API"
+	ApiAddr      = "127.0.0.1:8082"
+	JwtActorName = "MESSAGE_API"
+	// scopes granted to the tokens of users
+	UserScopes = api.ScopePreKeys + " " + api.ScopeMessages + " " + api.ScopeRelay
 )
 
 var db *sql.DB
@@ -34,25 +44,33 @@ var jTokenPoster jwt.Jwt
 var uidGetter string
 var jTokenGetter jwt.Jwt
 
+// mock of the auth server deny-list
+type mockDenyList map[string]bool
+
+func (d mockDenyList) Revoked(ctx context.Context, jti string) (bool, error) {
+	return d[jti], nil
+}
+
+var denyList = mockDenyList{}
+
 func TestMain(m *testing.M) {
 	// mock auth server by creating a jwt issuer
-	keyPriv := rs256.GeneratePrivateKey()
-	iss = jwt.NewIssuer(keyPriv, "AUTHSERV")
-	aud = jwt.NewAudience(&keyPriv.PublicKey, JwtActorName)
+	keyPriv := rs256.MustGeneratePrivateKey()
+	iss = jwt.NewIssuer(rs256.NewSigner(keyPriv), "AUTHSERV")
+	aud = jwt.NewAudience(rs256.NewVerifier(&keyPriv.PublicKey), JwtActorName)
 
 	db = database.Load("data_test.sqlite")
 	defer db.Close()
 
 	// make some "users"
 	uidPoster = "test_uid1"
-	jTokenPoster = iss.MintToken(uidPoster, JwtActorName, time.Second*10)
+	jTokenPoster = mintUserToken(uidPoster)
 
 	uidGetter = "test_uid2"
-	jTokenGetter = iss.MintToken(uidGetter, JwtActorName, time.Second*10)
+	jTokenGetter = mintUserToken(uidGetter)
 
 	// configure server
-	serv = api.NewServer(ApiAddr, db, aud, chat.NewRelay(db))
-	serv.ConfigureRoutes()
+	serv = api.NewServer(ApiAddr, db, aud, denyList, chat.NewRelay(db))
 
 	m.Run()
 
@@ -60,10 +78,16 @@ func TestMain(m *testing.M) {
 	os.Remove("data_test.sqlite")
 }
 
+func mintUserToken(uid string) jwt.Jwt {
+	j := iss.MintToken(uid, JwtActorName, time.Second*10)
+	j.Body.Scope = UserScopes
+	return j
+}
+
 func TestPostPreKey(t *testing.T) {
 	expectedKeys := []database.PreKey{
-		{uidPoster, "pk1", "id1"},
-		{uidPoster, "pk2", "id2"},
+		{FromUid: uidPoster, Key: "pk1", KeyId: "id1"},
+		{FromUid: uidPoster, Key: "pk2", KeyId: "id2"},
 	}
 
 	// make post body
@@ -76,8 +100,8 @@ func TestPostPreKey(t *testing.T) {
 	bodyBuf := bytes.NewBuffer(b)
 	request := httptest.NewRequest("POST", "/prekeys", bodyBuf)
 	recorder := httptest.NewRecorder()
-	request.Header.Set("Authorization", iss.StringifyJwt(jTokenPoster))
-	http.DefaultServeMux.ServeHTTP(recorder, request)
+	request.Header.Set("Authorization", iss.MustStringifyJwt(jTokenPoster))
+	serv.ServeHTTP(recorder, request)
 
 	if recorder.Result().StatusCode != http.StatusOK {
 		t.Fatalf("Not OK")
@@ -114,8 +138,8 @@ func TestGetPreKey(t *testing.T) {
 	recorder := httptest.NewRecorder()
 
 	request := httptest.NewRequest("GET", "/prekeys?fromUid="+"123", nil)
-	request.Header.Set("Authorization", iss.StringifyJwt(jTokenGetter))
-	http.DefaultServeMux.ServeHTTP(recorder, request)
+	request.Header.Set("Authorization", iss.MustStringifyJwt(jTokenGetter))
+	serv.ServeHTTP(recorder, request)
 
 	if recorder.Result().StatusCode != http.StatusOK {
 		t.Fatalf("Not OK response")
@@ -147,10 +171,10 @@ func TestPostMessages(t *testing.T) {
 	}
 
 	request := httptest.NewRequest("POST", "/messages", bytes.NewBuffer(jsonD))
-	request.Header.Add("Authorization", iss.StringifyJwt(jTokenPoster))
+	request.Header.Add("Authorization", iss.MustStringifyJwt(jTokenPoster))
 	recorder := httptest.NewRecorder()
 
-	http.DefaultServeMux.ServeHTTP(recorder, request)
+	serv.ServeHTTP(recorder, request)
 
 	if recorder.Result().StatusCode != http.StatusOK {
 		t.FailNow()
@@ -195,13 +219,13 @@ func TestGetMessages(t *testing.T) {
 			KeyId:   "7",
 		},
 	}
-	database.PostMessages(db, messages...)
+	database.PostMessages(context.Background(), db, messages...)
 
 	var body []database.Message
 	request := httptest.NewRequest("GET", "/messages", nil)
-	request.Header.Add("Authorization", iss.StringifyJwt(jTokenGetter))
+	request.Header.Add("Authorization", iss.MustStringifyJwt(jTokenGetter))
 	recorder := httptest.NewRecorder()
-	http.DefaultServeMux.ServeHTTP(recorder, request)
+	serv.ServeHTTP(recorder, request)
 
 	if recorder.Result().StatusCode != http.StatusOK {
 		t.Log("fail: Status not OK")
@@ -225,3 +249,319 @@ func TestGetMessages(t *testing.T) {
 		}
 	}
 }
+
+func TestRevokedTokenCantGetPreKey(t *testing.T) {
+	revoked := mintUserToken(uidGetter)
+	denyList[revoked.Body.JwtId] = true
+
+	request := httptest.NewRequest("GET", "/prekeys?fromUid="+uidPoster, nil)
+	request.Header.Set("Authorization", iss.MustStringifyJwt(revoked))
+	recorder := httptest.NewRecorder()
+	serv.ServeHTTP(recorder, request)
+
+	if recorder.Result().StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked token got status %v", recorder.Result().StatusCode)
+	}
+}
+
+func TestRefreshTokenCantGetPreKey(t *testing.T) {
+	refresh := mintUserToken(uidGetter)
+	refresh.Header.Type = jwt.TypRefresh
+
+	request := httptest.NewRequest("GET", "/prekeys?fromUid="+uidPoster, nil)
+	request.Header.Set("Authorization", iss.MustStringifyJwt(refresh))
+	recorder := httptest.NewRecorder()
+	serv.ServeHTTP(recorder, request)
+
+	if recorder.Result().StatusCode != http.StatusUnauthorized {
+		t.Fatalf("refresh token got status %v", recorder.Result().StatusCode)
+	}
+}
+
+func TestScopeRequired(t *testing.T) {
+	j := mintUserToken(uidGetter)
+	j.Body.Scope = api.ScopePreKeys
+
+	request := httptest.NewRequest("GET", "/messages", nil)
+	request.Header.Set("Authorization", iss.MustStringifyJwt(j))
+	recorder := httptest.NewRecorder()
+	serv.ServeHTTP(recorder, request)
+
+	if recorder.Result().StatusCode != http.StatusForbidden {
+		t.Fatalf("token without scope got status %v", recorder.Result().StatusCode)
+	}
+
+	if recorder.Result().Header.Get("WWW-Authenticate") == "" {
+		t.Fatal("missing WWW-Authenticate header")
+	}
+}
+
+func TestAdminDeletePreKeys(t *testing.T) {
+	database.PostPreKeys(context.Background(), db, []database.PreKey{{FromUid: "abuser", Key: "abusekey", KeyId: "abuse1"}})
+
+	admin := mintUserToken(uidGetter)
+	admin.Body.Roles = []string{jwt.RoleAdmin}
+
+	for _, c := range []struct {
+		token  jwt.Jwt
+		status int
+	}{
+		{jTokenGetter, http.StatusForbidden},
+		{admin, http.StatusOK},
+	} {
+		request := httptest.NewRequest("DELETE", "/admin/prekeys?uid=abuser", nil)
+		request.Header.Set("Authorization", iss.MustStringifyJwt(c.token))
+		recorder := httptest.NewRecorder()
+		serv.ServeHTTP(recorder, request)
+
+		if recorder.Result().StatusCode != c.status {
+			t.Fatalf("expected %v, got %v", c.status, recorder.Result().StatusCode)
+		}
+	}
+
+	if _, err := database.GetPreKey(context.Background(), db, "abuser"); err == nil {
+		t.Fatal("prekeys not deleted")
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	// a second server in the same process must not clash with the first
+	other := api.NewServer(ApiAddr, db, aud, denyList, chat.NewRelay(db))
+
+	mux := http.NewServeMux()
+	other.Mount(mux)
+
+	for _, handler := range []http.Handler{other, mux} {
+		request := httptest.NewRequest("GET", "/messages", nil)
+		request.Header.Set("Authorization", iss.MustStringifyJwt(jTokenGetter))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Result().StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %v", recorder.Result().StatusCode)
+		}
+	}
+
+	// methods are routed by the mux
+	request := httptest.NewRequest("PUT", "/messages", nil)
+	recorder := httptest.NewRecorder()
+	other.ServeHTTP(recorder, request)
+
+	if recorder.Result().StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %v", recorder.Result().StatusCode)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	other := api.NewServer(ApiAddr, db, aud, denyList, chat.NewRelay(db))
+	other.UseRateLimits(ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Routes{
+		"GET /messages": {Subject: ratelimit.Limit{Burst: 1, Every: time.Minute}},
+	}))
+
+	getMessages := func(token jwt.Jwt) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/messages", nil)
+		request.Header.Set("Authorization", iss.MustStringifyJwt(token))
+		recorder := httptest.NewRecorder()
+		other.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if code := getMessages(jTokenGetter).Code; code != http.StatusOK {
+		t.Fatalf("first request got %v", code)
+	}
+
+	recorder := getMessages(jTokenGetter)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "60" {
+		t.Fatalf("request over the limit got %v, Retry-After %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+
+	// the limit is per subject, not per client address
+	if code := getMessages(jTokenPoster).Code; code != http.StatusOK {
+		t.Fatalf("request of another subject got %v", code)
+	}
+}
+
+func TestPreKeyTargetRateLimit(t *testing.T) {
+	other := api.NewServer(ApiAddr, db, aud, denyList, chat.NewRelay(db))
+	other.UseRateLimits(ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Routes{
+		"GET /prekeys": {Target: ratelimit.Limit{Burst: 1, Every: time.Minute}},
+	}))
+
+	getPreKey := func(token jwt.Jwt, fromUid string) int {
+		request := httptest.NewRequest("GET", "/prekeys?fromUid="+fromUid, nil)
+		request.Header.Set("Authorization", iss.MustStringifyJwt(token))
+		recorder := httptest.NewRecorder()
+		other.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	if code := getPreKey(jTokenGetter, "target_uid"); code == http.StatusTooManyRequests {
+		t.Fatalf("first request got %v", code)
+	}
+
+	// the limit is per target, whoever takes the prekeys
+	if code := getPreKey(jTokenPoster, "target_uid"); code != http.StatusTooManyRequests {
+		t.Fatalf("request of another subject for the same target got %v", code)
+	}
+
+	if code := getPreKey(jTokenPoster, "other_target_uid"); code == http.StatusTooManyRequests {
+		t.Fatalf("request for another target got %v", code)
+	}
+}
+
+// The value of the sample of the /metrics exposition, -1 when missing
+func metric(t *testing.T, sample string) float64 {
+	recorder := httptest.NewRecorder()
+	serv.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, sample+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return -1
+}
+
+func TestMetrics(t *testing.T) {
+	before := metric(t, "gosqueak_prekeys")
+
+	b, _ := json.Marshal([]database.PreKey{
+		{FromUid: uidPoster, Key: "metrics1", KeyId: "metrics1"},
+		{FromUid: uidPoster, Key: "metrics2", KeyId: "metrics2"},
+	})
+	request := httptest.NewRequest("POST", "/prekeys", bytes.NewReader(b))
+	request.Header.Set("Authorization", iss.MustStringifyJwt(jTokenPoster))
+	serv.ServeHTTP(httptest.NewRecorder(), request)
+
+	if after := metric(t, "gosqueak_prekeys"); after != before+2 {
+		t.Fatalf("prekey inventory went from %v to %v", before, after)
+	}
+
+	if metric(t, `gosqueak_messages_total{delivery="stored"}`) < 1 {
+		t.Fatal("stored messages not counted")
+	}
+
+	sample := `gosqueak_http_request_duration_seconds_count{code="200",method="post",route="/prekeys"}`
+	if metric(t, sample) < 1 {
+		t.Fatalf("%v missing", sample)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	relay := chat.NewRelay(db)
+	other := api.NewServer(ApiAddr, db, aud, denyList, relay)
+
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/healthz", http.StatusOK},
+		{"/readyz", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		other.ServeHTTP(recorder, httptest.NewRequest("GET", c.path, nil))
+		if recorder.Result().StatusCode != c.status {
+			t.Fatalf("%v: expected %v, got %v: %v", c.path, c.status, recorder.Result().StatusCode, recorder.Body)
+		}
+	}
+
+	// not ready once the relay stopped
+	relay.Shutdown(context.Background(), chat.CloseShutdown)
+
+	recorder := httptest.NewRecorder()
+	other.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	var body struct {
+		Checks map[string]struct{ Status string }
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+
+	if recorder.Result().StatusCode != http.StatusServiceUnavailable || body.Checks["relay"].Status != "fail" {
+		t.Fatalf("ready without relay: %v", recorder.Body)
+	}
+}
+
+func TestRelayOverTLS(t *testing.T) {
+	// the relay database is closed with the server
+	relayDb := database.Load("relay_test.sqlite")
+	defer os.Remove("relay_test.sqlite")
+
+	// a free port for the server to listen on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	certPEM, keyPEM, err := certs.SelfSigned("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := api.NewServer(addr, relayDb, aud, denyList, chat.NewRelay(relayDb))
+	other.UseTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+
+	errs := make(chan error, 1)
+	go func() { errs <- other.ListenAndServe() }()
+	defer func() {
+		if err := other.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+
+	var conn *tls.Conn
+	for i := 0; i < 50; i++ {
+		// offering HTTP/2 as browsers and http.Transport do
+		conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto == "h2" {
+		t.Fatal("HTTP/2 negotiated, the connection can't be hijacked")
+	}
+
+	request := httptest.NewRequest("GET", "/ws", nil)
+	request.Host = addr
+	request.Header.Set("Authorization", iss.MustStringifyJwt(jTokenGetter))
+	if err := request.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// the socket relays a message to its own user, sent along with the
+	// request
+	sent := database.Message{ToUid: uidGetter, Private: "ciphertext", KeyId: "id1"}
+	if err := json.NewEncoder(conn).Encode(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var received database.Message
+	if err := json.NewDecoder(conn).Decode(&received); err != nil {
+		t.Fatalf("no message relayed over TLS: %v", err)
+	}
+	if received.Private != sent.Private {
+		t.Fatalf("expected %v, got %v", sent, received)
+	}
+}
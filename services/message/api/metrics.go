@@ -0,0 +1,15 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rebeljah/gosqueak/kit/metrics"
+)
+
+// prekeys in the database, counted by NewServer and kept up to date by the
+// handlers adding and taking them
+var preKeys = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: metrics.Namespace,
+	Name:      "prekeys",
+	Help:      "One-time prekeys stored for every user.",
+})
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+)
+
+// DefaultRateLimits are the limits of the routes of the message server.
+// Prekeys are one-time use, so taking them is limited per user, and per
+// user whose prekeys are taken, so that no one can drain the prekeys of
+// another, even with many accounts.
+func DefaultRateLimits() ratelimit.Routes {
+	perIp := ratelimit.Limit{Burst: 100, Every: time.Millisecond * 100}
+
+	return ratelimit.Routes{
+		ratelimit.DefaultRoute: {Ip: perIp},
+		"GET /prekeys": {
+			Ip:      perIp,
+			Subject: ratelimit.Limit{Burst: 10, Every: time.Second * 6},
+			Target:  ratelimit.Limit{Burst: 20, Every: time.Second * 6},
+		},
+		"POST /prekeys":  {Ip: perIp, Subject: ratelimit.Limit{Burst: 10, Every: time.Second * 6}},
+		"GET /messages":  {Ip: perIp, Subject: ratelimit.Limit{Burst: 20, Every: time.Second}},
+		"POST /messages": {Ip: perIp, Subject: ratelimit.Limit{Burst: 50, Every: time.Millisecond * 200}},
+		"GET /ws":        {Ip: perIp, Subject: ratelimit.Limit{Burst: 5, Every: time.Second * 12}},
+	}
+}
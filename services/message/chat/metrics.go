@@ -0,0 +1,35 @@
+package chat
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rebeljah/gosqueak/kit/metrics"
+)
+
+// delivery labels of the messages counter
+const (
+	// written to the socket of the connected recipient
+	DeliveryLive = "live"
+	// stored for the recipient to fetch later
+	DeliveryStored = "stored"
+)
+
+var (
+	relaySockets = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "relay_sockets",
+		Help:      "Relay sockets currently connected.",
+	})
+
+	messagesDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "messages_total",
+		Help:      "Messages delivered live over the relay or stored offline.",
+	}, []string{"delivery"})
+)
+
+// Count messages stored for their recipients outside of the relay, such as
+// those posted to the message API
+func CountStored(n int) {
+	messagesDelivered.WithLabelValues(DeliveryStored).Add(float64(n))
+}
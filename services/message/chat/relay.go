@@ -1,67 +1,207 @@
 package chat
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/rebeljah/gosqueak/kit/tracing"
 	"github.com/rebeljah/gosqueak/services/message/database"
 )
 
+// close reasons sent to the clients of the relay
+const (
+	CloseShutdown = "server shutting down"
+)
+
+// how long a client gets to receive the close notice when the shutdown
+// context has no deadline
+const CloseWriteTimeout = time.Second * 5
+
 type user struct {
 	uid  string
 	sock *Socket
 }
 
 type Relay struct {
-	db    *sql.DB
-	users map[string]user
-	recv  chan database.Message
+	db   *sql.DB
+	recv chan database.Message
+
+	mu      sync.Mutex
+	users   map[string]user
+	closing bool
+
+	// sockets channeling messages into recv
+	readers sync.WaitGroup
+	// messages being delivered or stored
+	pending sync.WaitGroup
+	// closed when recvLoop returns
+	done chan struct{}
 }
 
-func NewRelay(db *sql.DB) Relay {
-	r := Relay{
+func NewRelay(db *sql.DB) *Relay {
+	r := &Relay{
 		db:    db,
 		users: make(map[string]user),
 		recv:  make(chan database.Message, 0),
+		done:  make(chan struct{}),
 	}
 
 	go r.recvLoop()
 	return r
 }
-func (r Relay) AddUserConnection(uid string, conn net.Conn) {
-	defer r.disconnect(uid)
-
+func (r *Relay) AddUserConnection(uid string, conn net.Conn) {
 	user := user{uid, NewSocket(conn, json.NewEncoder(conn), json.NewDecoder(conn))}
+
+	r.mu.Lock()
+	if r.closing {
+		r.mu.Unlock()
+		user.sock.WriteClose(CloseShutdown)
+		user.sock.Close()
+		return
+	}
 	r.users[uid] = user
+	r.readers.Add(1)
+	r.mu.Unlock()
+
+	relaySockets.Inc()
+
+	defer r.readers.Done()
+	defer r.disconnect(user)
 
 	// usr sock will start putting events into the relay's recv channel
 	user.sock.ChannelMessages(r.recv)
 }
-func (r Relay) recvLoop() {
+func (r *Relay) recvLoop() {
+	defer close(r.done)
+
 	for msg := range r.recv {
-		if user, ok := r.users[msg.ToUid]; ok { // user is connected
-			go user.sock.WriteMessage(msg)
+		r.mu.Lock()
+		user, ok := r.users[msg.ToUid]
+		r.mu.Unlock()
+
+		r.pending.Add(1)
+
+		// the delivery continues the trace of the sender
+		ctx := tracing.Extract(context.Background(), messageCarrier{&msg})
+		ctx, span := tracing.Start(ctx, "relay deliver")
+
+		if ok { // user is connected
+			go func(m database.Message) {
+				defer r.pending.Done()
+
+				// and the recipient continues the trace of the delivery
+				tracing.Inject(ctx, messageCarrier{&m})
+
+				// the user may have gone since, keep the message for later
+				if err := user.sock.WriteMessage(m); err != nil {
+					tracing.End(span, r.store(ctx, m))
+					return
+				}
+				messagesDelivered.WithLabelValues(DeliveryLive).Inc()
+				span.End()
+			}(msg)
 			continue
 		}
 
 		// user not connected, put in DB for recipient to get later
 		go func(m database.Message) {
-			err := database.PostMessages(r.db, m)
-			if err != nil {
-				log.Println("Could not add message to database")
-			}
+			defer r.pending.Done()
+			tracing.End(span, r.store(ctx, m))
 		}(msg)
 	}
 }
-func (r Relay) disconnect(uid string) {
-	user, ok := r.users[uid]
+func (r *Relay) store(ctx context.Context, m database.Message) error {
+	err := database.PostMessages(ctx, r.db, m)
+	if err != nil {
+		slog.Error("could not store message", "to", m.ToUid, "err", err)
+		return err
+	}
+	CountStored(1)
+	return nil
+}
+func (r *Relay) disconnect(u user) {
+	r.mu.Lock()
+	// the user may have reconnected on another socket
+	if current, ok := r.users[u.uid]; ok && current.sock == u.sock {
+		delete(r.users, u.uid)
+	}
+	r.mu.Unlock()
+
+	u.sock.Close()
+	relaySockets.Dec()
+}
+
+// Whether the relay delivers messages, false once it is shutting down
+func (r *Relay) Running() bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.closing
+}
 
+// Shutdown sends the close reason to the connected users and disconnects
+// them, then waits until the messages they sent are delivered or stored.
+// Connections added during or after the shutdown are closed at once.
+func (r *Relay) Shutdown(ctx context.Context, reason string) error {
+	r.mu.Lock()
+	if r.closing {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closing = true
+	users := make([]user, 0, len(r.users))
+	for _, u := range r.users {
+		users = append(users, u)
+	}
+	r.mu.Unlock()
+
+	deadline, ok := ctx.Deadline()
 	if !ok {
-		return
+		deadline = time.Now().Add(CloseWriteTimeout)
 	}
 
-	delete(r.users, uid)
-	user.sock.Close()
+	for _, u := range users {
+		u.sock.Conn.SetWriteDeadline(deadline)
+		u.sock.WriteClose(reason)
+		// unblocks the reader, which then disconnects the user
+		u.sock.Close()
+	}
+
+	// recv is only closed once nothing can send on it anymore
+	if err := wait(ctx, r.readers.Wait); err != nil {
+		return err
+	}
+	close(r.recv)
+
+	if err := wait(ctx, func() { <-r.done }); err != nil {
+		return err
+	}
+
+	return wait(ctx, r.pending.Wait)
+}
+
+// Call f, returning early with the context error if ctx is done first
+func wait(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
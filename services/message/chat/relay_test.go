@@ -0,0 +1,121 @@
+package chat_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rebeljah/gosqueak/kit/tracing"
+	"github.com/rebeljah/gosqueak/services/message/chat"
+	"github.com/rebeljah/gosqueak/services/message/database"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestRelayShutdown(t *testing.T) {
+	db := database.Load(filepath.Join(t.TempDir(), "relay_test.sqlite"))
+	defer db.Close()
+
+	relay := chat.NewRelay(db)
+
+	server, client := net.Pipe()
+	go relay.AddUserConnection("uid1", server)
+
+	// the recipient is offline, so the message must end up in the database
+	offline := database.Message{ToUid: "offline", Private: "pending", KeyId: "key1"}
+	if err := json.NewEncoder(client).Encode(offline); err != nil {
+		t.Fatal(err)
+	}
+
+	notices := make(chan chat.CloseNotice, 1)
+	go func() {
+		var notice chat.CloseNotice
+		json.NewDecoder(client).Decode(&notice)
+		notices <- notice
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err := relay.Shutdown(ctx, chat.CloseShutdown); err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := <-notices; notice.Reason != chat.CloseShutdown {
+		t.Fatalf("wrong close reason: %q", notice.Reason)
+	}
+
+	stored, err := database.GetMessages(context.Background(), db, "offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0] != offline {
+		t.Fatalf("pending message not stored: %v", stored)
+	}
+
+	// connections after the shutdown are turned away
+	server, client = net.Pipe()
+	go relay.AddUserConnection("uid2", server)
+
+	var notice chat.CloseNotice
+	if err := json.NewDecoder(client).Decode(&notice); err != nil || notice.Reason != chat.CloseShutdown {
+		t.Fatalf("late connection not closed: %v %q", err, notice.Reason)
+	}
+}
+
+func TestRelayTraceContext(t *testing.T) {
+	if _, err := tracing.Setup(context.Background(), tracing.Options{Exporter: tracing.ExporterNone}); err != nil {
+		t.Fatal(err)
+	}
+	// spans are recorded, not exported
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	db := database.Load(filepath.Join(t.TempDir(), "relay_test.sqlite"))
+	defer db.Close()
+
+	relay := chat.NewRelay(db)
+
+	senderServer, sender := net.Pipe()
+	recipientServer, recipient := net.Pipe()
+	defer sender.Close()
+	defer recipient.Close()
+	go relay.AddUserConnection("sender", senderServer)
+	go relay.AddUserConnection("recipient", recipientServer)
+
+	received := make(chan database.Message, 1)
+	go func() {
+		var m database.Message
+		json.NewDecoder(recipient).Decode(&m)
+		received <- m
+	}()
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent := "00-" + traceId + "-00f067aa0ba902b7-01"
+	enc := json.NewEncoder(sender)
+
+	// messages sent before the recipient is connected are stored instead
+	for i := 0; i < 50; i++ {
+		m := database.Message{ToUid: "recipient", Private: fmt.Sprint("traced", i), KeyId: "key1", TraceParent: traceparent}
+		if err := enc.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case got := <-received:
+			// the recipient gets the delivery span of the sender's trace
+			if !strings.HasPrefix(got.TraceParent, "00-"+traceId+"-") || got.TraceParent == traceparent {
+				t.Fatalf("traceparent %q not a child of %q", got.TraceParent, traceparent)
+			}
+			return
+		case <-time.After(time.Millisecond * 20):
+		}
+	}
+	t.Fatal("message not delivered")
+}
@@ -3,6 +3,7 @@ package chat
 import (
 	"encoding/json"
 	"net"
+	"sync"
 
 	"github.com/rebeljah/gosqueak/services/message/database"
 )
@@ -12,10 +13,18 @@ type Message struct {
 	Private []byte
 }
 
+// Sent to the client before the server closes the socket, in place of a
+// message
+type CloseNotice struct {
+	Reason string `json:"close"`
+}
+
 type Socket struct {
 	Conn    net.Conn
 	encoder *json.Encoder
 	decoder *json.Decoder
+	// the relay and the shutdown write concurrently
+	writeMu sync.Mutex
 }
 
 func NewSocket(c net.Conn, enc *json.Encoder, dec *json.Decoder) *Socket {
@@ -30,8 +39,15 @@ func (s *Socket) ReadMessage() (m database.Message, err error) {
 	return
 }
 func (s *Socket) WriteMessage(m database.Message) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
 	return s.encoder.Encode(m)
 }
+func (s *Socket) WriteClose(reason string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.encoder.Encode(CloseNotice{reason})
+}
 func (s *Socket) ChannelMessages(ln chan<- database.Message) {
 	for {
 		message, err := s.ReadMessage()
@@ -46,3 +62,32 @@ func (s *Socket) ChannelMessages(ln chan<- database.Message) {
 func (s *Socket) Close() {
 	s.Conn.Close()
 }
+
+// messageCarrier is the propagation.TextMapCarrier of the trace context
+// sent along with a message
+type messageCarrier struct {
+	m *database.Message
+}
+
+func (c messageCarrier) Get(key string) string {
+	switch key {
+	case "traceparent":
+		return c.m.TraceParent
+	case "tracestate":
+		return c.m.TraceState
+	}
+	return ""
+}
+
+func (c messageCarrier) Set(key, value string) {
+	switch key {
+	case "traceparent":
+		c.m.TraceParent = value
+	case "tracestate":
+		c.m.TraceState = value
+	}
+}
+
+func (c messageCarrier) Keys() []string {
+	return []string{"traceparent", "tracestate"}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rebeljah/gosqueak/jwt"
+	"github.com/rebeljah/gosqueak/kit/config"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/server"
+	"github.com/rebeljah/gosqueak/services/message/api"
+	"github.com/rebeljah/gosqueak/services/message/database"
+)
+
+// prefix of the environment variables configuring the message server
+const EnvPrefix = "GOSQUEAK_MESSAGE_"
+
+// name of the message server in its spans
+const ServiceName = "gosqueak-message"
+
+// Configuration of the message server, see DefaultConfig for the defaults.
+// Secrets such as the client secret are only read from the environment.
+type Config struct {
+	Addr string `yaml:"addr" toml:"addr" env:"ADDR" flag:"addr" usage:"listen address"`
+	Db   string `yaml:"db" toml:"db" env:"DB" flag:"db" usage:"messages database file"`
+	// base URL of the auth server, serving the JWKS, the deny-list and the
+	// token endpoint
+	AuthUrl string `yaml:"auth_url" toml:"auth_url" env:"AUTH_URL" flag:"auth-url" usage:"base URL of the auth server"`
+	// audience name of the message server, and its client id at the auth
+	// server
+	Name string `yaml:"name" toml:"name" env:"NAME" flag:"name" usage:"audience name and client id"`
+	// issuer name of the auth server, the audience of its service tokens
+	AuthName string `yaml:"auth_name" toml:"auth_name" env:"AUTH_NAME" flag:"auth-name" usage:"issuer name of the auth server"`
+	// the client authenticates with the key in ClientKeyFile if it exists,
+	// or else with the secret in ClientSecretEnv
+	ClientKeyFile string `yaml:"client_key_file" toml:"client_key_file" env:"CLIENT_KEY_FILE" flag:"client-key-file" usage:"private key of the client"`
+	ClientKeyAlg  string `yaml:"client_key_alg" toml:"client_key_alg" env:"CLIENT_KEY_ALG" flag:"client-key-alg" usage:"signing algorithm of the client key"`
+	// TLS, logs and traces, shared with the other binaries
+	server.Config `yaml:",inline"`
+	// TLS towards the auth server: the CA of its certificate, such as its
+	// self-signed certificate, and the client certificate for mutual TLS
+	AuthCa         string `yaml:"auth_ca" toml:"auth_ca" env:"AUTH_CA" flag:"auth-ca" usage:"CA file of the auth server certificate, instead of the system roots"`
+	AuthClientCert string `yaml:"auth_client_cert" toml:"auth_client_cert" env:"AUTH_CLIENT_CERT" flag:"auth-client-cert" usage:"client certificate presented to the auth server"`
+	AuthClientKey  string `yaml:"auth_client_key" toml:"auth_client_key" env:"AUTH_CLIENT_KEY" flag:"auth-client-key" usage:"private key of the client certificate"`
+	// token buckets per client IP and per token subject, keyed by route
+	// pattern, with "*" for the other routes; only set by the config file
+	RateLimits ratelimit.Routes `yaml:"rate_limits" toml:"rate_limits"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:          "127.0.0.1:8082",
+		Db:            database.DbFileName,
+		AuthUrl:       "http://127.0.0.1:8081",
+		Name:          "MESSAGE_API",
+		AuthName:      "AUTHSERV",
+		ClientKeyFile: "client.private",
+		ClientKeyAlg:  jwt.AlgES256,
+		Config:        server.DefaultConfig(),
+		RateLimits:    api.DefaultRateLimits(),
+	}
+}
+
+func (c *Config) Validate() error {
+	if err := config.CheckAddr("addr", c.Addr); err != nil {
+		return err
+	}
+
+	if err := config.CheckUrl("auth-url", c.AuthUrl); err != nil {
+		return err
+	}
+
+	err := config.CheckNotEmpty(map[string]string{
+		"db":        c.Db,
+		"name":      c.Name,
+		"auth-name": c.AuthName,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.RateLimits.Validate(); err != nil {
+		return err
+	}
+
+	if (c.AuthClientCert == "") != (c.AuthClientKey == "") {
+		return fmt.Errorf("auth-client-cert and auth-client-key must be set together")
+	}
+	if (c.AuthCa != "" || c.AuthClientCert != "") && !strings.HasPrefix(c.AuthUrl, "https://") {
+		return fmt.Errorf("auth-ca and auth-client-cert need an https auth-url")
+	}
+
+	switch c.ClientKeyAlg {
+	case jwt.AlgRS256, jwt.AlgPS256, jwt.AlgES256, jwt.AlgEdDSA:
+	default:
+		return fmt.Errorf("client-key-alg: unsupported algorithm %q", c.ClientKeyAlg)
+	}
+
+	return nil
+}
+
+func (c *Config) JwksUrl() string {
+	return c.authEndpoint("/.well-known/jwks.json")
+}
+
+func (c *Config) DenyListUrl() string {
+	return c.authEndpoint("/revoked")
+}
+
+func (c *Config) TokenUrl() string {
+	return c.authEndpoint("/token")
+}
+
+func (c *Config) authEndpoint(path string) string {
+	return strings.TrimSuffix(c.AuthUrl, "/") + path
+}
@@ -1,29 +1,137 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+
 	"github.com/rebeljah/gosqueak/jwt"
-	"github.com/rebeljah/gosqueak/jwt/rs256"
+	"github.com/rebeljah/gosqueak/jwt/keyfile"
+	"github.com/rebeljah/gosqueak/jwt/oauth"
+	"github.com/rebeljah/gosqueak/kit/certs"
+	"github.com/rebeljah/gosqueak/kit/config"
+	"github.com/rebeljah/gosqueak/kit/logging"
+	"github.com/rebeljah/gosqueak/kit/ratelimit"
+	"github.com/rebeljah/gosqueak/kit/tracing"
 	"github.com/rebeljah/gosqueak/services/message/api"
-	"github.com/rebeljah/gosqueak/services/message/database"
 	"github.com/rebeljah/gosqueak/services/message/chat"
+	"github.com/rebeljah/gosqueak/services/message/database"
 )
 
+// secrets are not part of the Config, so they stay out of config files
 const (
-	ApiAddr         = "127.0.0.1:8082"
-	AuthServerUrl   = "http://127.0.0.1:8081"
-	JwtKeyPublicUrl = AuthServerUrl + "/jwtkeypub"
-	JwtActorName    = "MESSAGE_API"
+	ClientKeyPassphraseEnv = "GOSQUEAK_CLIENT_KEY_PASSPHRASE"
+	ClientSecretEnv        = "GOSQUEAK_CLIENT_SECRET"
 )
 
 func main() {
-	db := database.Load(database.DbFileName)
-	defer db.Close()
+	cfg := DefaultConfig()
+	config.MustLoad(&cfg, EnvPrefix)
+
+	// before anything logs, the standard logger writes to it too
+	logger, err := logging.NewLogger(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	stopTracing, err := tracing.Setup(context.Background(), cfg.TraceOptions(ServiceName))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// flushes the spans of the shutdown
+	defer stopTracing(context.Background())
+
+	db := database.Load(cfg.Db)
+
+	// keys are refreshed in the background, the auth server does not
+	// need to be up before the message server starts
+	client := authClient(&cfg)
+	keys := jwt.NewRemoteKeySet(cfg.JwksUrl(), client)
+	defer keys.Close()
+
+	// service token of the message server, for the deny-list
+	tokens := oauth.NewTokenSource(cfg.TokenUrl(), cfg.AuthName, clientAuth(&cfg), client)
 
 	// api handles async messages and provides JWT to access the live msg server
 	// api endpoints receive a JWT generated by external auth, then api can then
 	// independtly verify this JWT.
-	aud := jwt.NewAudience(rs256.FetchRsaPublicKey(JwtKeyPublicUrl), JwtActorName)
-	apiServ := api.NewServer(ApiAddr, db, aud, chat.NewRelay(db))
+	aud := jwt.NewKeySetAudience(keys, cfg.Name)
+	deny := jwt.NewRemoteDenyList(cfg.DenyListUrl(), tokens.Client())
+	apiServ := api.NewServer(cfg.Addr, db, aud, deny, chat.NewRelay(db))
+	apiServ.UseRateLimits(ratelimit.NewLimiter(ratelimit.NewMemoryStore(), cfg.RateLimits))
+
+	// not ready to verify tokens until the keys are fetched
+	apiServ.Ready().Add("auth_keys", func(context.Context) error {
+		if !keys.Fresh() {
+			return fmt.Errorf("keys of %v not fetched recently", cfg.JwksUrl())
+		}
+		return nil
+	})
+
+	tlsCfg, err := certs.ServerConfig(cfg.TlsOptions(cfg.Addr))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsCfg != nil {
+		apiServ.UseTLS(tlsCfg)
+	}
 
 	apiServ.Run()
 }
+
+// The client of every request to the auth server, trusting cfg.AuthCa and
+// presenting the client certificate for mutual TLS when they are set
+func authClient(cfg *Config) *http.Client {
+	tlsCfg, err := certs.ClientConfig(cfg.AuthCa, cfg.AuthClientCert, cfg.AuthClientKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	// requests made while handling one continue its trace and carry its id
+	return &http.Client{
+		Transport: tracing.Transport(logging.Transport(transport)),
+		Timeout:   jwt.KeyFetchTimeout,
+	}
+}
+
+// the message server is the client cfg.Name of the auth server
+func clientAuth(cfg *Config) oauth.ClientAuth {
+	b, err := os.ReadFile(cfg.ClientKeyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		// without a credential every deny-list check, and so every
+		// authenticated request, would fail
+		secret := os.Getenv(ClientSecretEnv)
+		if secret == "" {
+			log.Fatalf(
+				"no client credential: %v does not exist and $%v is empty, "+
+					"register the client %v with gosqueak-clients",
+				cfg.ClientKeyFile, ClientSecretEnv, cfg.Name,
+			)
+		}
+		return oauth.ClientSecret(cfg.Name, secret)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	priv, err := keyfile.ParsePrivateKey(b, []byte(os.Getenv(ClientKeyPassphraseEnv)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signer, err := jwt.NewSigner(cfg.ClientKeyAlg, priv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return oauth.PrivateKeyJwt(cfg.Name, signer, cfg.AuthName)
+}
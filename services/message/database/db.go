@@ -1,9 +1,11 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/rebeljah/gosqueak/kit/tracing"
 )
 
 const DbFileName = "data.sqlite"
@@ -23,6 +25,10 @@ type Message struct {
 	ToUid   string `json:"toUid"`
 	Private string `json:"private"`
 	KeyId   string `json:"keyId"`
+	// W3C trace context of the sender, carried over the relay socket and
+	// not stored
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
 }
 
 //
@@ -57,11 +63,14 @@ func Load(fp string) *sql.DB {
 	return db
 }
 
-func GetPreKey(db *sql.DB, fromUid string) (PreKey, error) {
+func GetPreKey(ctx context.Context, db *sql.DB, fromUid string) (PreKey, error) {
+	ctx, done := tracing.Query(ctx, "GetPreKey")
+	defer done()
+
 	var preKey PreKey
 
 	stmt := "SELECT keyId, fromUid, key FROM preKeys WHERE fromUid=?"
-	row := db.QueryRow(stmt, fromUid)
+	row := db.QueryRowContext(ctx, stmt, fromUid)
 
 	err := row.Scan(&preKey.KeyId, &preKey.FromUid, &preKey.Key)
 	if err != nil {
@@ -69,7 +78,7 @@ func GetPreKey(db *sql.DB, fromUid string) (PreKey, error) {
 	}
 
 	stmt = "DELETE FROM preKeys WHERE key=?"
-	_, err = db.Exec(stmt, preKey.Key)
+	_, err = db.ExecContext(ctx, stmt, preKey.Key)
 	if err != nil {
 		return preKey, err
 	}
@@ -77,7 +86,20 @@ func GetPreKey(db *sql.DB, fromUid string) (PreKey, error) {
 	return preKey, nil
 }
 
-func PostPreKeys(db *sql.DB, keys []PreKey) error {
+// The number of prekeys stored for every user
+func CountPreKeys(ctx context.Context, db *sql.DB) (int64, error) {
+	ctx, done := tracing.Query(ctx, "CountPreKeys")
+	defer done()
+
+	var n int64
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM preKeys").Scan(&n)
+	return n, err
+}
+
+func PostPreKeys(ctx context.Context, db *sql.DB, keys []PreKey) error {
+	ctx, done := tracing.Query(ctx, "PostPreKeys")
+	defer done()
+
 	var stmt string
 	args := make([]any, 0, 3*len(keys))
 
@@ -86,16 +108,19 @@ func PostPreKeys(db *sql.DB, keys []PreKey) error {
 		args = append(args, k.FromUid, k.Key, k.KeyId)
 	}
 
-	_, err := db.Exec(stmt, args...)
+	_, err := db.ExecContext(ctx, stmt, args...)
 
 	return err
 }
 
-func GetMessages(db *sql.DB, toUid string) ([]Message, error) {
+func GetMessages(ctx context.Context, db *sql.DB, toUid string) ([]Message, error) {
+	ctx, done := tracing.Query(ctx, "GetMessages")
+	defer done()
+
 	messages := make([]Message, 0)
 
 	stmt := "SELECT private, keyId FROM messages WHERE toUid=?"
-	rows, err := db.Query(stmt, toUid)
+	rows, err := db.QueryContext(ctx, stmt, toUid)
 
 	if err != nil {
 		return messages, err
@@ -120,7 +145,10 @@ func GetMessages(db *sql.DB, toUid string) ([]Message, error) {
 	return messages, nil
 }
 
-func PostMessages(db *sql.DB, messages ...Message) error {
+func PostMessages(ctx context.Context, db *sql.DB, messages ...Message) error {
+	ctx, done := tracing.Query(ctx, "PostMessages")
+	defer done()
+
 	var stmt string
 	args := make([]any, 0)
 
@@ -129,6 +157,30 @@ func PostMessages(db *sql.DB, messages ...Message) error {
 		args = append(args, msg.ToUid, msg.Private, msg.KeyId)
 	}
 
-	_, err := db.Exec(stmt, args...)
+	_, err := db.ExecContext(ctx, stmt, args...)
 	return err
 }
+
+// Delete every prekey of the user, returning how many were deleted
+func DeletePreKeys(ctx context.Context, db *sql.DB, fromUid string) (int64, error) {
+	ctx, done := tracing.Query(ctx, "DeletePreKeys")
+	defer done()
+
+	res, err := db.ExecContext(ctx, "DELETE FROM preKeys WHERE fromUid=?", fromUid)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Delete every stored message for the user, returning how many were deleted
+func DeleteMessages(ctx context.Context, db *sql.DB, toUid string) (int64, error) {
+	ctx, done := tracing.Query(ctx, "DeleteMessages")
+	defer done()
+
+	res, err := db.ExecContext(ctx, "DELETE FROM messages WHERE toUid=?", toUid)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
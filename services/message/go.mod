@@ -1,8 +1,13 @@
 module github.com/rebeljah/gosqueak/services/message
 
-go 1.18
+go 1.22
 
 require (
 	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/prometheus/client_golang v1.22.0
 	github.com/rebeljah/gosqueak/jwt v0.0.0-20221127075846-6d7df96b1b31
+	github.com/rebeljah/gosqueak/kit v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.31.0
+	go.opentelemetry.io/otel/sdk v1.31.0
+	go.opentelemetry.io/otel/trace v1.31.0
 )